@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net"
 	"os"
 
 	"github.com/keaganluttrell/ten/factotum"
+	"github.com/keaganluttrell/ten/kernel"
 )
 
 func main() {
@@ -25,7 +28,23 @@ func main() {
 		*vfsAddr = v
 	}
 
-	if err := factotum.StartServer(*addr, *data, *vfsAddr); err != nil {
+	// TLS: serve it if TLS_CERT is set, and reach VFS at tls!host!port
+	host, _ := kernel.LoadHostIdentity()
+	settings, err := kernel.LoadTLSSettings(host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConf *tls.Config
+	if settings != nil && settings.Cert != nil {
+		if tlsConf, err = settings.ServerConfig(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	factotum.Dial = func(addr string) (net.Conn, error) {
+		return kernel.DialNet(addr, settings)
+	}
+
+	if err := factotum.StartServer(*addr, *data, *vfsAddr, tlsConf); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
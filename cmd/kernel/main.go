@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/keaganluttrell/ten/kernel"
 )
@@ -41,6 +45,28 @@ func main() {
 		*keyPath = v
 	}
 
+	// Graceful shutdown: drain sessions for up to SHUTDOWN_TIMEOUT on SIGTERM/SIGINT
+	grace := 10 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid SHUTDOWN_TIMEOUT: %v", err)
+		}
+		grace = d
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sig
+		log.Printf("Received %v, shutting down (timeout %v)", s, grace)
+		signal.Stop(sig) // A second signal kills the process
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := kernel.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+
 	if err := kernel.StartServer(*addr, *vfsAddr, *wsAddr, *keyPath); err != nil {
 		log.Fatal(err)
 	}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/keaganluttrell/ten/kernel"
@@ -16,8 +19,76 @@ import (
 var (
 	kernelAddr = flag.String("kernel", "127.0.0.1:9000", "Kernel address")
 	user       = flag.String("user", "glenda", "User name")
+	keyFile    = flag.String("key", "", "File holding the user's base64 Ed25519 private key (authenticates via Tauth)")
+	ticketFile = flag.String("ticket", "", "File holding a signed ticket to attach with")
 )
 
+// authenticate runs the ed25519 conversation with factotum over a Tauth afid:
+// start, read the challenge, write its signature, read the ticket.
+func authenticate(client *kernel.Client, user, keyFile string) (uint32, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return p9.NOFID, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return p9.NOFID, fmt.Errorf("%s: not a base64 ed25519 private key", keyFile)
+	}
+
+	rpc := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("%s", resp.Ename)
+		}
+		return resp, nil
+	}
+	write := func(afid uint32, msg string) error {
+		_, err := rpc(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: []byte(msg), Count: uint32(len(msg))})
+		return err
+	}
+	read := func(afid uint32) (string, error) {
+		resp, err := rpc(&p9.Fcall{Type: p9.Tread, Fid: afid, Count: 8192})
+		if err != nil {
+			return "", err
+		}
+		return string(resp.Data), nil
+	}
+
+	afid := client.NextFid()
+	if _, err := rpc(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: user, Aname: ""}); err != nil {
+		return p9.NOFID, err
+	}
+	if err := write(afid, "start proto=ed25519 role=auth user="+user); err != nil {
+		return p9.NOFID, err
+	}
+	challenge, err := read(afid)
+	if err != nil {
+		return p9.NOFID, err
+	}
+	var nonce []byte
+	for _, f := range strings.Fields(challenge) {
+		if v, ok := strings.CutPrefix(f, "challenge="); ok {
+			nonce, _ = base64.StdEncoding.DecodeString(v)
+		}
+	}
+	if len(nonce) == 0 {
+		return p9.NOFID, fmt.Errorf("unexpected reply: %s", challenge)
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), nonce)
+	if err := write(afid, "write "+base64.StdEncoding.EncodeToString(sig)); err != nil {
+		return p9.NOFID, err
+	}
+	if reply, err := read(afid); err != nil {
+		return p9.NOFID, err
+	} else if !strings.HasPrefix(reply, "ok") {
+		return p9.NOFID, fmt.Errorf("unexpected reply: %s", reply)
+	}
+	return afid, nil
+}
+
 type Shell struct {
 	client *kernel.Client
 	cwd    string
@@ -29,7 +100,13 @@ func main() {
 
 	fmt.Printf("Connecting to Kernel at %s...\n", *kernelAddr)
 
+	// tls!host!port honours TLS_CA, TLS_PINS and a client TLS_CERT
 	dialer := kernel.NewNetworkDialer()
+	settings, err := kernel.LoadTLSSettings(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer.TLS = settings
 	client, err := dialer.Dial(*kernelAddr)
 	if err != nil {
 		log.Fatalf("Failed to dial kernel: %v", err)
@@ -41,13 +118,30 @@ func main() {
 		log.Fatalf("Version negotiation failed: %v", err)
 	}
 
+	afid := uint32(p9.NOFID)
+	if *keyFile != "" {
+		afid, err = authenticate(client, *user, *keyFile)
+		if err != nil {
+			log.Fatalf("Auth failed: %v", err)
+		}
+	}
+
+	aname := "/"
+	if *ticketFile != "" {
+		data, err := os.ReadFile(*ticketFile)
+		if err != nil {
+			log.Fatalf("Read ticket failed: %v", err)
+		}
+		aname = strings.TrimSpace(string(data))
+	}
+
 	rootFid := client.NextFid()
 	attachReq := &p9.Fcall{
 		Type:  p9.Tattach,
 		Fid:   rootFid,
-		Afid:  p9.NOFID,
+		Afid:  afid,
 		Uname: *user,
-		Aname: "/",
+		Aname: aname,
 	}
 	if _, err := client.RPC(attachReq); err != nil {
 		log.Fatalf("Attach failed: %v", err)
@@ -71,7 +165,16 @@ func main() {
 			continue
 		}
 
-		args := strings.Fields(line)
+		// name=value or name=(list) sets a variable in /env, as in rc
+		if name, list, ok := assignment(line); ok {
+			shell.setenv(name, list)
+			continue
+		}
+
+		args := shell.expand(strings.Fields(line))
+		if len(args) == 0 {
+			continue
+		}
 		cmd := args[0]
 
 		switch cmd {
@@ -163,6 +266,105 @@ func main() {
 	}
 }
 
+// assignment parses "name=value" or "name=(a b c)". An empty value or ()
+// is the empty list, which removes the variable.
+func assignment(line string) (string, []string, bool) {
+	name, val, ok := strings.Cut(line, "=")
+	if !ok || name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	}) >= 0 {
+		return "", nil, false
+	}
+	val = strings.TrimSpace(val)
+	if strings.HasPrefix(val, "(") && strings.HasSuffix(val, ")") {
+		return name, strings.Fields(val[1 : len(val)-1]), true
+	}
+	if val == "" {
+		return name, nil, true
+	}
+	return name, []string{val}, true
+}
+
+// expand replaces $name with the elements of the variable and $#name with
+// their count.
+func (s *Shell) expand(args []string) []string {
+	var out []string
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "$#") && len(a) > 2:
+			out = append(out, strconv.Itoa(len(s.getenv(a[2:]))))
+		case strings.HasPrefix(a, "$") && len(a) > 1:
+			out = append(out, s.getenv(a[1:])...)
+		default:
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// getenv reads /env/name as an rc list: elements each followed by a NUL.
+// A value written without NULs is one element.
+func (s *Shell) getenv(name string) []string {
+	fid := s.client.NextFid()
+	resp, err := s.client.RPC(&p9.Fcall{Type: p9.Twalk, Fid: s.cwdFid, Newfid: fid, Wname: []string{"env", name}})
+	if err != nil || resp.Type == p9.Rerror || len(resp.Wqid) != 2 {
+		return nil
+	}
+	defer s.client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: fid})
+	if resp, err := s.client.RPC(&p9.Fcall{Type: p9.Topen, Fid: fid, Mode: p9.OREAD}); err != nil || resp.Type == p9.Rerror {
+		return nil
+	}
+
+	var data []byte
+	for {
+		resp, err := s.client.RPC(&p9.Fcall{Type: p9.Tread, Fid: fid, Offset: uint64(len(data)), Count: 8192})
+		if err != nil || resp.Type == p9.Rerror || len(resp.Data) == 0 {
+			break
+		}
+		data = append(data, resp.Data...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// setenv writes list to /env/name, NUL-terminating each element. The empty
+// list removes the variable.
+func (s *Shell) setenv(name string, list []string) {
+	fid := s.client.NextFid()
+	resp, err := s.client.RPC(&p9.Fcall{Type: p9.Twalk, Fid: s.cwdFid, Newfid: fid, Wname: []string{"env", name}})
+	exists := err == nil && resp.Type != p9.Rerror && len(resp.Wqid) == 2
+	defer s.client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: fid})
+
+	if len(list) == 0 {
+		if exists {
+			s.client.RPC(&p9.Fcall{Type: p9.Tremove, Fid: fid})
+		}
+		return
+	}
+
+	if exists {
+		resp, err = s.client.RPC(&p9.Fcall{Type: p9.Topen, Fid: fid, Mode: p9.OWRITE | p9.OTRUNC})
+	} else {
+		if resp, err = s.client.RPC(&p9.Fcall{Type: p9.Twalk, Fid: s.cwdFid, Newfid: fid, Wname: []string{"env"}}); err == nil && resp.Type != p9.Rerror {
+			resp, err = s.client.RPC(&p9.Fcall{Type: p9.Tcreate, Fid: fid, Name: name, Perm: 0644, Mode: p9.OWRITE})
+		}
+	}
+	if err == nil && resp.Type == p9.Rerror {
+		err = fmt.Errorf("%s", resp.Ename)
+	}
+	if err != nil {
+		fmt.Printf("%s: %v\n", name, err)
+		return
+	}
+
+	data := []byte(strings.Join(list, "\x00") + "\x00")
+	if resp, err := s.client.RPC(&p9.Fcall{Type: p9.Twrite, Fid: fid, Data: data, Count: uint32(len(data))}); err != nil || resp.Type == p9.Rerror {
+		fmt.Printf("%s: write failed\n", name)
+	}
+}
+
 func (s *Shell) absPath(p string) string {
 	if strings.HasPrefix(p, "/") {
 		return p
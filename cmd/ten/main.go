@@ -0,0 +1,225 @@
+// Command ten boots the Kernel, VFS, Factotum and SSR in one process.
+// The services reach each other over an in-process PipeDialer at the
+// addresses lib/namespace names, so the seeded tree works unchanged.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/keaganluttrell/ten/factotum"
+	"github.com/keaganluttrell/ten/kernel"
+	"github.com/keaganluttrell/ten/ssr"
+	"github.com/keaganluttrell/ten/vfs"
+)
+
+// In-process service addresses, as written in vfs/fs/lib/namespace.
+const (
+	vfsAddr      = "tcp!vfs!9001"
+	factotumAddr = "tcp!factotum!9002"
+	ssrAddr      = "tcp!ssr!8080"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "Kernel TCP address (Env: ADDR)")
+	wsAddr := flag.String("ws", ":9009", "Kernel WebSocket address (Env: WS_ADDR)")
+	httpAddr := flag.String("http", ":8080", "SSR HTTP address (Env: HTTP_ADDR)")
+	root := flag.String("root", "", "Data root directory; a temporary one if empty (Env: DATA_ROOT)")
+	templates := flag.String("templates", "ssr/templates", "SSR templates directory (Env: TEMPLATES_DIR)")
+	static := flag.String("static", "ssr/static", "SSR static directory (Env: STATIC_DIR)")
+	flag.Parse()
+
+	// Env fallback
+	if v := os.Getenv("ADDR"); v != "" && !isFlagPassed("addr") {
+		*addr = v
+	}
+	if v := os.Getenv("WS_ADDR"); v != "" && !isFlagPassed("ws") {
+		*wsAddr = v
+	}
+	if v := os.Getenv("HTTP_ADDR"); v != "" && !isFlagPassed("http") {
+		*httpAddr = v
+	}
+	if v := os.Getenv("DATA_ROOT"); v != "" && !isFlagPassed("root") {
+		*root = v
+	}
+	if v := os.Getenv("TEMPLATES_DIR"); v != "" && !isFlagPassed("templates") {
+		*templates = v
+	}
+	if v := os.Getenv("STATIC_DIR"); v != "" && !isFlagPassed("static") {
+		*static = v
+	}
+
+	if *root == "" {
+		dir, err := os.MkdirTemp("", "ten-")
+		if err != nil {
+			log.Fatal(err)
+		}
+		*root = dir
+	}
+	log.Printf("ten: root=%s", *root)
+
+	host, err := hostIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SSR reaches the Kernel at ADDR
+	kernelHost, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		log.Fatalf("invalid ADDR: %v", err)
+	}
+	if kernelHost == "" {
+		kernelHost = "localhost"
+	}
+	sys, err := boot(*root, host, net.JoinHostPort(kernelHost, port), *templates, *static)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Printf("SSR listening on %s", *httpAddr)
+		if err := http.ListenAndServe(*httpAddr, sys.view); err != nil {
+			log.Fatalf("SSR: %v", err)
+		}
+	}()
+
+	// Graceful shutdown, as cmd/kernel
+	grace := 10 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid SHUTDOWN_TIMEOUT: %v", err)
+		}
+		grace = d
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sig
+		log.Printf("Received %v, shutting down (timeout %v)", s, grace)
+		signal.Stop(sig) // A second signal kills the process
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := kernel.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+
+	// The Kernel refreshes signing keys only from a configured address
+	if os.Getenv("FACTOTUM_ADDR") == "" {
+		os.Setenv("FACTOTUM_ADDR", factotumAddr)
+	}
+	keyPath := filepath.Join(sys.dataPath, "signing.pub")
+	if err := kernel.StartServerWithDialer(*addr, vfsAddr, *wsAddr, keyPath, sys.pipes); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// hostIdentity loads the Kernel's key from HOST_KEY_BASE64. If the variable
+// is unset, a key is generated and put there for the Kernel to load; a
+// malformed one is an error, not a reason to make up another key.
+func hostIdentity() (*kernel.HostIdentity, error) {
+	if os.Getenv("HOST_KEY_BASE64") != "" {
+		return kernel.LoadHostIdentity()
+	}
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	os.Setenv("HOST_KEY_BASE64", base64.StdEncoding.EncodeToString(priv))
+	return &kernel.HostIdentity{Key: priv}, nil
+}
+
+// system is the services ten runs behind the Kernel, wired over pipes.
+type system struct {
+	pipes    *kernel.PipeDialer
+	view     *ssr.Server
+	dataPath string // Factotum's data directory, with signing.pub
+}
+
+// boot seeds root and starts VFS, Factotum and SSR on a PipeDialer. VFS
+// trusts host; SSR reaches the Kernel at kernelAddr.
+func boot(root string, host *kernel.HostIdentity, kernelAddr, templates, static string) (*system, error) {
+	if err := vfs.Seed(root); err != nil {
+		return nil, fmt.Errorf("seed %s: %w", root, err)
+	}
+	trustedKey := base64.StdEncoding.EncodeToString(host.Key.Public().(ed25519.PublicKey))
+
+	pipes := kernel.NewPipeDialer()
+	pipes.Fallback = kernel.NewNetworkDialer()
+
+	// VFS
+	backend, err := vfs.NewLocalBackend(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := serve(pipes, vfsAddr, func(ln net.Listener) error {
+		return vfs.Serve(ln, backend, trustedKey)
+	}); err != nil {
+		return nil, err
+	}
+
+	// Factotum generates its signing key in /adm/factotum if there is none
+	factotum.Dial = pipes.DialConn
+	dataPath := filepath.Join(root, "adm", "factotum")
+	auth, err := factotum.NewServer(factotum.Config{
+		ListenAddr: factotumAddr,
+		DataPath:   dataPath,
+		VFSAddr:    vfsAddr,
+		KeyGrace:   factotum.DefaultTTL,
+		HostKey:    host.Key.Public().(ed25519.PublicKey),
+		SetupToken: os.Getenv("SETUP_TOKEN"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := serve(pipes, factotumAddr, auth.Serve); err != nil {
+		return nil, err
+	}
+
+	// SSR at its namespace address; main also serves it on HTTP
+	view := ssr.NewServer(kernelAddr, factotumAddr)
+	view.Dialer = pipes
+	view.TemplatesDir = templates
+	view.StaticDir = static
+	if err := serve(pipes, ssrAddr, func(ln net.Listener) error {
+		return http.Serve(ln, view)
+	}); err != nil {
+		return nil, err
+	}
+	return &system{pipes: pipes, view: view, dataPath: dataPath}, nil
+}
+
+// serve listens on addr in pipes and runs fn on the listener. The process
+// cannot do without any of its services, so fn returning is fatal.
+func serve(pipes *kernel.PipeDialer, addr string, fn func(net.Listener) error) error {
+	ln, err := pipes.Listen(addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := fn(ln)
+		log.Fatalf("%s: serve: %v", addr, err)
+	}()
+	return nil
+}
+
+func isFlagPassed(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keaganluttrell/ten/kernel"
+	p9 "github.com/keaganluttrell/ten/pkg/9p"
+)
+
+// pipeTransport carries a Kernel session over one end of a net.Pipe.
+type pipeTransport struct{ net.Conn }
+
+func (t pipeTransport) ReadMsg(ctx context.Context) (*p9.Fcall, error) {
+	return p9.ReadFcall(t.Conn)
+}
+
+func (t pipeTransport) WriteMsg(ctx context.Context, b []byte) error {
+	_, err := t.Conn.Write(b)
+	return err
+}
+
+func TestBoot(t *testing.T) {
+	t.Setenv("HOST_KEY_BASE64", "")
+	host, err := hostIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	sys, err := boot(root, host, "localhost:9000", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A Kernel session over the pipes builds the seeded namespace
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	s := kernel.NewSession(pipeTransport{c2}, vfsAddr, kernel.NewTrustedKeys(nil), host, sys.pipes)
+	go s.Serve()
+
+	tag := uint16(0)
+	rpc := func(req *p9.Fcall) *p9.Fcall {
+		t.Helper()
+		tag++
+		req.Tag = tag
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c1.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p9.ReadFcall(c1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Type == p9.Rerror {
+			t.Fatalf("%v: %s", req, resp.Ename)
+		}
+		return resp
+	}
+	rpc(&p9.Fcall{Type: p9.Tversion, Tag: p9.NOTAG, Msize: 8192, Version: "9P2000"})
+	rpc(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "none"})
+	rpc(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"lib", "namespace"}})
+	rpc(&p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OREAD})
+	got := rpc(&p9.Fcall{Type: p9.Tread, Fid: 1, Count: 4096}).Data
+
+	want, err := os.ReadFile(filepath.Join(root, "lib", "namespace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("/lib/namespace reads %q, want %q", got, want)
+	}
+}
+
+func TestHostIdentity(t *testing.T) {
+	t.Setenv("HOST_KEY_BASE64", "")
+	host, err := hostIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated key is left for the Kernel to load
+	loaded, err := kernel.LoadHostIdentity()
+	if err != nil || !loaded.Key.Equal(host.Key) {
+		t.Fatalf("HOST_KEY_BASE64 not set to the generated key: %v", err)
+	}
+	if again, err := hostIdentity(); err != nil || !again.Key.Equal(host.Key) {
+		t.Fatalf("a set key was replaced: %v", err)
+	}
+
+	for _, bad := range []string{"not base64!", "c2hvcnQ="} {
+		t.Setenv("HOST_KEY_BASE64", bad)
+		if _, err := hostIdentity(); err == nil {
+			t.Errorf("HOST_KEY_BASE64=%q accepted", bad)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net"
 	"os"
 
+	"github.com/keaganluttrell/ten/kernel"
 	"github.com/keaganluttrell/ten/vfs"
 )
 
@@ -12,6 +15,8 @@ func main() {
 	addr := flag.String("addr", ":9001", "Address to listen on (Env: ADDR)")
 	root := flag.String("root", "/tmp/ten-data", "Data root directory (Env: DATA_ROOT)")
 	authKey := flag.String("auth", "", "Trusted host public key (Env: TRUSTED_KEY)")
+	announce := flag.String("announce", "", "Kernel announce address to dial out to (Env: ANNOUNCE_ADDR)")
+	name := flag.String("name", "vfs", "Service name when announcing (Env: SERVICE_NAME)")
 	flag.Parse()
 
 	// Env var override (optional, or prefer flags)
@@ -25,7 +30,50 @@ func main() {
 		*authKey = v
 	}
 
-	if err := vfs.StartServer(*addr, *root, *authKey); err != nil {
+	if v := os.Getenv("ANNOUNCE_ADDR"); v != "" && !isFlagPassed("announce") {
+		*announce = v
+	}
+	if v := os.Getenv("SERVICE_NAME"); v != "" && !isFlagPassed("name") {
+		*name = v
+	}
+
+	// TLS: TLS_CERT=host serves a certificate derived from the host key.
+	// The Kernel's key (TRUSTED_KEY) is pinned so it may present its own.
+	host, hostErr := kernel.LoadHostIdentity()
+	settings, err := kernel.LoadTLSSettings(host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConf *tls.Config
+	if settings != nil {
+		if *authKey != "" {
+			if err := settings.Pin(*authKey); err != nil {
+				log.Fatalf("TRUSTED_KEY: %v", err)
+			}
+		}
+		kernel.TLS = settings
+		if settings.Cert != nil {
+			if tlsConf, err = settings.ServerConfig(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Reverse-dialed: also serve the tree over a connection to the Kernel
+	if *announce != "" {
+		if hostErr != nil {
+			log.Fatalf("announce: %v", hostErr)
+		}
+		backend, err := vfs.NewLocalBackend(*root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go kernel.AnnounceLoop(*announce, *name, host, func(conn net.Conn) {
+			vfs.NewSession(conn, backend, *authKey).Serve()
+		})
+	}
+
+	if err := vfs.StartServer(*addr, *root, *authKey, tlsConf); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -7,7 +7,11 @@ package factotum
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +20,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,13 +35,31 @@ import (
 
 // --- Server & Config ---
 
-// StartServer starts the Factotum service.
-func StartServer(addr string, dataPath string, vfsAddr string) error {
+// StartServer starts the Factotum service. If tlsConf is set the server
+// speaks TLS.
+func StartServer(addr string, dataPath string, vfsAddr string, tlsConf *tls.Config) error {
 	cfg := Config{
 		ListenAddr: addr,
 		DataPath:   dataPath,
 		VFSAddr:    vfsAddr,
+		KeyGrace:   DefaultTTL,
+		TLS:        tlsConf,
 	}
+	if val := os.Getenv("KEY_GRACE"); val != "" {
+		grace, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid KEY_GRACE: %w", err)
+		}
+		cfg.KeyGrace = grace
+	}
+	if val := os.Getenv("TRUSTED_KEY"); val != "" {
+		key, err := base64.StdEncoding.DecodeString(val)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid TRUSTED_KEY")
+		}
+		cfg.HostKey = key
+	}
+	cfg.SetupToken = os.Getenv("SETUP_TOKEN")
 	s, err := NewServer(cfg)
 	if err != nil {
 		return err
@@ -46,14 +69,29 @@ func StartServer(addr string, dataPath string, vfsAddr string) error {
 
 // Config holds server configuration.
 type Config struct {
-	ListenAddr string // TCP address to listen on (e.g., ":9003")
-	DataPath   string // Path to /adm/factotum (local fs for v1)
-	VFSAddr    string // Address of VFS Service
+	ListenAddr string            // TCP address to listen on (e.g., ":9003")
+	DataPath   string            // Path to /adm/factotum (local fs for v1)
+	VFSAddr    string            // Address of VFS Service
+	KeyGrace   time.Duration     // How long retired signing keys stay published
+	TLS        *tls.Config       // Serve TLS if set
+	HostKey    ed25519.PublicKey // Kernel host key trusted to vouch for unames
+	SetupToken string            // One-time token for installing the first key
+}
+
+// Dial connects to VFS. Replace it to reach VFS over TLS.
+var Dial = func(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
 }
 
+// HostAuthContext prefixes the nonce a host signs to authenticate, as in
+// VFS (see kernel.HostAuthContext).
+const HostAuthContext = "ten-host\x00"
+
 // Server is the Factotum 9P server.
 type Server struct {
 	listenAddr string
+	tls        *tls.Config
+	hostKey    ed25519.PublicKey
 	keyring    *Keyring
 	sessions   *Sessions
 	rpc        *RPC
@@ -62,7 +100,7 @@ type Server struct {
 
 // NewServer creates a new Factotum server.
 func NewServer(cfg Config) (*Server, error) {
-	keyring, err := NewKeyring(cfg.DataPath)
+	keyring, err := NewKeyring(cfg.DataPath, cfg.KeyGrace)
 	if err != nil {
 		return nil, fmt.Errorf("keyring init failed: %w", err)
 	}
@@ -83,12 +121,16 @@ func NewServer(cfg Config) (*Server, error) {
 		return nil, fmt.Errorf("webauthn init failed: %w", err)
 	}
 
+	ctl := NewCtl(keyring, cfg.VFSAddr)
+	ctl.setupToken = cfg.SetupToken
 	return &Server{
 		listenAddr: cfg.ListenAddr,
+		tls:        cfg.TLS,
+		hostKey:    cfg.HostKey,
 		keyring:    keyring,
 		sessions:   sessions,
 		rpc:        NewRPC(sessions, keyring, cfg.VFSAddr, webAuthnHandler),
-		ctl:        NewCtl(keyring),
+		ctl:        ctl,
 	}, nil
 }
 
@@ -98,31 +140,42 @@ func (s *Server) Run() error {
 	if err != nil {
 		return err
 	}
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
 	defer ln.Close()
 
 	log.Printf("factotum listening on %s", s.listenAddr)
+	return s.Serve(ln)
+}
 
+// Serve accepts connections on ln until it is closed.
+func (s *Server) Serve(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Printf("accept error: %v", err)
 			continue
 		}
-		go s.handleConn(conn)
+		go s.ServeConn(conn)
 	}
 }
 
-// handleConn handles a single client connection.
-func (s *Server) handleConn(conn net.Conn) {
+// ServeConn serves 9P on a single client connection until it closes.
+func (s *Server) ServeConn(conn net.Conn) {
 	defer conn.Close()
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC in handleConn: %v\n%s", r, debug.Stack())
+			log.Printf("PANIC in ServeConn: %v\n%s", r, debug.Stack())
 		}
 	}()
 
 	fids := make(map[uint32]*PFid)
 	var mu sync.Mutex
+	var uname string // verified user attached on this connection, or ""
 
 	for {
 		req, err := p9.ReadFcall(conn)
@@ -140,9 +193,40 @@ func (s *Server) handleConn(conn net.Conn) {
 			resp.Version = "9P2000"
 			resp.Msize = req.Msize
 
+		case p9.Tauth:
+			if s.hostKey == nil {
+				resp = rError(req, "auth_disabled")
+				break
+			}
+			nonce := make([]byte, 32)
+			if _, err := rand.Read(nonce); err != nil {
+				resp = rError(req, "internal error")
+				break
+			}
+			mu.Lock()
+			fids[req.Afid] = &PFid{Path: authPath, authUser: req.Uname, nonce: nonce}
+			mu.Unlock()
+			resp.Qid = p9.Qid{Type: p9.QTAUTH}
+
 		case p9.Tattach:
+			// The uname counts for /ctl only if vouched for by the Kernel's
+			// host key or by a ticket we signed, presented as the aname.
+			verified := ""
+			if req.Afid != p9.NOFID {
+				mu.Lock()
+				afid, ok := fids[req.Afid]
+				mu.Unlock()
+				if !ok || !afid.authed || afid.authUser != req.Uname {
+					resp = rError(req, "auth_failed")
+					break
+				}
+				verified = req.Uname
+			} else if t, err := ParseTicket(req.Aname); err == nil && t.User == req.Uname && s.keyring.VerifyTicket(t) {
+				verified = req.Uname
+			}
 			mu.Lock()
 			fids[req.Fid] = &PFid{Path: "/"}
+			uname = verified
 			mu.Unlock()
 			resp.Qid = p9.Qid{Type: p9.QTDIR, Path: 0, Vers: 0}
 
@@ -173,7 +257,7 @@ func (s *Server) handleConn(conn net.Conn) {
 					wqid = append(wqid, p9.Qid{Type: p9.QTDIR, Path: qidPath(nextPath)})
 				case "/keys/signing":
 					wqid = append(wqid, p9.Qid{Type: p9.QTDIR, Path: qidPath(nextPath)})
-				case "/keys/signing/pub":
+				case "/keys/signing/pub", "/keys/signing/prev", "/keys/signing/chain":
 					wqid = append(wqid, p9.Qid{Type: p9.QTFILE, Path: qidPath(nextPath)})
 				default:
 					// Unknown path - stop walk here
@@ -225,6 +309,8 @@ func (s *Server) handleConn(conn net.Conn) {
 			}
 
 			switch fid.Path {
+			case authPath:
+				resp.Data = readAt(fid.nonce, req.Offset, req.Count)
 			case "/rpc":
 				str, err := s.rpc.Read(req.Fid)
 				if err != nil {
@@ -237,7 +323,16 @@ func (s *Server) handleConn(conn net.Conn) {
 			case "/keys/signing/pub":
 				// Return base64-encoded signing public key
 				pubKey := s.keyring.PublicKey()
-				resp.Data = []byte(base64.StdEncoding.EncodeToString(pubKey))
+				resp.Data = readAt([]byte(base64.StdEncoding.EncodeToString(pubKey)), req.Offset, req.Count)
+			case "/keys/signing/prev":
+				// Retired keys still in their grace period: <kid> <base64-pub> <until>
+				var sb strings.Builder
+				for _, k := range s.keyring.PreviousKeys() {
+					fmt.Fprintf(&sb, "%s %s %d\n", KeyID(k.Public), base64.StdEncoding.EncodeToString(k.Public), k.Until.Unix())
+				}
+				resp.Data = readAt([]byte(sb.String()), req.Offset, req.Count)
+			case "/keys/signing/chain":
+				resp.Data = readAt([]byte(s.keyring.Chain()), req.Offset, req.Count)
 			case "/":
 				// Dir listing
 				if req.Offset == 0 {
@@ -256,8 +351,11 @@ func (s *Server) handleConn(conn net.Conn) {
 				}
 			case "/keys/signing":
 				if req.Offset == 0 {
-					d := p9.Dir{Name: "pub", Qid: p9.Qid{Type: p9.QTFILE}}
-					resp.Data = d.Bytes()
+					d1 := p9.Dir{Name: "pub", Qid: p9.Qid{Type: p9.QTFILE}}
+					d2 := p9.Dir{Name: "prev", Qid: p9.Qid{Type: p9.QTFILE}}
+					d3 := p9.Dir{Name: "chain", Qid: p9.Qid{Type: p9.QTFILE}}
+					resp.Data = append(d1.Bytes(), d2.Bytes()...)
+					resp.Data = append(resp.Data, d3.Bytes()...)
 				}
 			}
 
@@ -270,7 +368,16 @@ func (s *Server) handleConn(conn net.Conn) {
 				break
 			}
 
-			if fid.Path == "/rpc" {
+			if fid.Path == authPath {
+				if len(req.Data) != ed25519.SignatureSize || !ed25519.Verify(s.hostKey, append([]byte(HostAuthContext), fid.nonce...), req.Data) {
+					resp = rError(req, "signature verification failed")
+					break
+				}
+				mu.Lock()
+				fid.authed = true
+				mu.Unlock()
+				resp.Count = uint32(len(req.Data))
+			} else if fid.Path == "/rpc" {
 				if err := s.rpc.Write(req.Fid, req.Data); err != nil {
 					resp = rError(req, err.Error())
 				} else {
@@ -278,7 +385,7 @@ func (s *Server) handleConn(conn net.Conn) {
 				}
 			} else if fid.Path == "/ctl" {
 				// ctl handler
-				if err := s.ctl.Write(req.Data); err != nil {
+				if err := s.ctl.Write(uname, req.Data); err != nil {
 					resp = rError(req, err.Error())
 				} else {
 					resp.Count = req.Count
@@ -308,6 +415,26 @@ func (s *Server) handleConn(conn net.Conn) {
 
 type PFid struct {
 	Path string
+
+	// Host authentication, for an afid
+	authUser string
+	nonce    []byte
+	authed   bool
+}
+
+// authPath is the path of an afid. It is not walkable.
+const authPath = "#auth"
+
+// readAt returns at most count bytes of data from offset.
+func readAt(data []byte, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(data)) {
+		return nil
+	}
+	data = data[offset:]
+	if uint64(count) < uint64(len(data)) {
+		data = data[:count]
+	}
+	return data
 }
 
 func rError(req *p9.Fcall, ename string) *p9.Fcall {
@@ -332,6 +459,10 @@ func qidPath(path string) uint64 {
 		return 5
 	case "/keys/signing/pub":
 		return 6
+	case "/keys/signing/prev":
+		return 7
+	case "/keys/signing/chain":
+		return 8
 	default:
 		return 0
 	}
@@ -368,6 +499,8 @@ func (r *RPC) Open(fid uint32) {
 // Write processes a command from the client.
 // Commands: "start proto=webauthn role=<register|auth> user=<userid>"
 //
+//	"start proto=ed25519 role=auth user=<userid>"
+//
 //	"write <base64-data>"
 func (r *RPC) Write(fid uint32, data []byte) error {
 	sess, ok := r.sessions.Get(fid)
@@ -396,6 +529,9 @@ func (r *RPC) Read(fid uint32) (string, error) {
 
 	switch sess.State {
 	case "challenged":
+		if sess.Proto == "ed25519" {
+			return fmt.Sprintf("challenge user=%s challenge=%s", sess.User, base64.StdEncoding.EncodeToString(sess.Challenge)), nil
+		}
 		// Return challenge with metadata for browser
 		if sess.SessionData != nil && len(sess.SessionData.Challenge) > 0 {
 			challenge := sess.SessionData.Challenge
@@ -436,7 +572,7 @@ func (r *RPC) Read(fid uint32) (string, error) {
 func (r *RPC) writeTicketToVFS(path string, content string) error {
 	log.Printf("writeTicketToVFS: Dialing %s", r.vfsAddr)
 	// Simplified VFS Write: Dial, Handshake, Attach, Create/Write
-	conn, err := net.Dial("tcp", r.vfsAddr)
+	conn, err := Dial(r.vfsAddr)
 	if err != nil {
 		log.Printf("writeTicketToVFS: Dial failed: %v", err)
 		return err
@@ -557,6 +693,26 @@ func (r *RPC) handleStart(sess *Session, cmd string) error {
 		return nil
 	}
 
+	if proto == "ed25519" {
+		// Key Authentication (CLI clients)
+		// start proto=ed25519 role=auth user=<userid>
+		user := params["user"]
+		if user == "" {
+			return errors.New("user required")
+		}
+		if params["role"] != "auth" {
+			return errors.New("role must be 'auth' for ed25519")
+		}
+		sess.User = user
+		sess.Role = "auth"
+		sess.Proto = proto
+		sess.Challenge = make([]byte, 32)
+		rand.Read(sess.Challenge)
+		sess.State = "challenged"
+		r.sessions.Set(sess.FID, sess)
+		return nil
+	}
+
 	if proto == "simple" {
 		user := params["user"]
 		if user == "" {
@@ -632,6 +788,9 @@ func (r *RPC) handleStart(sess *Session, cmd string) error {
 // handleWrite processes the "write" command with attestation/assertion.
 func (r *RPC) handleWrite(sess *Session, cmd string) error {
 	parts := strings.Fields(cmd)
+	if sess.Proto == "ed25519" {
+		return r.handleKeyAuth(sess, parts)
+	}
 	if len(parts) < 3 || parts[0] != "write" {
 		return errors.New("format: write <clientDataJSON-b64> <responseB64> [sigB64] [userHandleB64]")
 	}
@@ -701,6 +860,34 @@ func (r *RPC) handleWrite(sess *Session, cmd string) error {
 	return errors.New("unknown role")
 }
 
+// handleKeyAuth verifies "write <sig-b64>", the user's Ed25519 signature
+// of the challenge, against the key installed with "key proto=ed25519".
+func (r *RPC) handleKeyAuth(sess *Session, parts []string) error {
+	if len(parts) != 2 || parts[0] != "write" {
+		return errors.New("format: write <sigB64>")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	data, err := r.keyring.LoadUserKey(sess.User)
+	if err != nil {
+		return errors.New("user_not_found")
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("user has no ed25519 key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), sess.Challenge, sig) {
+		return errors.New("invalid_signature")
+	}
+
+	sess.State = "done"
+	r.sessions.Set(sess.FID, sess)
+	log.Printf("RPC: Key authentication successful for user=%s", sess.User)
+	return nil
+}
+
 func (r *RPC) handleRegistration(sess *Session, clientDataJSON, attestationObject, rawID []byte) error {
 	// Skip WebAuthn library if not available (for tests)
 	if r.webAuthn == nil {
@@ -822,22 +1009,31 @@ func parseParams(parts []string) map[string]string {
 
 // --- Ctl Handler ---
 
-// Ctl handles the /ctl file (key management).
+// Ctl handles the /ctl file (key management and ticket revocation).
 type Ctl struct {
 	keyring *Keyring
+	vfsAddr string
+
+	mu         sync.Mutex // guards setupToken
+	setupToken string     // installs the first key once; "" when unset or used
 }
 
 // NewCtl creates a new Ctl handler.
-func NewCtl(keyring *Keyring) *Ctl {
-	return &Ctl{keyring: keyring}
+func NewCtl(keyring *Keyring, vfsAddr string) *Ctl {
+	return &Ctl{keyring: keyring, vfsAddr: vfsAddr}
 }
 
-// Write processes a command from the client.
+// Write processes a command from the client attached as uname, which the
+// attach verified, or "" if it did not.
 // Commands:
 //
 //	key proto=webauthn user=<userid> cose=<base64-cose-key>
+//	key proto=ed25519 user=<userid> pub=<base64-pubkey> [token=<setup-token>]
 //	delkey user=<userid>
-func (c *Ctl) Write(data []byte) error {
+//	logout [nonce=<nonce>]
+//	revoke user=<userid> [nonce=<nonce>]
+//	rotate
+func (c *Ctl) Write(uname string, data []byte) error {
 	cmd := string(data)
 	parts := strings.Fields(cmd)
 	if len(parts) == 0 {
@@ -846,21 +1042,71 @@ func (c *Ctl) Write(data []byte) error {
 
 	switch parts[0] {
 	case "key":
-		return c.handleKey(parts[1:])
+		return c.handleKey(uname, parts[1:])
 	case "delkey":
+		if uname != "adm" {
+			return errors.New("permission denied")
+		}
 		return c.handleDelKey(parts[1:])
+	case "logout":
+		if uname == "" || uname == "none" {
+			return errors.New("permission denied")
+		}
+		return c.revoke(uname, parseParams(parts[1:])["nonce"])
+	case "revoke":
+		if uname != "adm" {
+			return errors.New("permission denied")
+		}
+		params := parseParams(parts[1:])
+		if params["user"] == "" {
+			return errors.New("user required")
+		}
+		return c.revoke(params["user"], params["nonce"])
+	case "rotate":
+		if uname != "adm" {
+			return errors.New("permission denied")
+		}
+		return c.keyring.RotateSigningKey()
 	default:
 		return errors.New("unknown command")
 	}
 }
 
-func (c *Ctl) handleKey(args []string) error {
+func (c *Ctl) handleKey(uname string, args []string) error {
 	params := parseParams(args)
-	// TODO: Implement key registration for service accounts?
 	// Currently WebAuthn registration happens via /rpc flow.
 	// This command is for manual key installation (e.g. bootstrapping).
-	// For now, minimal impl.
-	_ = params
+	if params["proto"] != "ed25519" {
+		return nil
+	}
+
+	user := params["user"]
+	if user == "" || strings.ContainsAny(user, "/.") {
+		return errors.New("user required")
+	}
+	pub, err := base64.StdEncoding.DecodeString(params["pub"])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("pub must be a base64 ed25519 public key")
+	}
+	if uname == "adm" {
+		return c.keyring.SaveUserKey(user, []byte(params["pub"]))
+	}
+
+	// Only adm installs keys, except the very first one, which needs the
+	// setup token. The token is used up by it.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token := params["token"]
+	if c.setupToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.setupToken)) != 1 {
+		return errors.New("permission denied")
+	}
+	if users, err := c.keyring.ListUsers(); err != nil || len(users) > 0 {
+		return errors.New("permission denied")
+	}
+	if err := c.keyring.SaveUserKey(user, []byte(params["pub"])); err != nil {
+		return err
+	}
+	c.setupToken = ""
 	return nil
 }
 
@@ -873,6 +1119,127 @@ func (c *Ctl) handleDelKey(args []string) error {
 	return c.keyring.DeleteUserKey(user)
 }
 
+// revoke deletes the user's tickets (all, or only nonce) from
+// /adm/sessions/<user>/ and appends a line to /adm/revoked, which Kernels
+// poll to drop cached tickets and hang up the sessions holding them.
+func (c *Ctl) revoke(user, nonce string) error {
+	if strings.ContainsAny(user+nonce, "/ ") || user == ".." || nonce == ".." {
+		return errors.New("invalid user or nonce")
+	}
+
+	conn, err := Dial(c.vfsAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rpc := func(req *p9.Fcall) (*p9.Fcall, error) {
+		req.Tag = 1
+		b, _ := req.Bytes()
+		conn.Write(b)
+		resp, err := p9.ReadFcall(conn)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+
+	// walk reports an error unless every element was walked
+	walk := func(newfid uint32, wname ...string) error {
+		resp, err := rpc(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: newfid, Wname: wname})
+		if err != nil {
+			return err
+		}
+		if len(resp.Wqid) != len(wname) {
+			return errors.New("file not found")
+		}
+		return nil
+	}
+
+	if _, err := rpc(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		return fmt.Errorf("tversion failed: %w", err)
+	}
+	if _, err := rpc(&p9.Fcall{Type: p9.Tattach, Fid: 0, Uname: "factotum", Aname: "/"}); err != nil {
+		return fmt.Errorf("attach failed: %w", err)
+	}
+
+	// Collect the ticket names to delete
+	names := []string{nonce}
+	if nonce == "" {
+		names = nil
+		if err := walk(1, "adm", "sessions", user); err == nil {
+			if _, err := rpc(&p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OREAD}); err != nil {
+				return fmt.Errorf("open sessions failed: %w", err)
+			}
+			var data []byte
+			for {
+				resp, err := rpc(&p9.Fcall{Type: p9.Tread, Fid: 1, Offset: uint64(len(data)), Count: 8192})
+				if err != nil || len(resp.Data) == 0 {
+					break
+				}
+				data = append(data, resp.Data...)
+			}
+			rpc(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+			for len(data) > 0 {
+				d, n, err := p9.UnmarshalDir(data)
+				if err != nil {
+					break
+				}
+				names = append(names, d.Name)
+				data = data[n:]
+			}
+		}
+	}
+
+	for _, name := range names {
+		if err := walk(1, "adm", "sessions", user, name); err != nil {
+			continue
+		}
+		if _, err := rpc(&p9.Fcall{Type: p9.Tremove, Fid: 1}); err != nil {
+			log.Printf("revoke: remove %s/%s failed: %v", user, name, err)
+			rpc(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+		}
+	}
+
+	// Notify Kernels
+	line := fmt.Sprintf("%d user=%s", time.Now().Unix(), user)
+	if nonce != "" {
+		line += " nonce=" + nonce
+	}
+	line = SignRevocation(line, c.keyring.SigningKey()) + "\n"
+	if err := walk(2, "adm", "revoked"); err == nil {
+		if _, err := rpc(&p9.Fcall{Type: p9.Topen, Fid: 2, Mode: p9.OWRITE}); err != nil {
+			return fmt.Errorf("open revoked failed: %w", err)
+		}
+	} else {
+		if err := walk(2, "adm"); err != nil {
+			return fmt.Errorf("walk adm failed: %w", err)
+		}
+		if _, err := rpc(&p9.Fcall{Type: p9.Tcreate, Fid: 2, Name: "revoked", Perm: p9.DMAPPEND | 0644, Mode: p9.OWRITE}); err != nil {
+			return fmt.Errorf("create revoked failed: %w", err)
+		}
+	}
+	if _, err := rpc(&p9.Fcall{Type: p9.Twrite, Fid: 2, Data: []byte(line), Count: uint32(len(line))}); err != nil {
+		return fmt.Errorf("write revoked failed: %w", err)
+	}
+	log.Printf("revoke: user=%s nonce=%s tickets=%d", user, nonce, len(names))
+	return nil
+}
+
+// RevocationContext prefixes the message a revocation line is signed over,
+// so the signature cannot be replayed as a ticket or a challenge response.
+const RevocationContext = "ten-revoke\x00"
+
+// SignRevocation appends kid=<kid> sig=<base64> to a revocation line,
+// signing RevocationContext followed by the line with key.
+func SignRevocation(line string, key ed25519.PrivateKey) string {
+	sig := ed25519.Sign(key, []byte(RevocationContext+line))
+	return fmt.Sprintf("%s kid=%s sig=%s", line, KeyID(key.Public().(ed25519.PublicKey)), base64.StdEncoding.EncodeToString(sig))
+}
+
 // --- WebAuthn ---
 
 // WebAuthnConfig holds WebAuthn configuration.
@@ -1015,7 +1382,7 @@ func NewCredentialStore(vfsAddr string) *CredentialStore {
 // LoadUser loads a user and their credentials from VFS.
 func (s *CredentialStore) LoadUser(name string) (*User, error) {
 	// 1. Dial VFS
-	conn, err := net.Dial("tcp", s.vfsAddr)
+	conn, err := Dial(s.vfsAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -1108,7 +1475,7 @@ func (s *CredentialStore) saveUser(user *User) error {
 	}
 
 	// Write to VFS: Dial, Attach, Walk/Create, Write.
-	conn, err := net.Dial("tcp", s.vfsAddr)
+	conn, err := Dial(s.vfsAddr)
 	if err != nil {
 		log.Printf("VFS: Dial failed: %v", err)
 		return err
@@ -1216,33 +1583,111 @@ func (s *CredentialStore) saveUser(user *User) error {
 // Currently, it uses os.* which violates the architecture (disk dependency).
 // TODO(rob): Refactor to use VFS 9P client.
 type Keyring struct {
-	basePath   string // e.g., "/adm/factotum"
+	basePath string        // e.g., "/adm/factotum"
+	grace    time.Duration // how long retired keys keep verifying tickets
+
+	mu         sync.RWMutex // guards signingKey, publicKey, previous, chain
 	signingKey ed25519.PrivateKey
 	publicKey  ed25519.PublicKey
+	previous   []RetiredKey
+	chain      string // signing.chain
+}
+
+// RetiredKey is a rotated-out signing key that Kernels still trust until Until.
+type RetiredKey struct {
+	Public ed25519.PublicKey
+	Until  time.Time
 }
 
 // NewKeyring creates a new keyring with the given base path.
-func NewKeyring(basePath string) (*Keyring, error) {
-	kr := &Keyring{basePath: basePath}
+// Retired keys are published for grace after rotation.
+func NewKeyring(basePath string, grace time.Duration) (*Keyring, error) {
+	kr := &Keyring{basePath: basePath, grace: grace}
 
 	// Load or generate signing key
 	if err := kr.loadOrGenerateSigningKey(); err != nil {
 		return nil, err
 	}
+	kr.loadPreviousKeys()
+	if data, err := os.ReadFile(filepath.Join(basePath, "signing.chain")); err == nil {
+		kr.chain = string(data)
+	}
 
 	return kr, nil
 }
 
 // SigningKey returns the private signing key.
 func (kr *Keyring) SigningKey() ed25519.PrivateKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
 	return kr.signingKey
 }
 
 // PublicKey returns the public signing key.
 func (kr *Keyring) PublicKey() ed25519.PublicKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
 	return kr.publicKey
 }
 
+// PreviousKeys returns the retired keys still within their grace period.
+func (kr *Keyring) PreviousKeys() []RetiredKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	var keys []RetiredKey
+	for _, k := range kr.previous {
+		if time.Now().Before(k.Until) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// KeyContext prefixes the message a rotated-out signing key signs to
+// endorse its successor.
+const KeyContext = "ten-key\x00"
+
+// Chain returns the endorsements made by RotateSigningKey, one per line:
+// <base64-pub> <signer-kid> <base64-sig>, where sig is the signer's
+// signature over KeyContext followed by the new public key. Kernels trust a
+// new key only through a chain from a key they already trust.
+func (kr *Keyring) Chain() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.chain
+}
+
+// loadPreviousKeys reads the keys archived by RotateSigningKey
+// (signing.key.<unix-time>), newest first.
+func (kr *Keyring) loadPreviousKeys() {
+	paths, _ := filepath.Glob(filepath.Join(kr.basePath, "signing.key.*"))
+	var keys []RetiredKey
+	for _, path := range paths {
+		retired, err := strconv.ParseInt(strings.TrimPrefix(filepath.Ext(path), "."), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil || len(decoded) != ed25519.PrivateKeySize {
+			log.Printf("keyring: skipping invalid archived key %s", path)
+			continue
+		}
+		keys = append(keys, RetiredKey{
+			Public: ed25519.PrivateKey(decoded).Public().(ed25519.PublicKey),
+			Until:  time.Unix(retired, 0).Add(kr.grace),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Until.After(keys[j].Until) })
+
+	kr.mu.Lock()
+	kr.previous = keys
+	kr.mu.Unlock()
+}
+
 // LoadUserKey loads a user's public key.
 func (kr *Keyring) LoadUserKey(user string) ([]byte, error) {
 	path := filepath.Join(kr.basePath, user, "pubkey")
@@ -1336,20 +1781,43 @@ func (kr *Keyring) RotateSigningKey() error {
 	// Archive old key
 	if data, err := os.ReadFile(keyPath); err == nil {
 		archivePath := keyPath + "." + fmt.Sprintf("%d", time.Now().Unix())
-		os.WriteFile(archivePath, data, 0600)
+		if err := os.WriteFile(archivePath, data, 0600); err != nil {
+			return fmt.Errorf("archive signing key: %w", err)
+		}
 	}
 
-	// Generate new key
+	// Generate new key, endorsed by the old one
 	pub, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
 		return err
 	}
+	kr.mu.Lock()
+	old := kr.signingKey
+	line := fmt.Sprintf("%s %s %s\n", base64.StdEncoding.EncodeToString(pub), KeyID(kr.publicKey),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(old, []byte(KeyContext+string(pub)))))
+	f, err := os.OpenFile(filepath.Join(kr.basePath, "signing.chain"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.WriteString(line)
+		f.Close()
+	}
+	if err != nil {
+		kr.mu.Unlock()
+		return fmt.Errorf("endorse signing key: %w", err)
+	}
+	kr.chain += line
 	kr.signingKey = priv
 	kr.publicKey = pub
+	kr.mu.Unlock()
+	kr.loadPreviousKeys()
+	log.Printf("keyring: rotated signing key, now %s", KeyID(pub))
 
 	// Save new key
 	encoded := base64.StdEncoding.EncodeToString(priv)
-	return os.WriteFile(keyPath, []byte(encoded), 0600)
+	if err := os.WriteFile(keyPath, []byte(encoded), 0600); err != nil {
+		return err
+	}
+	pubPath := filepath.Join(kr.basePath, "signing.pub")
+	return os.WriteFile(pubPath, []byte(base64.StdEncoding.EncodeToString(pub)), 0644)
 }
 
 // --- Sessions ---
@@ -1365,6 +1833,7 @@ type Session struct {
 	FID               uint32
 	User              string
 	Role              string // "register" | "auth"
+	Proto             string // "ed25519" for key auth; webauthn otherwise
 	State             string // "start" | "challenged" | "done"
 	Challenge         []byte // ephemeral, never persisted (legacy)
 	SessionData       *webauthn.SessionData
@@ -1402,36 +1871,53 @@ func (s *Sessions) Delete(fid uint32) {
 
 // --- Ticket ---
 
+// DefaultTTL is how long a ticket is valid.
+const DefaultTTL = 7 * 24 * time.Hour
+
 // Ticket represents a session token stored in VFS.
-// Format: <user> <expiry> <nonce> <sig>
+// Format: <user> <expiry> <nonce> <sig> [<kid>]
 type Ticket struct {
 	User   string
 	Expiry time.Time
 	Nonce  string
 	Sig    string // base64(ed25519.Sign(user+expiry+nonce))
+	KeyID  string // KeyID of the signing key; empty in older tickets
+}
+
+// KeyID names a signing key: the first 8 bytes of its SHA-256, in hex.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
 }
 
 // ParseTicket parses a space-delimited ticket string.
 func ParseTicket(line string) (Ticket, error) {
 	fields := strings.Fields(line)
-	if len(fields) != 4 {
+	if len(fields) != 4 && len(fields) != 5 {
 		return Ticket{}, errors.New("invalid ticket format")
 	}
 	expiry, err := strconv.ParseInt(fields[1], 10, 64)
 	if err != nil {
 		return Ticket{}, fmt.Errorf("invalid expiry: %w", err)
 	}
-	return Ticket{
+	t := Ticket{
 		User:   fields[0],
 		Expiry: time.Unix(expiry, 0),
 		Nonce:  fields[2],
 		Sig:    fields[3],
-	}, nil
+	}
+	if len(fields) == 5 {
+		t.KeyID = fields[4]
+	}
+	return t, nil
 }
 
 // String returns the space-delimited ticket format.
 func (t Ticket) String() string {
-	return fmt.Sprintf("%s %d %s %s", t.User, t.Expiry.Unix(), t.Nonce, t.Sig)
+	if t.KeyID == "" {
+		return fmt.Sprintf("%s %d %s %s", t.User, t.Expiry.Unix(), t.Nonce, t.Sig)
+	}
+	return fmt.Sprintf("%s %d %s %s %s", t.User, t.Expiry.Unix(), t.Nonce, t.Sig, t.KeyID)
 }
 
 // IsExpired returns true if the ticket has expired.
@@ -1442,7 +1928,7 @@ func (t Ticket) IsExpired() bool {
 // Generate creates a new ticket for the given user.
 func Generate(user string, key ed25519.PrivateKey) Ticket {
 	nonce := generateNonce()
-	expiry := time.Now().Add(7 * 24 * time.Hour) // DefaultTTL hardcoded for simplicity
+	expiry := time.Now().Add(DefaultTTL)
 
 	// Sign: user + expiry + nonce
 	message := fmt.Sprintf("%s%d%s", user, expiry.Unix(), nonce)
@@ -1453,7 +1939,26 @@ func Generate(user string, key ed25519.PrivateKey) Ticket {
 		Expiry: expiry,
 		Nonce:  nonce,
 		Sig:    base64.StdEncoding.EncodeToString(sig),
+		KeyID:  KeyID(key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// VerifyTicket reports whether t is unexpired and signed by the current
+// signing key or a retired one still in its grace period.
+func (kr *Keyring) VerifyTicket(t Ticket) bool {
+	if t.IsExpired() {
+		return false
+	}
+	pubs := []ed25519.PublicKey{kr.PublicKey()}
+	for _, k := range kr.PreviousKeys() {
+		pubs = append(pubs, k.Public)
+	}
+	for _, pub := range pubs {
+		if (t.KeyID == "" || t.KeyID == KeyID(pub)) && t.Verify(pub) {
+			return true
+		}
 	}
+	return false
 }
 
 // Verify checks the ticket signature against the public key.
@@ -0,0 +1,198 @@
+package factotum
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	p9 "github.com/keaganluttrell/ten/pkg/9p"
+)
+
+func TestReadAt(t *testing.T) {
+	data := []byte("abcdef")
+	tests := []struct {
+		offset uint64
+		count  uint32
+		want   string
+	}{
+		{0, 8192, "abcdef"},
+		{0, 2, "ab"},
+		{4, 8192, "ef"},
+		{6, 1, ""},
+		{1 << 63, 1, ""},
+		{^uint64(0), ^uint32(0), ""},
+	}
+	for _, tt := range tests {
+		if got := string(readAt(data, tt.offset, tt.count)); got != tt.want {
+			t.Errorf("readAt(%d, %d) = %q, want %q", tt.offset, tt.count, got, tt.want)
+		}
+	}
+}
+
+// pipeRPC returns a function sending a request on conn and returning the
+// reply, which may be an Rerror.
+func pipeRPC(t *testing.T, conn net.Conn) func(*p9.Fcall) *p9.Fcall {
+	var tag uint16
+	return func(req *p9.Fcall) *p9.Fcall {
+		t.Helper()
+		tag++
+		req.Tag = tag
+		b, _ := req.Bytes()
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p9.ReadFcall(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+}
+
+// mustRPC wraps rpc to fail the test on an Rerror.
+func mustRPC(t *testing.T, rpc func(*p9.Fcall) *p9.Fcall) func(*p9.Fcall) *p9.Fcall {
+	return func(req *p9.Fcall) *p9.Fcall {
+		t.Helper()
+		resp := rpc(req)
+		if resp.Type == p9.Rerror {
+			t.Fatalf("%s: %s", p9.TypeName(req.Type), resp.Ename)
+		}
+		return resp
+	}
+}
+
+// TestSigningKeysRead reads /keys/signing/* over a pipe with offsets and
+// counts a well-behaved client would not send.
+func TestSigningKeysRead(t *testing.T) {
+	srv, err := NewServer(Config{DataPath: t.TempDir(), VFSAddr: "tcp!vfs!9001", KeyGrace: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.keyring.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go srv.ServeConn(c2)
+	rpc := mustRPC(t, pipeRPC(t, c1))
+	rpc(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	rpc(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "kernel"})
+
+	for i, name := range []string{"pub", "prev", "chain"} {
+		fid := uint32(i + 1)
+		rpc(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: fid, Wname: []string{"keys", "signing", name}})
+		rpc(&p9.Fcall{Type: p9.Topen, Fid: fid, Mode: p9.OREAD})
+		for _, tt := range []struct {
+			offset uint64
+			count  uint32
+			max    int
+		}{
+			{0, 8192, 8192},
+			{0, 3, 3},
+			{1 << 63, 8192, 0},
+		} {
+			resp := rpc(&p9.Fcall{Type: p9.Tread, Fid: fid, Offset: tt.offset, Count: tt.count})
+			if len(resp.Data) > tt.max || (tt.offset == 0 && len(resp.Data) == 0) {
+				t.Errorf("%s at %d count %d: %d bytes", name, tt.offset, tt.count, len(resp.Data))
+			}
+		}
+	}
+}
+
+func TestCtlAttach(t *testing.T) {
+	hostPub, hostPriv, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	userPub, _, _ := ed25519.GenerateKey(nil)
+	pub64 := base64.StdEncoding.EncodeToString(userPub)
+
+	newServer := func(t *testing.T) *Server {
+		srv, err := NewServer(Config{DataPath: t.TempDir(), VFSAddr: "tcp!vfs!9001", KeyGrace: time.Hour, HostKey: hostPub, SetupToken: "s3cret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+	// ctl attaches as uname and writes cmd to /ctl, returning the Rerror's
+	// ename or "".
+	ctl := func(t *testing.T, srv *Server, uname, aname string, host ed25519.PrivateKey, cmd string) string {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go srv.ServeConn(c2)
+		rpc := pipeRPC(t, c1)
+		must := mustRPC(t, rpc)
+
+		must(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+		afid := p9.NOFID
+		if host != nil {
+			afid = 100
+			must(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: uname})
+			nonce := must(&p9.Fcall{Type: p9.Tread, Fid: afid, Count: 32}).Data
+			if resp := rpc(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: ed25519.Sign(host, append([]byte(HostAuthContext), nonce...))}); resp.Type == p9.Rerror {
+				return resp.Ename
+			}
+		}
+		if resp := rpc(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: uname, Aname: aname}); resp.Type == p9.Rerror {
+			return resp.Ename
+		}
+		must(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"ctl"}})
+		must(&p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OWRITE})
+		return rpc(&p9.Fcall{Type: p9.Twrite, Fid: 1, Data: []byte(cmd)}).Ename
+	}
+
+	t.Run("rotate", func(t *testing.T) {
+		srv := newServer(t)
+		adm := Generate("adm", srv.keyring.SigningKey())
+		expired := adm
+		expired.Expiry = time.Now().Add(-time.Minute)
+		tests := []struct {
+			name  string
+			uname string
+			aname string
+			host  ed25519.PrivateKey
+			ok    bool
+		}{
+			{"unverified", "adm", "/", nil, false},
+			{"ticket", "adm", adm.String(), nil, true},
+			{"ticket for another user", "bob", adm.String(), nil, false},
+			{"expired ticket", "adm", expired.String(), nil, false},
+			{"forged ticket", "adm", Generate("adm", otherPriv).String(), nil, false},
+			{"host auth", "adm", "/", hostPriv, true},
+			{"wrong host key", "adm", "/", otherPriv, false},
+		}
+		for _, tt := range tests {
+			// The ticket was signed by the key rotated out by the last
+			// success, which stays valid for KeyGrace
+			if ename := ctl(t, srv, tt.uname, tt.aname, tt.host, "rotate"); (ename == "") != tt.ok {
+				t.Errorf("%s: %q, want ok=%v", tt.name, ename, tt.ok)
+			}
+		}
+	})
+
+	t.Run("bootstrap", func(t *testing.T) {
+		srv := newServer(t)
+		key := "key proto=ed25519 user=glenda pub=" + pub64
+		tests := []struct {
+			name string
+			cmd  string
+			ok   bool
+		}{
+			{"no token", key, false},
+			{"wrong token", key + " token=guess", false},
+			{"token", key + " token=s3cret", true},
+			{"token again", "key proto=ed25519 user=eve pub=" + pub64 + " token=s3cret", false},
+			{"delkey", "delkey user=glenda", false},
+		}
+		for _, tt := range tests {
+			if ename := ctl(t, srv, "none", "/", nil, tt.cmd); (ename == "") != tt.ok {
+				t.Errorf("%s: %q, want ok=%v", tt.name, ename, tt.ok)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(srv.keyring.basePath, "glenda", "pubkey")); err != nil {
+			t.Fatalf("first key not installed: %v", err)
+		}
+	})
+}
@@ -5,6 +5,7 @@ go 1.24.3
 require (
 	github.com/coder/websocket v1.8.14
 	github.com/go-webauthn/webauthn v0.15.0
+	golang.org/x/sys v0.37.0
 )
 
 require (
@@ -16,5 +17,4 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.43.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 )
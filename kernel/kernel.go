@@ -1,20 +1,32 @@
 package kernel
 
 import (
+	"container/list"
 	"context"
 	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -25,52 +37,223 @@ import (
 
 // StartServer starts the Kernel TCP and WebSocket servers.
 func StartServer(listenAddr, vfsAddr, wsAddr, keyPath string) error {
-	pubKey := loadPublicKey(keyPath)
+	return StartServerWithDialer(listenAddr, vfsAddr, wsAddr, keyPath, NewNetworkDialer())
+}
+
+// StartServerWithDialer is StartServer reaching backends through d, such
+// as a PipeDialer when every service runs in one process.
+func StartServerWithDialer(listenAddr, vfsAddr, wsAddr, keyPath string, dialer Dialer) error {
+	keys := NewTrustedKeys(loadPublicKey(keyPath))
 	host, err := LoadHostIdentity()
 	if err != nil {
 		log.Printf("Warning: Failed to load Host Identity: %v. Bootstrapping will invoke Tauth failure handling.", err)
 	}
 
-	dialer := NewNetworkDialer()
+	// TLS for listeners and tls! dials
+	if TLS, err = LoadTLSSettings(host); err != nil {
+		return err
+	}
+
+	// Audit log in VFS
+	auditDir := os.Getenv("AUDIT_DIR")
+	if auditDir == "" {
+		auditDir = "/sys/log/audit"
+	}
+	Audit = NewAuditLog(vfsAddr, auditDir, dialer, host)
+
+	// Ticket cache and revocations
+	if val := os.Getenv("TICKET_CACHE_TTL"); val != "" {
+		ttl, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid TICKET_CACHE_TTL: %w", err)
+		}
+		Tickets.SetTTL(ttl)
+	}
+	if val := os.Getenv("TICKET_LIFETIME"); val != "" {
+		lifetime, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid TICKET_LIFETIME: %w", err)
+		}
+		Tickets.SetLifetime(lifetime)
+	}
+	poll := 10 * time.Second
+	if val := os.Getenv("REVOKE_POLL"); val != "" {
+		if poll, err = time.ParseDuration(val); err != nil || poll <= 0 {
+			return fmt.Errorf("invalid REVOKE_POLL: %q", val)
+		}
+	}
+	go WatchRevocations(vfsAddr, dialer, host, keys, poll)
+
+	limitsPoll := 30 * time.Second
+	if val := os.Getenv("LIMITS_POLL"); val != "" {
+		if limitsPoll, err = time.ParseDuration(val); err != nil || limitsPoll <= 0 {
+			return fmt.Errorf("invalid LIMITS_POLL: %q", val)
+		}
+	}
+	go WatchLimits(vfsAddr, dialer, host, limitsPoll)
+
+	refresh := 5 * time.Minute
+	if val := os.Getenv("KEY_REFRESH"); val != "" {
+		if refresh, err = time.ParseDuration(val); err != nil || refresh <= 0 {
+			return fmt.Errorf("invalid KEY_REFRESH: %q", val)
+		}
+	}
+	go WatchSigningKeys(keys, os.Getenv("FACTOTUM_ADDR"), dialer, refresh)
+
+	// Session timeouts and keepalive
+	for _, t := range []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"SESSION_IDLE", &Timeouts.Idle},
+		{"SESSION_MAX", &Timeouts.Lifetime},
+		{"WS_PING", &Timeouts.Ping},
+		{"WS_WRITE_TIMEOUT", &Timeouts.Write},
+	} {
+		if val := os.Getenv(t.env); val != "" {
+			if *t.d, err = time.ParseDuration(val); err != nil || *t.d < 0 {
+				return fmt.Errorf("invalid %s: %q", t.env, val)
+			}
+		}
+	}
+
+	if val := os.Getenv("RESUME_GRACE"); val != "" {
+		if ResumeGrace, err = time.ParseDuration(val); err != nil || ResumeGrace < 0 {
+			return fmt.Errorf("invalid RESUME_GRACE: %q", val)
+		}
+	}
+
+	// WebSocket and 9P message policy
+	WSOrigins = ParseOrigins(os.Getenv("WS_ORIGINS"))
+	ImportAddrs = ParseOrigins(os.Getenv("IMPORT_ADDRS"))
+	if val := os.Getenv("MAX_MSIZE"); val != "" {
+		n, err := strconv.ParseUint(val, 10, 32)
+		if err != nil || n < 256 {
+			return fmt.Errorf("invalid MAX_MSIZE: %q", val)
+		}
+		MaxMsize = uint32(n)
+	}
+
+	// File cache for mount -C
+	if val := os.Getenv("CACHE_SIZE"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid CACHE_SIZE: %q", val)
+		}
+		Cache.SetMax(n)
+	}
+
+	// Per-session /tmp
+	if val := os.Getenv("TMP_SIZE"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid TMP_SIZE: %q", val)
+		}
+		TmpSize = n
+	}
 
 	// 1. Start WebSocket Server (HTTP)
 	go func() {
-		if err := StartWebSocketServer(wsAddr, vfsAddr, pubKey, host, dialer); err != nil {
+		if err := StartWebSocketServer(wsAddr, vfsAddr, keys, host, dialer); err != nil {
 			log.Printf("WebSocket server failed: %v", err)
 		}
 	}()
 
+	// Metrics listen apart from the WebSocket server, which is public
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		path := os.Getenv("METRICS_PATH")
+		if path == "" {
+			path = "/metrics"
+		}
+		go func() {
+			if err := StartMetricsServer(addr, path); err != nil {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	// 2. Start TCP Server
-	ln, err := net.Listen("tcp", listenAddr)
+	conf, err := TLS.listenConfig(TLS != nil && TLS.ClientAuth)
 	if err != nil {
 		return err
 	}
-	log.Printf("Kernel listening on %s (TCP)", listenAddr)
+	ln, err := listen(listenAddr, conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kernel listening on %s (%s)", listenAddr, listenProto(TLS, "TCP", "TLS"))
 
-	// Start embedded ProcFS
-	go func() {
-		if err := StartProcFS(":9004"); err != nil {
-			log.Printf("ProcFS failed: %v", err)
+	// Start Announce listener for services that dial in
+	if annAddr := os.Getenv("ANNOUNCE_ADDR"); annAddr != "" {
+		keys, err := ParseAnnounceKeys(os.Getenv("ANNOUNCE_KEYS"))
+		if err != nil {
+			return err
 		}
-	}()
+		go func() {
+			if err := StartAnnounceServer(annAddr, keys); err != nil {
+				log.Printf("Announce server failed: %v", err)
+			}
+		}()
+	}
+
+	// Start Export listener for peer Kernels that import
+	if expAddr := os.Getenv("EXPORT_ADDR"); expAddr != "" {
+		peers, err := ParseExportKeys(os.Getenv("EXPORT_KEYS"))
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := StartExportServer(expAddr, vfsAddr, keys, host, dialer, peers); err != nil {
+				log.Printf("Export server failed: %v", err)
+			}
+		}()
+	}
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if shuttingDown() {
+				<-life.stopped
+				return nil
+			}
 			log.Printf("Accept failed: %v", err)
 			continue
 		}
 
 		go func(c net.Conn) {
 			transport := &TCPTransport{conn: c}
-			sess := NewSession(transport, vfsAddr, pubKey, host, dialer)
+			sess := NewSession(transport, vfsAddr, keys, host, dialer)
 			sess.Serve()
 		}(conn)
 	}
 }
 
+// StartMetricsServer serves Stats in Prometheus format at path on its own
+// listener, kept off the public WebSocket address.
+func StartMetricsServer(addr, path string) error {
+	ln, err := listen(addr, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kernel serving metrics on %s%s", addr, path)
+	if err := ServeMetrics(ln, path); err != nil && !shuttingDown() {
+		return err
+	}
+	return nil
+}
+
+// ServeMetrics answers GET path on ln with Stats.Prometheus.
+func ServeMetrics(ln net.Listener, path string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, Stats.Prometheus())
+	})
+	return (&http.Server{Handler: mux}).Serve(ln)
+}
+
 // StartWebSocketServer starts the HTTP server for WebSocket upgrades.
-func StartWebSocketServer(addr, vfsAddr string, pubKey ed25519.PublicKey, host *HostIdentity, dialer *NetworkDialer) error {
+func StartWebSocketServer(addr, vfsAddr string, keys *TrustedKeys, host *HostIdentity, dialer Dialer) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		socket, err := Upgrade(w, r)
@@ -79,28 +262,58 @@ func StartWebSocketServer(addr, vfsAddr string, pubKey ed25519.PublicKey, host *
 			return
 		}
 		// Bridge Socket to Session
-		sess := NewSession(socket, vfsAddr, pubKey, host, dialer)
+		sess := NewSession(socket, vfsAddr, keys, host, dialer)
 		sess.Serve()
 	})
-
-	log.Printf("Kernel listening on %s (WebSocket /ws)", addr)
-	return http.ListenAndServe(addr, mux)
+	conf, err := TLS.listenConfig(false)
+	if err != nil {
+		return err
+	}
+	ln, err := listen(addr, conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kernel listening on %s (%s /ws)", addr, listenProto(TLS, "WebSocket", "Secure WebSocket"))
+	if err := (&http.Server{Handler: mux}).Serve(ln); err != nil && !shuttingDown() {
+		return err
+	}
+	return nil
 }
 
 type TCPTransport struct {
-	conn net.Conn
+	conn  net.Conn
+	msize atomic.Uint32 // negotiated by Tversion; 0 is MaxMsize
 }
 
-func (t *TCPTransport) ReadMsg(ctx context.Context) (*p9.Fcall, error) {
-	return p9.ReadFcall(t.conn)
+// SetMsize limits incoming messages to the negotiated msize.
+func (t *TCPTransport) SetMsize(msize uint32) {
+	t.msize.Store(msize)
 }
 
-func (t *TCPTransport) WriteMsg(ctx context.Context, f *p9.Fcall) error {
-	b, err := f.Bytes()
-	if err != nil {
-		return err
+// ReadMsg reads a 9P message, checking its size header against the msize
+// before allocating for it.
+func (t *TCPTransport) ReadMsg(ctx context.Context) (*p9.Fcall, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(t.conn, sizeBuf[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(sizeBuf[:])
+	msize := t.msize.Load()
+	if msize == 0 {
+		msize = MaxMsize
 	}
-	_, err = t.conn.Write(b)
+	if size < 7 || size > msize {
+		return nil, fmt.Errorf("bad message size %d (msize %d)", size, msize)
+	}
+	buf := make([]byte, size-4)
+	if _, err := io.ReadFull(t.conn, buf); err != nil {
+		return nil, err
+	}
+	return p9.Unmarshal(buf, size)
+}
+
+func (t *TCPTransport) WriteMsg(ctx context.Context, b []byte) error {
+	_, err := t.conn.Write(b)
 	return err
 }
 
@@ -129,6 +342,257 @@ func loadPublicKey(path string) ed25519.PublicKey {
 	return ed25519.PublicKey(b)
 }
 
+// --- Shutdown Logic ---
+
+// SessionTimeouts bounds how long sessions live. Zero disables a limit.
+type SessionTimeouts struct {
+	Idle     time.Duration // nothing read, written or outstanding (SESSION_IDLE)
+	Lifetime time.Duration // since the session connected (SESSION_MAX)
+	Ping     time.Duration // WebSocket keepalive interval (WS_PING)
+	Write    time.Duration // deadline for each WebSocket write (WS_WRITE_TIMEOUT)
+}
+
+var Timeouts = SessionTimeouts{Ping: 30 * time.Second, Write: 5 * time.Second}
+
+// life tracks the kernel's listeners so Shutdown can close them.
+var life = struct {
+	mu        sync.Mutex
+	closing   bool
+	listeners []net.Listener
+	stopped   chan struct{} // closed when Shutdown returns
+}{stopped: make(chan struct{})}
+
+// listen announces on a TCP address, serving TLS if conf is set, and
+// remembers the listener for Shutdown.
+func listen(addr string, conf *tls.Config) (net.Listener, error) {
+	life.mu.Lock()
+	defer life.mu.Unlock()
+	if life.closing {
+		return nil, fmt.Errorf("kernel_shutting_down")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		ln = tls.NewListener(ln, conf)
+	}
+	life.listeners = append(life.listeners, ln)
+	return ln, nil
+}
+
+// listenProto names a listener for the log, depending on whether t serves TLS.
+func listenProto(t *TLSSettings, plain, secure string) string {
+	if t != nil && t.Cert != nil {
+		return secure
+	}
+	return plain
+}
+
+// shuttingDown reports whether Shutdown has begun.
+func shuttingDown() bool {
+	life.mu.Lock()
+	defer life.mu.Unlock()
+	return life.closing
+}
+
+// Shutdown stops the kernel gracefully. It closes the listeners, then shuts
+// down every session in parallel: in-flight requests may finish until ctx is
+// done, backend fids are clunked and transports closed. It returns ctx.Err()
+// if some session had to be cut short. StartServer returns once it is done.
+func Shutdown(ctx context.Context) error {
+	life.mu.Lock()
+	if life.closing {
+		life.mu.Unlock()
+		<-life.stopped
+		return nil
+	}
+	life.closing = true
+	for _, ln := range life.listeners {
+		ln.Close()
+	}
+	life.mu.Unlock()
+	defer close(life.stopped)
+	Health.Stop()
+
+	var sessions []*Session
+	for _, id := range Registry.List() {
+		if s := Registry.Get(id); s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	log.Printf("Kernel shutting down, draining %d sessions", len(sessions))
+
+	var wg sync.WaitGroup
+	var cut atomic.Bool
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Session %d: shutdown cut short: %v", s.id, err)
+				cut.Store(true)
+			}
+		}(s)
+	}
+	wg.Wait()
+	Resumes.Expire()
+	Audit.Record("shutdown", "sessions", strconv.Itoa(len(sessions)))
+	Audit.Flush(ctx)
+	if cut.Load() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// --- Resume Logic ---
+
+// ResumeGrace is how long a disconnected session is kept for its client to
+// resume (RESUME_GRACE). Zero disables resumption.
+var ResumeGrace = 2 * time.Minute
+
+// ResumeTable holds disconnected sessions by resume token until they are
+// resumed or their grace period ends.
+type ResumeTable struct {
+	mu       sync.Mutex
+	sessions map[string]*detached
+}
+
+type detached struct {
+	s     *Session
+	until time.Time   // end of the grace period
+	timer *time.Timer // expires the session at until
+}
+
+var Resumes = &ResumeTable{
+	sessions: make(map[string]*detached),
+}
+
+// newResumeToken returns a random, unguessable token.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Detach keeps s for ResumeGrace if it holds a resume token, reporting
+// whether it did. Its fids, namespace and open files stay as they are.
+func (t *ResumeTable) Detach(s *Session) bool {
+	if ResumeGrace <= 0 {
+		return false
+	}
+	return t.DetachUntil(s, time.Now().Add(ResumeGrace))
+}
+
+// DetachUntil is Detach with the grace period ending at until. A resume
+// that fails puts the session back with the deadline Take returned, so
+// bad attempts cannot keep it alive.
+func (t *ResumeTable) DetachUntil(s *Session, until time.Time) bool {
+	s.mu.Lock()
+	token := s.resume
+	s.mu.Unlock()
+	if token == "" || s.killed.Load() || shuttingDown() {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := &detached{s: s, until: until}
+	d.timer = time.AfterFunc(time.Until(until), func() {
+		t.mu.Lock()
+		cur, ok := t.sessions[token]
+		if ok && cur == d {
+			delete(t.sessions, token)
+		}
+		t.mu.Unlock()
+		if ok && cur == d {
+			log.Printf("Session %d: not resumed, releasing", s.id)
+			s.expire()
+		}
+	})
+	t.sessions[token] = d
+	log.Printf("Session %d: detached, resumable for %v", s.id, time.Until(until).Round(time.Second))
+	return true
+}
+
+// Take removes and returns the session detached under token, with the end
+// of its grace period. A token can be taken once.
+func (t *ResumeTable) Take(token string) (*Session, time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.sessions[token]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	delete(t.sessions, token)
+	d.timer.Stop()
+	return d.s, d.until, true
+}
+
+// Expire releases every detached session.
+func (t *ResumeTable) Expire() {
+	t.mu.Lock()
+	var sessions []*Session
+	for token, d := range t.sessions {
+		d.timer.Stop()
+		sessions = append(sessions, d.s)
+		delete(t.sessions, token)
+	}
+	t.mu.Unlock()
+	for _, s := range sessions {
+		s.expire()
+	}
+}
+
+// resumeAttach continues the detached session named by token on this
+// connection: the client gets its fids, binds and open files back, and
+// req.Fid as a new root. The token is spent; /dev/resume has the next one.
+// If the session's ticket was revoked or has expired meanwhile, it is
+// released instead.
+func (s *Session) resumeAttach(req *p9.Fcall, token string) *p9.Fcall {
+	old, until, ok := Resumes.Take(token)
+	if !ok {
+		s.audit("resume", errors.New("resume_invalid"))
+		return rError(req, "resume_invalid")
+	}
+
+	old.mu.Lock()
+	ticket := &Ticket{User: old.user, Nonce: old.nonce, Expiry: old.expiry}
+	_, inUse := old.fids[req.Fid]
+	old.mu.Unlock()
+
+	switch {
+	case req.Uname != ticket.User:
+		Resumes.DetachUntil(old, until)
+		return rError(req, "resume_user_mismatch")
+	case inUse:
+		Resumes.DetachUntil(old, until)
+		return rError(req, "fid_in_use")
+	case Tickets.Revoked(ticket):
+		old.expire()
+		return rError(req, "ticket_revoked")
+	case time.Now().After(ticket.Expiry):
+		old.expire()
+		return rError(req, "ticket_expired")
+	}
+
+	qid, ename := old.attachRoot(req.Fid)
+	if ename != "" {
+		Resumes.DetachUntil(old, until)
+		return rError(req, ename)
+	}
+
+	old.mu.Lock()
+	old.resume = newResumeToken()
+	old.socket = s.socket
+	old.transport = s.transport
+	old.mu.Unlock()
+	old.draining.Store(false)
+	s.heir = old // Serve hands the connection over after replying
+	old.audit("resume", nil, "nonce", ticket.Nonce)
+	return &p9.Fcall{Type: p9.Rattach, Tag: req.Tag, Qid: qid}
+}
+
 // --- Session Logic ---
 
 type fidRef struct {
@@ -137,12 +601,27 @@ type fidRef struct {
 	path      string // Track absolute path
 	isOpen    bool
 	openMode  uint8
+	qid       p9.Qid // of the open file
+}
+
+// postsNotes reports whether ref is open on /dev/note, /dev/wall or a
+// /proc/<pid>/note, known by device and qid wherever they are bound.
+func (ref fidRef) postsNotes() bool {
+	switch ref.client.addr {
+	case devAddr:
+		return ref.qid.Path == QidDevNote || ref.qid.Path == QidDevWall
+	case procAddr:
+		return ref.qid.Path&0xFF == QidProcNote
+	}
+	return false
 }
 
 // MessageTransport abstracts the connection (WebSocket or other).
+// WriteMsg sends one encoded message, so the session can count its bytes
+// without encoding it twice.
 type MessageTransport interface {
 	ReadMsg(ctx context.Context) (*p9.Fcall, error)
-	WriteMsg(ctx context.Context, f *p9.Fcall) error
+	WriteMsg(ctx context.Context, b []byte) error
 	Close() error
 }
 
@@ -152,11 +631,52 @@ type Session struct {
 	ns      *Namespace
 	user    string
 	vfsAddr string
-	pubKey  ed25519.PublicKey
+	keys    *TrustedKeys  // Factotum signing keys
 	host    *HostIdentity // Identity of the Kernel itself
 	dialer  Dialer
 
-	fids map[uint32]fidRef
+	id        uint32
+	transport string // e.g. tcp!10.0.0.5:4312
+	start     time.Time
+	rx, tx    atomic.Uint64 // bytes read and written on socket
+	msize     atomic.Uint32 // negotiated by Tversion; 0 is MaxMsize
+	ops       atomic.Uint64 // requests handled
+	debug     atomic.Bool   // log every Fcall (/proc/<pid>/ctl debug on)
+	tracing   atomic.Bool   // record relayed Fcalls in trace (ctl trace on)
+	trace     *Cons         // ring of trace lines, read at /proc/<pid>/trace
+	notes     *NoteQueue    // posted at /proc/<pid>/note and /dev/wall, read at /dev/note
+	last      atomic.Int64  // unix nanoseconds of the last message read or written
+	draining  atomic.Bool   // refusing new requests during Shutdown
+	cancel    context.CancelFunc
+	done      chan struct{} // closed when Serve returns
+	heir      *Session      // detached session this connection resumed
+	killed    atomic.Bool   // hung up on purpose; not resumable
+	opsRate   Bucket        // per-session limits from Quotas
+	bytesRate Bucket
+	limited   atomic.Uint64         // requests refused by limits
+	slots     chan struct{}         // one per outstanding request, up to maxInflight
+	peers     map[string]ExportPeer // export listener: Kernels allowed to import, by key ID
+
+	mu       sync.Mutex // guards ns, user, fids, auth, nextFid, inflight, nonce, expiry, attached, resume, admitted, root, socket, transport
+	wmu      sync.Mutex // serializes replies on socket
+	nonce    string     // nonce of the ticket attached with, if any
+	expiry   time.Time  // of that ticket
+	attached time.Time
+	resume   string // token to resume the session after a disconnect
+	admitted string // key the session counts against in Quotas
+	root     string // exported subtree; ".." does not climb above it
+	rootQid  p9.Qid
+	fids     map[uint32]fidRef
+	auth     map[uint32]*authConv // afid -> conversation with Factotum
+	nextFid  uint32               // next internal fid, counting down
+	inflight map[uint16]*request  // tag -> outstanding request
+}
+
+// request is an outstanding client request, handled in its own goroutine.
+type request struct {
+	cancel  context.CancelFunc
+	fid     uint32
+	flushed bool // reply suppressed by Tflush
 }
 
 // SessionRegistry tracks all active sessions.
@@ -171,13 +691,17 @@ var Registry = &SessionRegistry{
 	nextID:   1,
 }
 
+// Register adds s, assigning it an id unless it is a resumed session
+// that already has one.
 func (r *SessionRegistry) Register(s *Session) uint32 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	id := r.nextID
-	r.nextID++
-	r.sessions[id] = s
-	return id
+	if s.id == 0 {
+		s.id = r.nextID
+		r.nextID++
+	}
+	r.sessions[s.id] = s
+	return s.id
 }
 
 func (r *SessionRegistry) Unregister(id uint32) {
@@ -203,27 +727,122 @@ func (r *SessionRegistry) Get(id uint32) *Session {
 	return r.sessions[id]
 }
 
-func NewSession(sock MessageTransport, vfsAddr string, pubKey ed25519.PublicKey, host *HostIdentity, d Dialer) *Session {
+// Note posts note to every session, returning how many took it.
+func (r *SessionRegistry) Note(note string) int {
+	r.mu.RLock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.RUnlock()
+
+	n := 0
+	for _, s := range sessions {
+		if s.Note(note) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Revoke hangs up the sessions that attached as user before at, with any
+// ticket or only the one with nonce. It returns how many were hung up.
+func (r *SessionRegistry) Revoke(user, nonce string, at time.Time) int {
+	r.mu.RLock()
+	var victims []*Session
+	for _, s := range r.sessions {
+		s.mu.Lock()
+		held := s.nonce != "" && s.user == user && (nonce == "" || s.nonce == nonce) && s.attached.Before(at)
+		s.mu.Unlock()
+		if held {
+			victims = append(victims, s)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, s := range victims {
+		log.Printf("Session %d: ticket revoked for %s", s.id, user)
+		s.kill()
+	}
+	return len(victims)
+}
+
+func NewSession(sock MessageTransport, vfsAddr string, keys *TrustedKeys, host *HostIdentity, d Dialer) *Session {
 	return &Session{
-		socket:  sock,
-		vfsAddr: vfsAddr,
-		pubKey:  pubKey,
-		host:    host,
-		dialer:  d,
-		fids:    make(map[uint32]fidRef),
-		ns:      NewNamespace(),
+		socket:    sock,
+		vfsAddr:   vfsAddr,
+		keys:      keys,
+		host:      host,
+		dialer:    d,
+		fids:      make(map[uint32]fidRef),
+		auth:      make(map[uint32]*authConv),
+		nextFid:   0xFFFFFFFE,
+		inflight:  make(map[uint16]*request),
+		ns:        NewNamespace(),
+		transport: transportName(sock),
+		start:     time.Now(),
+		trace:     NewCons(),
+		notes:     NewNoteQueue(),
+		slots:     make(chan struct{}, maxInflight),
+	}
+}
+
+// maxInflight bounds a session's outstanding requests. Once reached, Serve
+// stops reading so a client that floods requests is slowed by its transport.
+const maxInflight = 64
+
+// transportName describes where a session's socket comes from.
+func transportName(sock MessageTransport) string {
+	switch t := sock.(type) {
+	case *TCPTransport:
+		if _, ok := t.conn.(*tls.Conn); ok {
+			return "tls!" + t.conn.RemoteAddr().String()
+		}
+		return "tcp!" + t.conn.RemoteAddr().String()
+	case *Socket:
+		return "ws!" + t.remote
 	}
+	return "unknown"
 }
 
 // Serve handles the 9P message loop.
+// Tversion and Tattach rebuild session state and are handled in order; every
+// other request runs in its own goroutine so a blocking read (e.g. /dev/cons)
+// does not stall the session. Tflush cancels the request it names.
 func (s *Session) Serve() {
-	defer s.socket.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		// The connection now carries the session it resumed
+		if s.heir != nil {
+			s.heir.Serve()
+		}
+	}()
+	defer close(s.done)
+	defer s.closeAuth()
+	defer func() {
+		if s.heir == nil {
+			s.socket.Close()
+		}
+		// Keep the session for its client to resume, or tear it down
+		if s.heir != nil || !Resumes.Detach(s) {
+			s.expire()
+		}
+	}()
+	defer wg.Wait()
+	defer cancel()
 
 	// Register Session
 	id := Registry.Register(s)
 	defer Registry.Unregister(id)
+	if shuttingDown() {
+		return // Accepted just before Shutdown closed the listeners
+	}
 
-	ctx := context.Background()
+	s.last.Store(time.Now().UnixNano())
+	go s.watchdog(ctx, Timeouts.Idle, Timeouts.Lifetime)
 
 	for {
 		// Read Message
@@ -232,104 +851,406 @@ func (s *Session) Serve() {
 			// Connection closed or error
 			return
 		}
+		s.last.Store(time.Now().UnixNano())
+		s.rx.Add(uint64(msg.Size))
+		s.ops.Add(1)
+		Stats.rx.Add(uint64(msg.Size))
+		if s.debug.Load() {
+			log.Printf("Session %d: <- %s", s.id, debugLine(msg))
+		}
+
+		if s.draining.Load() && msg.Type != p9.Tflush {
+			if !s.reply(ctx, &p9.Fcall{Type: p9.Rerror, Tag: msg.Tag, Ename: "kernel_shutting_down"}) {
+				return
+			}
+			continue
+		}
+		if ename := s.limit(msg); ename != "" {
+			if !s.reply(ctx, &p9.Fcall{Type: p9.Rerror, Tag: msg.Tag, Ename: ename}) {
+				return
+			}
+			continue
+		}
 
-		// Process Message
-		resp := s.handle(msg)
+		switch msg.Type {
+		case p9.Tversion, p9.Tattach:
+			if !s.reply(ctx, s.dispatch(ctx, msg)) || s.heir != nil {
+				return
+			}
+			continue
+		case p9.Tflush:
+			s.flush(ctx, msg)
+			continue
+		}
 
-		// Write Response
-		if err := s.socket.WriteMsg(ctx, resp); err != nil {
-			log.Printf("write error: %v", err)
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
 			return
 		}
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		r := &request{cancel: reqCancel, fid: msg.Fid}
+		s.mu.Lock()
+		s.inflight[msg.Tag] = r
+		s.mu.Unlock()
+
+		wg.Add(1)
+		go func(msg *p9.Fcall) {
+			defer wg.Done()
+			defer func() { <-s.slots }()
+			defer reqCancel()
+
+			// Process Message
+			resp := s.dispatch(reqCtx, msg)
+
+			s.mu.Lock()
+			delete(s.inflight, msg.Tag)
+			if r.flushed {
+				s.mu.Unlock()
+				return
+			}
+			// Take the write lock before releasing mu so a Tflush that
+			// misses this request still answers after its reply.
+			s.wmu.Lock()
+			s.mu.Unlock()
+			defer s.wmu.Unlock()
+
+			// Write Response
+			if err := s.write(ctx, resp); err != nil {
+				log.Printf("write error: %v", err)
+				s.socket.Close()
+			}
+		}(msg)
 	}
 }
 
-func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
-	resp := &p9.Fcall{
-		Tag:  req.Tag,
-		Type: req.Type + 1, // Default response type
+// dispatch handles req, auditing it if it changes files.
+func (s *Session) dispatch(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	switch req.Type {
+	case p9.Tcreate, p9.Tremove, p9.Twstat:
+		// Security-relevant: audit the path the request acted on
+		ref, _ := s.getFid(req.Fid)
+		path := ref.path
+		if req.Type == p9.Tcreate {
+			path = resolveJoin(path, req.Name)
+		}
+		resp := s.relay(ctx, req)
+		var err error
+		if resp.Type == p9.Rerror {
+			err = errors.New(resp.Ename)
+		}
+		kv := []string{"path", path}
+		switch req.Type {
+		case p9.Tcreate:
+			kv = append(kv, "perm", fmt.Sprintf("%o", req.Perm))
+		case p9.Twstat:
+			if d, _, derr := p9.UnmarshalDir(req.Stat); derr == nil {
+				kv = append(kv, "name", d.Name, "mode", fmt.Sprintf("%o", d.Mode), "length", fmt.Sprintf("%d", int64(d.Length)))
+			}
+		}
+		s.audit(strings.ToLower(p9.TypeName(req.Type)[1:]), err, kv...)
+		return resp
+	}
+	return s.relay(ctx, req)
+}
+
+// relay handles req, counting it in Stats and recording it in the trace.
+func (s *Session) relay(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	if !s.tracing.Load() {
+		resp := s.handle(ctx, req)
+		Stats.Op(req.Type, resp)
+		return resp
 	}
 
+	before, _ := s.getFid(req.Fid)
+	start := time.Now()
+	resp := s.handle(ctx, req)
+	elapsed := time.Since(start)
+	Stats.Op(req.Type, resp)
+
+	// The backend is the one holding the fid the request leaves behind.
+	ref := before
 	switch req.Type {
-	case p9.Tversion:
-		resp.Msize = req.Msize
-		resp.Version = "9P2000"
+	case p9.Tattach:
+		ref, _ = s.getFid(req.Fid)
+	case p9.Twalk:
+		ref, _ = s.getFid(req.Newfid)
+	}
+	backend := "-"
+	if ref.client != nil {
+		backend = plan9Addr(ref.client.addr)
+	}
+	s.trace.Write([]byte(traceLine(start, req, resp, backend, elapsed)))
+	return resp
+}
 
+// traceLine formats one relayed request/reply pair:
+// <unix-ms> <tag> <Tmsg> fid=<fid> [detail] <backend> -> <Rmsg> [detail] <latency>
+func traceLine(at time.Time, req, resp *p9.Fcall, backend string, elapsed time.Duration) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d %d %s fid=%d", at.UnixMilli(), req.Tag, p9.TypeName(req.Type), req.Fid)
+	switch req.Type {
 	case p9.Tattach:
-		// 1. Try to Fetch Namespace Manifest from VFS
-		// If this fails, we enter Rescue Mode (if bootstrapping) or fail (if authenticating).
-		manifest, err := fetchNamespaceManifest(s.vfsAddr, s.dialer, s.host)
+		fmt.Fprintf(&sb, " uname=%s aname=%q", req.Uname, ticketLabel(req.Aname))
+	case p9.Twalk:
+		fmt.Fprintf(&sb, " newfid=%d wname=%q", req.Newfid, strings.Join(req.Wname, "/"))
+	case p9.Topen:
+		fmt.Fprintf(&sb, " mode=%d", req.Mode)
+	case p9.Tcreate:
+		fmt.Fprintf(&sb, " name=%q perm=%o mode=%d", req.Name, req.Perm, req.Mode)
+	case p9.Tread:
+		fmt.Fprintf(&sb, " offset=%d count=%d", req.Offset, req.Count)
+	case p9.Twrite:
+		fmt.Fprintf(&sb, " offset=%d count=%d", req.Offset, len(req.Data))
+	}
+	fmt.Fprintf(&sb, " %s -> %s", backend, p9.TypeName(resp.Type))
+	switch resp.Type {
+	case p9.Rerror:
+		fmt.Fprintf(&sb, " %q", resp.Ename)
+	case p9.Rwalk:
+		fmt.Fprintf(&sb, " nwqid=%d", len(resp.Wqid))
+	case p9.Rread:
+		fmt.Fprintf(&sb, " count=%d", len(resp.Data))
+	case p9.Rwrite:
+		fmt.Fprintf(&sb, " count=%d", resp.Count)
+	}
+	fmt.Fprintf(&sb, " %s\n", elapsed)
+	return sb.String()
+}
 
-		s.ns = NewNamespace()
+// debugLine describes f for the debug log. Attach names go through
+// ticketLabel, so inline tickets and resume tokens are not logged.
+func debugLine(f *p9.Fcall) string {
+	if f.Type == p9.Tattach {
+		return fmt.Sprintf("%v uname=%s aname=%q", f, f.Uname, ticketLabel(f.Aname))
+	}
+	return f.String()
+}
 
-		// Decide Mode: Bootstrap (Aname empty or /) or Ticket (Aname = /adm/...)
-		isBootstrap := req.Aname == "" || req.Aname == "/"
+// audit records event for this session in the audit log, with the outcome.
+func (s *Session) audit(event string, err error, kv ...string) {
+	transport, remote, _ := strings.Cut(s.transport, "!")
+	base := []string{"session", strconv.FormatUint(uint64(s.id), 10), "user", s.uname(), "transport", transport, "remote", remote}
+	kv = append(base, kv...)
+	if err != nil {
+		kv = append(kv, "result", "error", "error", err.Error())
+	} else {
+		kv = append(kv, "result", "ok")
+	}
+	Audit.Record(event, kv...)
+}
 
-		if err != nil {
-			if isBootstrap {
-				// FAIL FAST: Consistent with Audit. No RAMFS.
-				return rError(req, "vfs_unavailable: "+err.Error())
-			} else {
-				return rError(req, "vfs_unavailable: "+err.Error())
-			}
-		} else {
-			// VFS Alive - Normal Boot
-			if isBootstrap {
-				// Bootstrap Mode: Build Full Namespace from Manifest
-				if err := s.ns.Build(manifest, s.dialer); err != nil {
+// reply writes resp to the socket, reporting whether the session is still usable.
+func (s *Session) reply(ctx context.Context, resp *p9.Fcall) bool {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.write(ctx, resp); err != nil {
+		log.Printf("write error: %v", err)
+		return false
+	}
+	return true
+}
+
+// write sends resp on the socket. Caller holds s.wmu.
+func (s *Session) write(ctx context.Context, resp *p9.Fcall) error {
+	s.last.Store(time.Now().UnixNano())
+	if s.debug.Load() {
+		log.Printf("Session %d: -> %s", s.id, debugLine(resp))
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		return err
+	}
+	s.tx.Add(uint64(len(b)))
+	Stats.tx.Add(uint64(len(b)))
+	return s.socket.WriteMsg(ctx, b)
+}
+
+// Note posts a note to the session. An interrupt note also interrupts the
+// session's outstanding requests.
+func (s *Session) Note(note string) error {
+	if err := s.notes.Post(note); err != nil {
+		return err
+	}
+	if note == "interrupt" {
+		s.interrupt()
+	}
+	return nil
+}
+
+// interrupt cancels the session's outstanding requests, which then fail with
+// "interrupted". Requests on note and wall files (see postsNotes) are left
+// alone: cutting short a read of /dev/note could lose the note, and the
+// writer of the note would see its own write fail.
+func (s *Session) interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.inflight {
+		if ref, ok := s.fids[r.fid]; ok {
+			if ref.postsNotes() {
+				continue
+			}
+		}
+		r.cancel()
+	}
+}
+
+// flush cancels the request named by req.Oldtag and answers Rflush.
+// The flushed request never gets a reply of its own.
+func (s *Session) flush(ctx context.Context, req *p9.Fcall) {
+	s.mu.Lock()
+	if r, ok := s.inflight[req.Oldtag]; ok {
+		r.flushed = true
+		r.cancel()
+	}
+	s.mu.Unlock()
+	s.reply(ctx, &p9.Fcall{Type: p9.Rflush, Tag: req.Tag})
+}
+
+func (s *Session) handle(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	resp := &p9.Fcall{
+		Tag:  req.Tag,
+		Type: req.Type + 1, // Default response type
+	}
+
+	// A read may not ask for more than fits in one reply, so no backend
+	// or device sizes a buffer from the client's count.
+	if req.Type == p9.Tread {
+		req.Count = min(req.Count, s.iounit())
+	}
+
+	switch req.Type {
+	case p9.Tread, p9.Twrite, p9.Tclunk:
+		if conv, ok := s.getAuth(req.Fid); ok {
+			return s.authRPC(ctx, conv, req)
+		}
+	}
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = min(req.Msize, MaxMsize)
+		resp.Version = "9P2000"
+		s.msize.Store(resp.Msize)
+		if t, ok := s.socket.(interface{ SetMsize(uint32) }); ok {
+			t.SetMsize(resp.Msize)
+		}
+
+	case p9.Tauth:
+		conv := &authConv{user: req.Uname}
+		if s.peers != nil {
+			// Export listener: the peer Kernel names its host key in aname
+			peer, ok := s.peers[req.Aname]
+			if !ok {
+				return rError(req, "unknown_peer: "+req.Aname)
+			}
+			if !peer.SpeaksFor(req.Uname) {
+				s.audit("import_denied", errors.New("user not allowed for peer"), "peer", req.Aname, "uname", req.Uname)
+				return rError(req, "permission denied")
+			}
+			conv.peer = req.Aname
+			conv.nonce = make([]byte, 32)
+			rand.Read(conv.nonce)
+		}
+		s.mu.Lock()
+		if _, ok := s.auth[req.Afid]; ok {
+			s.mu.Unlock()
+			return rError(req, "fid_in_use")
+		}
+		s.auth[req.Afid] = conv
+		s.mu.Unlock()
+		resp.Qid = p9.Qid{Type: p9.QTAUTH, Path: uint64(req.Afid)}
+
+	case p9.Tattach:
+		if token, ok := strings.CutPrefix(req.Aname, "resume "); ok {
+			return s.resumeAttach(req, strings.TrimSpace(token))
+		}
+		if s.peers != nil {
+			return s.exportAttach(ctx, req)
+		}
+
+		// 1. Try to Fetch Namespace Manifest from VFS
+		// If this fails, we enter Rescue Mode (if bootstrapping) or fail (if authenticating).
+		manifest, err := fetchNamespaceManifest(s.vfsAddr, s.dialer, s.host)
+
+		// The new namespace is built aside and replaces the old one whole,
+		// since earlier requests may still be routing through it.
+		ns := NewNamespace()
+		var user string
+
+		// Decide Mode: Bootstrap (Aname empty or /) or Ticket (Aname = /adm/...)
+		// An afid from a finished Tauth stands in for the ticket path
+		conv, authed := s.getAuth(req.Afid)
+		isBootstrap := !authed && (req.Aname == "" || req.Aname == "/")
+		nonce := "none"
+
+		if err != nil {
+			if isBootstrap {
+				// FAIL FAST: Consistent with Audit. No RAMFS.
+				return rError(req, "vfs_unavailable: "+err.Error())
+			} else {
+				return rError(req, "vfs_unavailable: "+err.Error())
+			}
+		} else {
+			// VFS Alive - Normal Boot
+			if isBootstrap {
+				// Bootstrap Mode: Build Full Namespace from Manifest
+				if err := s.admit("none"); err != nil {
+					return rError(req, err.Error())
+				}
+				if err := ns.Build(manifest, s.dialer); err != nil {
 					return rError(req, "namespace_build_failed: "+err.Error())
 				}
-				s.user = "none"
+				user = "none"
 			} else {
 				// Ticket Mode
-				ticket, err := ValidateTicket(req.Aname, s.vfsAddr, s.pubKey, s.host, s.dialer)
-				if err != nil {
+				var ticket *Ticket
+				if authed {
+					if ticket = conv.done(); ticket == nil {
+						return rError(req, "auth_incomplete")
+					}
+					if ticket.User != req.Uname {
+						return rError(req, "auth_user_mismatch")
+					}
+				} else if ticket, err = Tickets.Validate(req.Aname, s.vfsAddr, s.keys, s.host, s.dialer); err != nil {
+					s.audit("ticket_invalid", err, "ticket", ticketLabel(req.Aname))
 					return rError(req, err.Error())
 				}
-				s.user = ticket.User
+				if err := s.admit(ticket.User); err != nil {
+					return rError(req, err.Error())
+				}
+				user = ticket.User
+				nonce = ticket.Nonce
+				s.mu.Lock()
+				s.nonce = ticket.Nonce
+				s.expiry = ticket.Expiry
+				s.attached = time.Now()
+				if ResumeGrace > 0 {
+					s.resume = newResumeToken()
+				}
+				s.mu.Unlock()
+
+				// A user's first login provisions their home directory
+				if created, err := Homes.Provision(s.vfsAddr, s.dialer, s.host, user); created || err != nil {
+					s.audit("home", err, "home", "/usr/"+user)
+				}
 
 				// Build Full Namespace
-				if err := s.ns.Build(manifest, s.dialer); err != nil {
+				if err := ns.Build(manifest, s.dialer); err != nil {
 					return rError(req, "namespace_build_failed: "+err.Error())
 				}
 			}
 		}
 
-		// Mount /dev/sys (Always)
-		sysClient := NewSysClient(s.ns, s.dialer)
-		s.ns.Mount("/dev/sys", sysClient, MREPL)
-
-		// Mount /env
-		envClient := NewEnvClient()
-		s.ns.Mount("/env", envClient, MREPL)
+		s.mountDevices(ns, user)
+		s.setIdentity(user, ns)
 
 		// Attach to Root
-		rootStack := s.ns.Route("/")
-		if len(rootStack) == 0 {
-			return rError(req, "root_mount_missing")
-		}
-		// Default to first match for root attach?
-		// In Plan 9, attaching to / usually lands you on the head of the union.
-		rootRoute := rootStack[0]
-
-		fReq := &p9.Fcall{
-			Type:  p9.Tattach,
-			Fid:   req.Fid,
-			Afid:  p9.NOFID,
-			Uname: s.user,
-			Aname: rootRoute.RelPath,
+		qid, ename := s.attachRoot(req.Fid)
+		if ename != "" {
+			return rError(req, ename)
 		}
-
-		fResp, err := rootRoute.Client.RPC(fReq)
-		if err != nil {
-			return rError(req, "attach_failed: "+err.Error())
-		}
-
-		resp.Qid = fResp.Qid
-		s.putFid(req.Fid, rootRoute.Client, req.Fid, "/") // Store "/"
-
-	case p9.Tflush:
-		resp.Type = p9.Rflush
+		resp.Qid = qid
+		s.audit("attach", nil, "nonce", nonce)
 
 	case p9.Twalk:
 		ref, ok := s.getFid(req.Fid)
@@ -369,10 +1290,11 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 
 		success := true
+		user, ns := s.identity()
 
 		// Helper to find current mount point
 		getMountPoint := func(path string, client *Client) string {
-			stack := s.ns.Route(path)
+			stack := ns.Route(path)
 			for _, r := range stack {
 				if r.Client == client {
 					return r.MountPoint
@@ -381,14 +1303,20 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 			return "/"
 		}
 		currMountPoint := getMountPoint(currPath, currClient)
+		root, rootQid := s.exportRoot()
 
 		for _, name := range req.Wname {
 			log.Printf("DEBUG: Twalk Loop Name=%s CurrPath=%s", name, currPath)
+			if name == ".." && currPath == root {
+				// The top of an exported subtree is its own parent
+				wqids = append(wqids, rootQid)
+				continue
+			}
 			// Calculate next path
 			nextPath := resolvePath(currPath, name)
 
 			// Get the Stack for the *next* path
-			nextStack := s.ns.Route(nextPath)
+			nextStack := ns.Route(nextPath)
 			if len(nextStack) == 0 {
 				log.Printf("DEBUG: Route failed for path %s (curr=%s, name=%s)", nextPath, currPath, name)
 				success = false
@@ -438,7 +1366,7 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 				probFid := s.nextInternalFid()
 
 				// Attach to Root of candidate client
-				aResp, err := candidate.Client.RPC(&p9.Fcall{Type: p9.Tattach, Fid: probFid, Afid: p9.NOFID, Uname: s.user, Aname: "/"})
+				aResp, err := candidate.Client.RPC(&p9.Fcall{Type: p9.Tattach, Fid: probFid, Afid: p9.NOFID, Uname: user, Aname: "/"})
 				if err == nil {
 					// Walk to the target RelPath
 					pathParts := strings.Split(strings.Trim(candidate.RelPath, "/"), "/")
@@ -536,7 +1464,8 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		// Update ref state
 		ref.isOpen = true
 		ref.openMode = req.Mode
-		s.fids[req.Fid] = ref
+		ref.qid = fResp.Qid
+		s.setFid(req.Fid, ref)
 
 		resp.Qid = fResp.Qid
 		resp.Iounit = fResp.Iounit
@@ -556,9 +1485,10 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		// Update ref state - Tcreate opens the file
 		ref.isOpen = true
 		ref.openMode = req.Mode
+		ref.qid = fResp.Qid
 		// Note: Tcreate modifies the path of the fid to the new file
 		ref.path = resolveJoin(ref.path, req.Name)
-		s.fids[req.Fid] = ref
+		s.setFid(req.Fid, ref)
 
 		resp.Qid = fResp.Qid
 		resp.Iounit = fResp.Iounit
@@ -570,7 +1500,10 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 		fReq := *req
 		fReq.Fid = ref.remoteFid
-		fResp, err := ref.client.RPC(&fReq)
+		fResp, err := ref.client.RPCContext(ctx, &fReq)
+		if ctx.Err() != nil {
+			return rError(req, "interrupted")
+		}
 
 		// Recovery Logic
 		if err != nil || fResp.Type == p9.Rerror {
@@ -589,7 +1522,7 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 					// Retry RPC
 					fReq.Fid = newFid
 					retryReq := fReq // Copy request to avoid tag issues
-					fResp, err = client.RPC(&retryReq)
+					fResp, err = client.RPCContext(ctx, &retryReq)
 				}
 			}
 		}
@@ -609,7 +1542,7 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 		fReq := *req
 		fReq.Fid = ref.remoteFid
-		fResp, err := ref.client.RPC(&fReq)
+		fResp, err := ref.client.RPCContext(ctx, &fReq)
 		if err != nil {
 			return rError(req, "write_error: "+err.Error())
 		}
@@ -628,11 +1561,33 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 		resp.Stat = fResp.Stat
 
+	case p9.Twstat:
+		ref, ok := s.getFid(req.Fid)
+		if !ok {
+			return rError(req, "fid_not_found")
+		}
+		fReq := *req
+		fReq.Fid = ref.remoteFid
+		fResp, err := ref.client.RPC(&fReq)
+		if err != nil {
+			return rError(req, "wstat_error: "+err.Error())
+		}
+		if fResp.Type == p9.Rerror {
+			return rError(req, fResp.Ename)
+		}
+
 	case p9.Tremove:
 		ref, ok := s.getFid(req.Fid)
 		if ok {
-			ref.client.RPC(&p9.Fcall{Type: p9.Tremove, Fid: ref.remoteFid})
+			// The fid is gone whether or not the remove succeeds
+			fResp, err := ref.client.RPC(&p9.Fcall{Type: p9.Tremove, Fid: ref.remoteFid})
 			s.delFid(req.Fid)
+			if err != nil {
+				return rError(req, "remove_error: "+err.Error())
+			}
+			if fResp.Type == p9.Rerror {
+				return rError(req, fResp.Ename)
+			}
 		}
 		resp.Type = p9.Rremove
 
@@ -643,16 +1598,386 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 	return resp
 }
 
+// authConv is a Tauth conversation over an afid. The client either writes
+// "ticket <user> <expiry> <nonce> <sig> [<kid>]", which the Kernel verifies
+// offline, or talks to Factotum's /rpc through it until Factotum hands out a
+// ticket. Either way Tattach with the afid then attaches as the ticket's user.
+type authConv struct {
+	user  string // uname from Tauth
+	peer  string // key ID of the importing Kernel, on an export listener
+	nonce []byte // host challenge for peer
+
+	mu     sync.Mutex
+	client *Client // Factotum, dialed on the first relayed request
+	ticket *Ticket
+}
+
+func (c *authConv) done() *Ticket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ticket
+}
+
+func (c *authConv) finish(t *Ticket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ticket = t
+}
+
+func (c *authConv) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// rpc returns the connection to Factotum, opening its /rpc on first use.
+func (c *authConv) rpc(s *Session) (*Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	addr := factotumAddr(s.vfsAddr, s.dialer, s.host)
+	if addr == "" {
+		return nil, errors.New("factotum address unknown")
+	}
+	client, err := Srv.Dial(s.dialer, addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range []*p9.Fcall{
+		{Type: p9.Tversion, Msize: 8192, Version: "9P2000"},
+		{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "kernel", Aname: "/"},
+		{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"rpc"}},
+		{Type: p9.Topen, Fid: 1, Mode: p9.ORDWR},
+	} {
+		resp, err := client.RPC(req)
+		if err == nil && resp.Type == p9.Rerror {
+			err = errors.New(resp.Ename)
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	c.client = client
+	return client, nil
+}
+
+// authRPC handles a Tread, Twrite or Tclunk on an afid. An inline ticket is
+// verified here; anything else is relayed to Factotum's /rpc, where a read
+// of "ok ticket=<path>" completes the conversation.
+func (s *Session) authRPC(ctx context.Context, conv *authConv, req *p9.Fcall) *p9.Fcall {
+	if req.Type == p9.Tclunk {
+		s.mu.Lock()
+		delete(s.auth, req.Fid)
+		s.mu.Unlock()
+		conv.close()
+		return &p9.Fcall{Type: p9.Rclunk, Tag: req.Tag}
+	}
+	if conv.nonce != nil {
+		return s.peerAuth(conv, req)
+	}
+
+	if req.Type == p9.Twrite {
+		if inline, ok := strings.CutPrefix(strings.TrimSpace(string(req.Data)), "ticket "); ok {
+			ticket, err := Tickets.Validate(inline, s.vfsAddr, s.keys, s.host, s.dialer)
+			if err != nil {
+				s.audit("ticket_invalid", err, "ticket", ticketLabel(inline), "uname", conv.user)
+				return rError(req, err.Error())
+			}
+			conv.finish(ticket)
+			return &p9.Fcall{Type: p9.Rwrite, Tag: req.Tag, Count: uint32(len(req.Data))}
+		}
+	}
+
+	client, err := conv.rpc(s)
+	if err != nil {
+		return rError(req, "auth_failed: "+err.Error())
+	}
+	fReq := *req
+	fReq.Fid = 1
+	fResp, err := client.RPCContext(ctx, &fReq)
+	if err != nil {
+		return rError(req, "auth_error: "+err.Error())
+	}
+	if fResp.Type == p9.Rerror {
+		return rError(req, fResp.Ename)
+	}
+	resp := &p9.Fcall{Type: fResp.Type, Tag: req.Tag, Count: fResp.Count, Data: fResp.Data}
+
+	if req.Type == p9.Tread {
+		fields := strings.Fields(string(fResp.Data))
+		if len(fields) == 2 && fields[0] == "ok" && strings.HasPrefix(fields[1], "ticket=") {
+			path := strings.TrimPrefix(fields[1], "ticket=")
+			ticket, err := Tickets.Validate(path, s.vfsAddr, s.keys, s.host, s.dialer)
+			if err != nil {
+				s.audit("ticket_invalid", err, "ticket", path, "uname", conv.user)
+				return rError(req, err.Error())
+			}
+			conv.finish(ticket)
+		}
+	}
+	return resp
+}
+
+func (s *Session) getAuth(afid uint32) (*authConv, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, ok := s.auth[afid]
+	return conv, ok
+}
+
+// closeAuth hangs up every unfinished Tauth conversation.
+func (s *Session) closeAuth() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for afid, conv := range s.auth {
+		conv.close()
+		delete(s.auth, afid)
+	}
+}
+
+// busy reports whether the session has requests outstanding.
+func (s *Session) busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight) > 0
+}
+
+// watchdog hangs up the session once it has been idle for idle or
+// connected for lifetime (Timeouts when Serve started). A session waiting
+// on a blocking read is not idle.
+func (s *Session) watchdog(ctx context.Context, idle, lifetime time.Duration) {
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+	every := time.Second
+	for _, d := range []time.Duration{idle, lifetime} {
+		if d > 0 && d/4 < every {
+			every = max(d/4, 10*time.Millisecond)
+		}
+	}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			reason := ""
+			switch {
+			case lifetime > 0 && now.Sub(s.start) >= lifetime:
+				reason = "session_expired"
+			case idle > 0 && now.Sub(time.Unix(0, s.last.Load())) >= idle && !s.busy():
+				reason = "idle_timeout"
+			}
+			if reason != "" {
+				log.Printf("Session %d: %s, hanging up", s.id, reason)
+				s.kill()
+				return
+			}
+		}
+	}
+}
+
+// attachRoot attaches fid to the root of the session's namespace.
+func (s *Session) attachRoot(fid uint32) (p9.Qid, string) {
+	user, ns := s.identity()
+	rootStack := ns.Route("/")
+	if len(rootStack) == 0 {
+		return p9.Qid{}, "root_mount_missing"
+	}
+	// Default to first match for root attach?
+	// In Plan 9, attaching to / usually lands you on the head of the union.
+	rootRoute := rootStack[0]
+
+	fReq := &p9.Fcall{
+		Type:  p9.Tattach,
+		Fid:   fid,
+		Afid:  p9.NOFID,
+		Uname: user,
+		Aname: rootRoute.RelPath,
+	}
+
+	fResp, err := rootRoute.Client.RPC(fReq)
+	if err != nil {
+		return p9.Qid{}, "attach_failed: " + err.Error()
+	}
+	if fResp.Type == p9.Rerror {
+		return p9.Qid{}, fResp.Ename
+	}
+
+	s.putFid(fid, rootRoute.Client, fid, "/") // Store "/"
+	return fResp.Qid, ""
+}
+
+// mountDevices mounts the Kernel's own file servers over ns, which user's
+// session is about to take.
+func (s *Session) mountDevices(ns *Namespace, user string) {
+	ns.Mount("/dev/sys", NewSysClient(s, ns), MREPL)
+	ns.Mount("/dev", NewDevClient(s), MREPL)
+	ns.Mount("/proc", NewProcClient(s), MREPL)
+	ns.Mount("/srv", NewSrvClient(s), MREPL)
+	ns.Mount("/env", NewEnvClient(s, user), MREPL)
+	ns.Mount("/tmp", NewTmpClient(user), MREPL)
+}
+
+// identity returns the session's user and namespace. Tattach replaces both.
+func (s *Session) identity() (string, *Namespace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user, s.ns
+}
+
+// uname returns the session's user.
+func (s *Session) uname() string {
+	user, _ := s.identity()
+	return user
+}
+
+// namespace returns the session's namespace.
+func (s *Session) namespace() *Namespace {
+	_, ns := s.identity()
+	return ns
+}
+
+// iounit returns the most data one Rread may carry on this session.
+func (s *Session) iounit() uint32 {
+	msize := s.msize.Load()
+	if msize == 0 {
+		msize = MaxMsize
+	}
+	return msize - min(msize, IOHDRSZ)
+}
+
+// setIdentity makes user and ns the session's and hangs up the namespace
+// they replace; fids walked in it fail from then on.
+func (s *Session) setIdentity(user string, ns *Namespace) {
+	s.mu.Lock()
+	old := s.ns
+	s.user, s.ns = user, ns
+	s.mu.Unlock()
+	if old != nil && old != ns {
+		old.Close()
+	}
+}
+
+// kill hangs up the session for good: unlike a dropped connection, it
+// cannot be resumed.
+func (s *Session) kill() error {
+	s.killed.Store(true)
+	return s.conn().Close()
+}
+
+// conn returns the transport the session is currently served on.
+func (s *Session) conn() MessageTransport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.socket
+}
+
+// expire tears down a session that will not be resumed.
+func (s *Session) expire() {
+	s.release()
+	s.trace.Close()
+	Srv.Drop(s) // Withdraw posts once no request can make more
+}
+
+// release clunks the session's backend fids, closes its mounts and frees
+// its place in the user's session quota. Serve calls it once no request is
+// left running.
+func (s *Session) release() {
+	s.mu.Lock()
+	fids, admitted := s.fids, s.admitted
+	s.fids = make(map[uint32]fidRef)
+	s.admitted = ""
+	s.mu.Unlock()
+	if admitted != "" {
+		Quotas.Leave(admitted)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	for _, ref := range fids {
+		ref.client.RPCContext(ctx, &p9.Fcall{Type: p9.Tclunk, Fid: ref.remoteFid})
+	}
+	s.namespace().Close()
+}
+
+// releaseTimeout bounds how long release waits on backends for Rclunk.
+const releaseTimeout = 2 * time.Second
+
+// Shutdown hangs up the session gracefully. New requests are refused with
+// kernel_shutting_down, outstanding ones may finish until ctx is done and
+// are cancelled after that. The transport is then closed as going away and
+// Shutdown waits for Serve to release the backends.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	var err error
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+wait:
+	for s.busy() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.cancel()
+			break wait
+		case <-tick.C:
+		}
+	}
+
+	// A drained request may still be writing its reply
+	locked := false
+	for err == nil && !locked {
+		if locked = s.wmu.TryLock(); !locked {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-tick.C:
+			}
+		}
+	}
+	if sock, ok := s.conn().(*Socket); ok {
+		sock.close(websocket.StatusGoingAway, "kernel shutting down")
+	} else {
+		s.conn().Close()
+	}
+	if locked {
+		s.wmu.Unlock()
+	}
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
 func (s *Session) getFid(id uint32) (fidRef, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	f, ok := s.fids[id]
 	return f, ok
 }
 
 func (s *Session) putFid(fid uint32, client *Client, remoteFid uint32, path string) {
-	s.fids[fid] = fidRef{client: client, remoteFid: remoteFid, path: path}
+	s.setFid(fid, fidRef{client: client, remoteFid: remoteFid, path: path})
+}
+
+func (s *Session) setFid(fid uint32, ref fidRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fids[fid] = ref
 }
 
 func (s *Session) delFid(fid uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.fids, fid)
 }
 
@@ -679,7 +2004,8 @@ func resolvePath(base, name string) string {
 
 // recoverFid attempts to re-establish a FID for a given path using the namespace.
 func (s *Session) recoverFid(ref fidRef) (*Client, uint32, error) {
-	routeStack := s.ns.Route(ref.path)
+	Stats.recoveries.Add(1)
+	routeStack := s.namespace().Route(ref.path)
 	if len(routeStack) == 0 {
 		return nil, 0, fmt.Errorf("route not found for %s", ref.path)
 	}
@@ -737,14 +2063,19 @@ func (s *Session) recoverFid(ref fidRef) (*Client, uint32, error) {
 }
 
 func (s *Session) nextInternalFid() uint32 {
-	// Start from high numbers to avoid collision with user FIDs (usually low numbers)
-	// Simple collision check against s.fids
-	for i := uint32(0xFFFFFFFE); i > 0; i-- {
-		if _, ok := s.fids[i]; !ok {
-			return i
-		}
-	}
-	return 0 // Full?
+	// Count down from high numbers to avoid collision with user FIDs (usually low numbers)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		fid := s.nextFid
+		s.nextFid--
+		if s.nextFid == 0 {
+			s.nextFid = 0xFFFFFFFE
+		}
+		if _, ok := s.fids[fid]; !ok {
+			return fid
+		}
+	}
 }
 
 func rError(req *p9.Fcall, ename string) *p9.Fcall {
@@ -841,6 +2172,7 @@ const (
 	MBEFORE = 0x0001 // Add to head of union
 	MAFTER  = 0x0002 // Add to tail of union
 	MCREATE = 0x0004 // Allow creation in this union element
+	MCACHE  = 0x0010 // Cache file data and stats (mount -C)
 )
 
 // mountEntry represents a mount point with an optional path offset for binds.
@@ -879,11 +2211,72 @@ func BootstrapNamespace(factotumAddr string, d Dialer) (*Namespace, error) {
 	return ns, nil
 }
 
-// Mount adds a client at a specific path.
+// Mount adds a client at a specific path. With MCACHE the client reads
+// through Cache.
 func (ns *Namespace) Mount(path string, client *Client, flags int) {
+	if flags&MCACHE != 0 {
+		client = NewCachedClient(client)
+	}
 	ns.BindEntry(path, &mountEntry{client: client, offset: "", flags: flags}, flags)
 }
 
+// Unmount removes everything mounted or bound at path, reporting whether
+// there was anything. It returns the clients no longer used anywhere in the
+// namespace; a client a bind shares with another path is left to it.
+func (ns *Namespace) Unmount(path string) ([]*Client, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	entries, ok := ns.mounts[path]
+	delete(ns.mounts, path)
+
+	used := make(map[*Client]bool)
+	for _, rest := range ns.mounts {
+		for _, e := range rest {
+			used[e.client] = true
+		}
+	}
+	var clients []*Client
+	for _, e := range entries {
+		if e.client != nil && !used[e.client] {
+			used[e.client] = true
+			clients = append(clients, e.client)
+		}
+	}
+	return clients, ok
+}
+
+// Close hangs up every client mounted in the namespace and empties it.
+// Binds share their source's client, which is closed once.
+func (ns *Namespace) Close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	closed := make(map[*Client]bool)
+	for path, entries := range ns.mounts {
+		for _, e := range entries {
+			if e.client != nil && !closed[e.client] {
+				closed[e.client] = true
+				e.client.Close()
+			}
+		}
+		delete(ns.mounts, path)
+	}
+}
+
+// Mounts reports whether addr backs anything mounted in the namespace,
+// alone or as a replica.
+func (ns *Namespace) Mounts(addr string) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	for _, entries := range ns.mounts {
+		for _, e := range entries {
+			if e.client != nil && slices.Contains(strings.Fields(e.client.addr), addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Bind creates a path alias or union.
 // oldPath: The existing path to bind from (the source).
 // newPath: The location to bind to (the target).
@@ -1074,32 +2467,62 @@ func (ns *Namespace) Route(path string) []*ResolvedPath {
 	return stack
 }
 
+// String lists the namespace in manifest form, one mount per line:
+// mount [flags] <path> <addr> [<offset>]
 func (ns *Namespace) String() string {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
+
+	paths := make([]string, 0, len(ns.mounts))
+	for path := range ns.mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
 	var sb strings.Builder
-	for path, entries := range ns.mounts {
-		for _, e := range entries {
+	for _, path := range paths {
+		for _, e := range ns.mounts[path] {
 			flag := ""
 			if e.flags&MAFTER != 0 {
-				flag = "-a "
+				flag += "-a "
 			}
 			if e.flags&MBEFORE != 0 {
-				flag = "-b "
+				flag += "-b "
 			}
 			if e.flags&MCREATE != 0 {
-				flag = "-c "
+				flag += "-c "
+			}
+			if e.flags&MCACHE != 0 {
+				flag += "-C "
+			}
+			line := fmt.Sprintf("mount %s%s %s", flag, path, plan9Addr(e.client.addr))
+			if e.offset != "" {
+				line += " " + e.offset
 			}
-			// We can't easily get remote addr from client here without refactoring Client
-			// Just output mount point
-			sb.WriteString(fmt.Sprintf("mount %s%s %s\n", flag, "service", path))
+			sb.WriteString(line + "\n")
 		}
 	}
 	return sb.String()
 }
 
+// plan9Addr is the inverse of convertAddr: host:port becomes tcp!host!port.
+// Replicated clients name several addresses separated by spaces.
+func plan9Addr(addr string) string {
+	fields := strings.Fields(addr)
+	for i, a := range fields {
+		if strings.Contains(a, "!") {
+			continue
+		}
+		if c := strings.LastIndex(a, ":"); c >= 0 {
+			a = a[:c] + "!" + a[c+1:]
+		}
+		fields[i] = "tcp!" + a
+	}
+	return strings.Join(fields, " ")
+}
+
 // Build constructs the namespace from a manifest string.
-// Format: mount <path> tcp!<host>!<port> [flags...]
+// Format: mount <path> tcp!<host>!<port> [tcp!<host>!<port>...] [flags...]
 // or: bind <old> <new> [flags...]
 func (ns *Namespace) Build(manifest string, d Dialer) error {
 	lines := strings.Split(manifest, "\n")
@@ -1120,9 +2543,14 @@ func (ns *Namespace) Build(manifest string, d Dialer) error {
 				continue
 			}
 			path := args[0]
-			addr := convertAddr(args[1])
 
-			client, err := d.Dial(addr)
+			// mount <path> <addr> [<addr>...]: several addresses name replicas.
+			// An address of the form /srv/<name> is looked up in /srv.
+			addrs := make([]string, 0, len(args)-1)
+			for _, a := range args[1:] {
+				addrs = append(addrs, convertAddr(a))
+			}
+			client, err := dialMount(d, addrs, true)
 			if err != nil {
 				return fmt.Errorf("failed to mount %s: %w", path, err)
 			}
@@ -1160,6 +2588,8 @@ func parseFlags(args []string) (int, []string) {
 				f &^= MREPL
 			} else if a == "-c" {
 				f |= MCREATE
+			} else if a == "-C" {
+				f |= MCACHE
 			}
 		} else {
 			remaining = append(remaining, a)
@@ -1173,8 +2603,12 @@ func parseFlags(args []string) (int, []string) {
 	return f, remaining
 }
 
-// convertAddr converts "tcp!host!port" to "host:port".
+// convertAddr converts "tcp!host!port" to "host:port". tls!host!port is
+// left for DialNet.
 func convertAddr(plan9Addr string) string {
+	if strings.HasPrefix(plan9Addr, "tls!") {
+		return plan9Addr
+	}
 	s := strings.TrimPrefix(plan9Addr, "tcp!")
 	return strings.Replace(s, "!", ":", 1)
 }
@@ -1182,12 +2616,22 @@ func convertAddr(plan9Addr string) string {
 // --- Client Logic ---
 
 // Client represents a connection to a backend 9P service.
+// Requests from several goroutines may be outstanding at once; a read loop
+// matches responses to requests by tag.
+// A Client created by DialReplicated has no conn of its own; it forwards
+// every RPC to whichever replica of its group is currently healthy.
 type Client struct {
 	addr    string
 	conn    net.Conn
-	mu      sync.Mutex
+	mu      sync.Mutex // guards tag, lastFid, pending, err
+	wmu     sync.Mutex // serializes writes to conn
 	tag     uint16
 	lastFid uint32
+	pending map[uint16]chan *p9.Fcall
+	err     error // set when the read loop stops
+	group   *ReplicaSet
+	view    *FidView
+	cache   *CacheView
 }
 
 // --- Retry Logic (inlined from pkg/resilience) ---
@@ -1239,9 +2683,10 @@ type Dialer interface {
 	Dial(addr string) (*Client, error)
 }
 
-// NetworkDialer implements Dialer using net.Dial with retry.
+// NetworkDialer implements Dialer using DialNet with retry.
 type NetworkDialer struct {
 	RetryConfig RetryConfig
+	TLS         *TLSSettings // for tls! addresses; nil uses the Kernel's TLS
 }
 
 // NewNetworkDialer creates a NetworkDialer with default retry settings.
@@ -1254,10 +2699,13 @@ func NewNetworkDialer() *NetworkDialer {
 // Dial connects to a backend service with retry logic.
 func (d *NetworkDialer) Dial(addr string) (*Client, error) {
 	var client *Client
-	cleanAddr := convertAddr(addr) // Strip tcp!
+	settings := d.TLS
+	if settings == nil {
+		settings = TLS
+	}
 
 	err := Retry(d.RetryConfig, func() error {
-		conn, err := net.Dial("tcp", cleanAddr)
+		conn, err := DialNet(addr, settings)
 		if err != nil {
 			return err
 		}
@@ -1275,8 +2723,114 @@ func (d *NetworkDialer) Dial(addr string) (*Client, error) {
 	return client, nil
 }
 
+// PipeDialer is an in-process network. Services Listen on an address and
+// Dial reaches them over net.Pipe, so several services can run in one
+// process without touching the network. Addresses are compared after
+// convertAddr, so tcp!vfs!9001 and vfs:9001 name the same listener.
+// Addresses nobody listens on go to Fallback, if set.
+type PipeDialer struct {
+	Fallback Dialer
+	mu       sync.Mutex
+	ln       map[string]*pipeListener
+}
+
+// NewPipeDialer creates a PipeDialer with no listeners.
+func NewPipeDialer() *PipeDialer {
+	return &PipeDialer{ln: make(map[string]*pipeListener)}
+}
+
+// Listen announces addr. Closing the listener withdraws it.
+func (d *PipeDialer) Listen(addr string) (net.Listener, error) {
+	addr = convertAddr(addr)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.ln[addr]; ok {
+		return nil, fmt.Errorf("address in use: %s", addr)
+	}
+	l := &pipeListener{d: d, addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+	d.ln[addr] = l
+	return l, nil
+}
+
+// DialConn connects to a listener on addr.
+func (d *PipeDialer) DialConn(addr string) (net.Conn, error) {
+	d.mu.Lock()
+	l, ok := d.ln[convertAddr(addr)]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- c2:
+		return c1, nil
+	case <-l.done:
+		c1.Close()
+		c2.Close()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+}
+
+// Dial connects to a listener on addr, or through Fallback.
+func (d *PipeDialer) Dial(addr string) (*Client, error) {
+	d.mu.Lock()
+	_, ok := d.ln[convertAddr(addr)]
+	d.mu.Unlock()
+	if !ok && d.Fallback != nil {
+		return d.Fallback.Dial(addr)
+	}
+	conn, err := d.DialConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr: addr, conn: conn, tag: 1}, nil
+}
+
+type pipeListener struct {
+	d     *PipeDialer
+	addr  string
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		l.d.mu.Lock()
+		delete(l.d.ln, l.addr)
+		l.d.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.addr) }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
 // Close closes the connection.
 func (c *Client) Close() error {
+	if c.group != nil {
+		return c.group.Close()
+	}
+	if c.view != nil {
+		return c.view.Close()
+	}
+	if c.cache != nil {
+		return c.cache.Close()
+	}
 	if c.conn != nil {
 		return c.conn.Close()
 	}
@@ -1309,7 +2863,7 @@ func (c *Client) Authenticate(user string, key ed25519.PrivateKey) (uint32, erro
 	nonce := resp.Data
 
 	// 3. Sign Nonce
-	sig := ed25519.Sign(key, nonce)
+	sig := ed25519.Sign(key, append([]byte(HostAuthContext), nonce...))
 
 	// 4. Write Signature (Twrite afid)
 	tWrite := &p9.Fcall{Type: p9.Twrite, Fid: afid, Offset: 0, Data: sig, Count: uint32(len(sig))}
@@ -1337,36 +2891,138 @@ func (c *Client) NextFid() uint32 {
 
 // RPC sends a request and waits for a response.
 func (c *Client) RPC(req *p9.Fcall) (*p9.Fcall, error) {
+	return c.RPCContext(context.Background(), req)
+}
+
+// RPCContext is RPC with cancellation.
+// If ctx is done before the response arrives, the request is flushed on the
+// backend with Tflush and ctx.Err() is returned.
+func (c *Client) RPCContext(ctx context.Context, req *p9.Fcall) (*p9.Fcall, error) {
+	if c.group != nil {
+		return c.group.RPCContext(ctx, req)
+	}
+	if c.view != nil {
+		return c.view.RPCContext(ctx, req)
+	}
+	if c.cache != nil {
+		return c.cache.RPCContext(ctx, req)
+	}
+
+	start := time.Now()
+	ch, err := c.send(req)
+	if err != nil {
+		Stats.RPC(c.addr, time.Since(start), err)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			err := c.readErr()
+			Stats.RPC(c.addr, time.Since(start), err)
+			return nil, err
+		}
+		Stats.RPC(c.addr, time.Since(start), nil)
+		return resp, nil
+	case <-ctx.Done():
+		c.flush(req.Tag)
+		return nil, ctx.Err()
+	}
+}
+
+// send allocates a tag for req, registers it as pending and writes it.
+// The returned channel receives the response, or is closed if the connection dies.
+func (c *Client) send(req *p9.Fcall) (chan *p9.Fcall, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	if c.pending == nil {
+		c.pending = make(map[uint16]chan *p9.Fcall)
+		go c.readLoop()
+	}
 
-	// Alloc Tag
-	if req.Tag == p9.NOTAG {
+	// Alloc Tag (Tversion always travels as NOTAG)
+	if req.Type == p9.Tversion {
+		req.Tag = p9.NOTAG
+	} else {
 		req.Tag = c.nextTag()
 	}
+	ch := make(chan *p9.Fcall, 1)
+	c.pending[req.Tag] = ch
+	c.mu.Unlock()
 
 	if err := c.writeFcall(req); err != nil {
+		c.mu.Lock()
+		delete(c.pending, req.Tag)
+		c.mu.Unlock()
 		return nil, err
 	}
-	resp, err := c.readFcall()
-	if err != nil {
-		return nil, err
+	return ch, nil
+}
+
+// flush asks the backend to abandon oldtag and waits for Rflush.
+func (c *Client) flush(oldtag uint16) {
+	ch, err := c.send(&p9.Fcall{Type: p9.Tflush, Oldtag: oldtag})
+	if err == nil {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+		}
 	}
+	c.mu.Lock()
+	delete(c.pending, oldtag)
+	c.mu.Unlock()
+}
 
-	if resp.Tag != req.Tag {
-		return nil, fmt.Errorf("tag mismatch: expected %d, got %d", req.Tag, resp.Tag)
+// readLoop delivers responses to their pending requests until the connection fails.
+func (c *Client) readLoop() {
+	for {
+		resp, err := c.readFcall()
+
+		c.mu.Lock()
+		if err != nil {
+			c.err = err
+			for tag, ch := range c.pending {
+				close(ch)
+				delete(c.pending, tag)
+			}
+			c.mu.Unlock()
+			return
+		}
+		ch, ok := c.pending[resp.Tag]
+		delete(c.pending, resp.Tag)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- resp
+		}
 	}
+}
 
-	return resp, nil
+func (c *Client) readErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		return errors.New("connection closed")
+	}
+	return c.err
 }
 
-// nextTag increments and returns the next available tag, handling wrap-around.
+// nextTag returns the next tag not in flight, handling wrap-around.
+// Caller holds c.mu.
 func (c *Client) nextTag() uint16 {
-	c.tag++
-	if c.tag == p9.NOTAG { // Wrap around, 0 is NOTAG
-		c.tag = 1
+	for {
+		c.tag++
+		if c.tag == p9.NOTAG { // Wrap around, NOTAG is reserved
+			c.tag = 1
+		}
+		if _, busy := c.pending[c.tag]; !busy {
+			return c.tag
+		}
 	}
-	return c.tag
 }
 
 // writeFcall encodes and writes an Fcall to the connection.
@@ -1376,6 +3032,8 @@ func (c *Client) writeFcall(req *p9.Fcall) error {
 		return fmt.Errorf("encode failed: %w", err)
 	}
 
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	if _, err := c.conn.Write(buf); err != nil {
 		return fmt.Errorf("write failed: %w", err)
 	}
@@ -1391,932 +3049,5909 @@ func (c *Client) readFcall() (*p9.Fcall, error) {
 	return resp, nil
 }
 
-// --- Socket Logic ---
+// --- Replica Logic ---
 
-// Socket wraps a WebSocket connection.
-type Socket struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
+// Breaker states.
+const (
+	BreakerClosed   = iota // Healthy: requests flow
+	BreakerOpen            // Tripped: requests are refused until the cooldown ends
+	BreakerHalfOpen        // Cooldown over: the next request is a trial
+)
+
+// CircuitBreaker stops a failing replica from being redialed on every request.
+// It trips after MaxRetries consecutive failures and stays open for a cooldown
+// that grows like the Retry backoff (InitialBackoff * Multiplier, up to MaxBackoff).
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	cfg       RetryConfig
+	state     int
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	now       func() time.Time // clock for cooldowns; tests replace it
 }
 
-// Upgrade upgrades the HTTP request to a WebSocket connection.
-func Upgrade(w http.ResponseWriter, r *http.Request) (*Socket, error) {
-	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true, // Allow all origins for now
-	})
-	if err != nil {
-		return nil, err
+// NewCircuitBreaker creates a closed breaker using cfg for thresholds and cooldowns.
+func NewCircuitBreaker(cfg RetryConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		cfg:      cfg,
+		state:    BreakerClosed,
+		cooldown: cfg.InitialBackoff,
+		now:      time.Now,
 	}
-	return &Socket{conn: c}, nil
 }
 
-// Close closes the connection.
-func (s *Socket) Close() error {
-	return s.conn.Close(websocket.StatusNormalClosure, "")
-}
+// Allow reports whether a request may be sent.
+// An open breaker whose cooldown has passed moves to half-open and allows a trial.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-// ReadMsg reads a 9P message from a WebSocket binary frame.
-// Framing: [4-byte size][9P Message]
-func (s *Socket) ReadMsg(ctx context.Context) (*p9.Fcall, error) {
-	_, data, err := s.conn.Read(ctx)
-	if err != nil {
-		return nil, err
+	if b.state == BreakerOpen {
+		if b.now().Before(b.openUntil) {
+			return false
+		}
+		b.state = BreakerHalfOpen
 	}
+	return true
+}
 
-	// Validate size prefix
-	if len(data) < 4 {
-		return nil, fmt.Errorf("frame too short")
-	}
-	size := binary.LittleEndian.Uint32(data[0:4])
-	if uint32(len(data)) != size {
-		return nil, fmt.Errorf("frame size mismatch: header says %d, got %d", size, len(data))
-	}
+// Success closes the breaker and resets the cooldown.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.cooldown = b.cfg.InitialBackoff
+}
 
-	// Unmarshal 9P message (skipping 4 byte size header, p9.Unmarshal expects type at index 0)
-	return p9.Unmarshal(data[4:], size)
+// Failure records a failure, tripping the breaker when the threshold is reached
+// or when a half-open trial fails.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.cfg.MaxRetries {
+		b.state = BreakerOpen
+		b.openUntil = b.now().Add(b.cooldown)
+		b.cooldown = time.Duration(float64(b.cooldown) * b.cfg.Multiplier)
+		if b.cooldown > b.cfg.MaxBackoff {
+			b.cooldown = b.cfg.MaxBackoff
+		}
+	}
 }
 
-// WriteMsg writes a 9P message to a WebSocket binary frame.
-func (s *Socket) WriteMsg(ctx context.Context, f *p9.Fcall) error {
-	buf, err := f.Bytes() // Includes [Size][Type]...
-	if err != nil {
-		return err
+// State returns the breaker state as a word for status files.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "halfopen"
+	default:
+		return "closed"
 	}
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Replica is one address of a replicated mount.
+// Replicas are shared by every session that mounts the same address.
+type Replica struct {
+	Addr    string
+	breaker *CircuitBreaker
+	dialer  Dialer
 
-	// Timeout for writes
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+	mu       sync.Mutex
+	failures int
+	lastErr  string
+	lastOK   time.Time
+	rtt      time.Duration
+}
 
-	return s.conn.Write(ctx, websocket.MessageBinary, buf)
+func (r *Replica) ok(rtt time.Duration) {
+	r.breaker.Success()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastOK = time.Now()
+	if rtt > 0 {
+		r.rtt = rtt
+	}
 }
 
-// --- Proc Logic ---
+func (r *Replica) fail(err error) {
+	r.breaker.Failure()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	r.lastErr = err.Error()
+}
 
-// StartProcFS starts the internal ProcFS 9P service.
-func StartProcFS(addr string) error {
-	s := &ProcServer{
-		listenAddr: addr,
+// String renders the replica as one status line.
+func (r *Replica) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lastOK := int64(0)
+	if !r.lastOK.IsZero() {
+		lastOK = r.lastOK.Unix()
 	}
-	return s.Run()
+	return fmt.Sprintf("%s %s fails=%d rtt=%s ok=%d err=%q\n",
+		r.Addr, r.breaker.State(), r.failures, r.rtt, lastOK, r.lastErr)
 }
 
-type ProcServer struct {
-	listenAddr string
+// HealthMonitor probes every known replica in the background.
+// A probe is a fresh dial plus Tversion; its result feeds the replica's breaker,
+// so a recovered replica closes its breaker before any session needs it.
+type HealthMonitor struct {
+	mu       sync.Mutex
+	replicas map[string]*Replica
+	order    []string
+	interval time.Duration
+	started  bool
+	stop     chan struct{} // closed by Stop
 }
 
-func (s *ProcServer) Run() error {
-	ln, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
-		return err
+// Health tracks the replicas of all replicated mounts.
+var Health = &HealthMonitor{
+	replicas: make(map[string]*Replica),
+	interval: 5 * time.Second,
+}
+
+// Track returns the shared Replica for addr, starting the monitor on first use.
+func (h *HealthMonitor) Track(addr string, d Dialer) *Replica {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r, ok := h.replicas[addr]; ok {
+		return r
+	}
+	r := &Replica{
+		Addr:    addr,
+		breaker: NewCircuitBreaker(DefaultRetryConfig()),
+		dialer:  d,
 	}
-	log.Printf("ProcFS listening on %s", s.listenAddr)
+	h.replicas[addr] = r
+	h.order = append(h.order, addr)
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		go s.handleConn(conn)
+	if !h.started {
+		h.started = true
+		h.stop = make(chan struct{})
+		go h.run(h.stop)
 	}
+	return r
 }
 
-func (s *ProcServer) handleConn(conn net.Conn) {
-	defer conn.Close()
-	fids := make(map[uint32]*PFid)
-	var mu sync.Mutex
+// Stop ends the probes. The next Track starts them again.
+func (h *HealthMonitor) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.started {
+		close(h.stop)
+		h.started = false
+	}
+}
 
+func (h *HealthMonitor) run(stop chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
 	for {
-		req, err := p9.ReadFcall(conn)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("procfs read error: %v", err)
-			}
+		select {
+		case <-ticker.C:
+		case <-stop:
 			return
 		}
+		h.mu.Lock()
+		replicas := make([]*Replica, 0, len(h.order))
+		for _, addr := range h.order {
+			replicas = append(replicas, h.replicas[addr])
+		}
+		h.mu.Unlock()
 
-		resp := &p9.Fcall{Type: req.Type + 1, Tag: req.Tag}
+		for _, r := range replicas {
+			h.probe(r)
+		}
+	}
+}
 
-		switch req.Type {
-		case p9.Tversion:
-			resp.Version = "9P2000"
-			resp.Msize = req.Msize
+func (h *HealthMonitor) probe(r *Replica) {
+	rtt, err := probe(r.dialer, r.Addr)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.ok(rtt)
+}
 
-		case p9.Tattach:
-			mu.Lock()
-			fids[req.Fid] = &PFid{Path: "/"}
-			mu.Unlock()
-			resp.Qid = p9.Qid{Type: p9.QTDIR, Path: 0, Vers: 0}
+// String renders one line per replica, in the order they were first mounted.
+func (h *HealthMonitor) String() string {
+	h.mu.Lock()
+	replicas := make([]*Replica, 0, len(h.order))
+	for _, addr := range h.order {
+		replicas = append(replicas, h.replicas[addr])
+	}
+	h.mu.Unlock()
 
-		case p9.Twalk:
-			mu.Lock()
-			fid, ok := fids[req.Fid]
-			mu.Unlock()
+	var sb strings.Builder
+	for _, r := range replicas {
+		sb.WriteString(r.String())
+	}
+	return sb.String()
+}
 
-			if !ok {
-				resp = rError(req, "fid not found")
-				break
-			}
+// ReplicaSet is the backend of a replicated Client.
+// It keeps one connection to the first healthy replica and moves to the next
+// one when that connection fails. Fids do not survive the move: reads recover
+// through Session.recoverFid, and attaches are retried here directly.
+type ReplicaSet struct {
+	mu       sync.Mutex
+	dialer   Dialer
+	replicas []*Replica
+	active   *Client
+	current  *Replica
+}
 
-			wqid := make([]p9.Qid, 0)
-			currPath := fid.Path
+// DialReplicated connects to the first healthy replica of addrs.
+func DialReplicated(d Dialer, addrs []string) (*Client, error) {
+	rs := &ReplicaSet{dialer: d}
+	for _, addr := range addrs {
+		rs.replicas = append(rs.replicas, Health.Track(addr, d))
+	}
+	if _, _, err := rs.conn(); err != nil {
+		return nil, err
+	}
+	return &Client{
+		addr:  strings.Join(addrs, " "),
+		tag:   1,
+		group: rs,
+	}, nil
+}
 
-			for _, w := range req.Wname {
-				if w == ".." {
-					// Handle parent (naive)
-					if currPath != "/" {
-						// Split and drop last
-						parts := strings.Split(currPath, "/")
-						if len(parts) > 1 {
-							currPath = strings.Join(parts[:len(parts)-1], "/")
-						}
-						if currPath == "" {
-							currPath = "/"
-						}
-					}
-					// Qid logic for parent is tricky without full map.
-					// Root is always 0.
-					wqid = append(wqid, p9.Qid{Type: p9.QTDIR, Path: 0})
-					continue
-				}
+// conn returns the active replica connection, dialing the first healthy replica if needed.
+func (rs *ReplicaSet) conn() (*Client, *Replica, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
 
-				nextPath := currPath
-				if nextPath == "/" {
-					nextPath += w
-				} else {
-					nextPath += "/" + w
-				}
+	if rs.active != nil {
+		return rs.active, rs.current, nil
+	}
 
-				// Resolve Path
-				q, err := resolveProcPath(nextPath)
-				if err != nil {
-					// Stop walk
-					goto endWalk
-				}
-				wqid = append(wqid, q)
-				currPath = nextPath
-			}
-		endWalk:
-			if len(wqid) == len(req.Wname) {
-				mu.Lock()
-				fids[req.Newfid] = &PFid{Path: currPath}
-				mu.Unlock()
-			}
-			resp.Wqid = wqid
+	var errs []string
+	for _, r := range rs.replicas {
+		if !r.breaker.Allow() {
+			errs = append(errs, r.Addr+": circuit_open")
+			continue
+		}
+		start := time.Now()
+		c, err := rs.dialer.Dial(r.Addr)
+		if err != nil {
+			r.fail(err)
+			errs = append(errs, fmt.Sprintf("%s: %v", r.Addr, err))
+			continue
+		}
+		if _, err := c.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+			c.Close()
+			r.fail(err)
+			errs = append(errs, fmt.Sprintf("%s: %v", r.Addr, err))
+			continue
+		}
+		r.ok(time.Since(start))
+		log.Printf("Replica: using %s", r.Addr)
+		rs.active = c
+		rs.current = r
+		return c, r, nil
+	}
+	return nil, nil, fmt.Errorf("no_healthy_replica: %s", strings.Join(errs, "; "))
+}
 
-		case p9.Topen:
-			mu.Lock()
-			fid, ok := fids[req.Fid]
-			mu.Unlock()
-			if !ok {
-				resp = rError(req, "fid not found")
-				break
-			}
-			q, _ := resolveProcPath(fid.Path)
-			resp.Qid = q
-			resp.Iounit = 8192
+// drop discards c if it is still the active connection.
+func (rs *ReplicaSet) drop(c *Client) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.active == c {
+		rs.active = nil
+		rs.current = nil
+	}
+	c.Close()
+}
 
-		case p9.Tread:
-			mu.Lock()
-			fid, ok := fids[req.Fid]
-			mu.Unlock()
-			if !ok {
-				resp = rError(req, "fid not found")
-				break
-			}
-
-			data, err := readProcFile(fid.Path)
-			if err != nil {
-				resp = rError(req, err.Error())
-				break
+// RPCContext sends req to the active replica.
+// A transport error trips that replica and drops its connection. Tversion and
+// Tattach carry no fid state, so they are retried on the next healthy replica.
+func (rs *ReplicaSet) RPCContext(ctx context.Context, req *p9.Fcall) (*p9.Fcall, error) {
+	var lastErr error
+	for range rs.replicas {
+		c, r, err := rs.conn()
+		if err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w (%v)", lastErr, err)
 			}
+			return nil, err
+		}
 
-			// Handle Offset
-			if req.Offset >= uint64(len(data)) {
-				resp.Data = []byte{}
-			} else {
-				end := req.Offset + uint64(req.Count)
-				if end > uint64(len(data)) {
-					end = uint64(len(data))
-				}
-				resp.Data = data[req.Offset:end]
-			}
+		resp, err := c.RPCContext(ctx, req)
+		if err == nil {
+			r.ok(0)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err // Cancelled by the caller, not a replica failure
+		}
 
-		case p9.Tclunk:
-			mu.Lock()
-			delete(fids, req.Fid)
-			mu.Unlock()
-			resp.Type = p9.Rclunk
+		log.Printf("Replica: %s failed: %v", r.Addr, err)
+		r.fail(err)
+		rs.drop(c)
+		lastErr = err
 
-		default:
-			resp = rError(req, "unknown type")
+		if req.Type != p9.Tversion && req.Type != p9.Tattach {
+			break
 		}
+	}
+	return nil, lastErr
+}
 
-		b, _ := resp.Bytes()
-		conn.Write(b)
+// Close closes the active replica connection.
+func (rs *ReplicaSet) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.active == nil {
+		return nil
 	}
+	err := rs.active.Close()
+	rs.active = nil
+	rs.current = nil
+	return err
 }
 
-type PFid struct {
-	Path string
+// --- Services Logic ---
+
+// Service is a backend address that some namespace has mounted, as seen by
+// the Kernel's probes.
+type Service struct {
+	Addr   string
+	id     uint64 // names the service's qid in /dev/sys/services
+	dialer Dialer
+
+	mu      sync.Mutex
+	listed  bool // mounted from a manifest or by adm, so every user sees it
+	probed  bool // whether up means anything yet
+	up      bool
+	lastErr string
+	lastOK  time.Time
+	rtt     time.Duration
+	seen    time.Time // last mounted
 }
 
-func resolveProcPath(path string) (p9.Qid, error) {
-	if path == "/" {
-		return p9.Qid{Type: p9.QTDIR, Path: 0}, nil
+func (svc *Service) result(rtt time.Duration, err error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.probed = true
+	svc.up = err == nil
+	if err != nil {
+		svc.lastErr = err.Error()
+		return
+	}
+	svc.lastOK = time.Now()
+	if rtt > 0 {
+		svc.rtt = rtt
 	}
+}
 
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) == 1 {
-		// /<pid>
-		pid, err := strconv.Atoi(parts[0])
-		if err != nil {
-			return p9.Qid{}, fmt.Errorf("not found")
-		}
-		// Verify existence?
-		if Registry.Get(uint32(pid)) == nil {
-			return p9.Qid{}, fmt.Errorf("pid not found")
+// visible reports whether user may see the service in /dev/sys/services.
+// A user's own mounts may name private addresses, so other users see only
+// listed services.
+func (svc *Service) visible(user string) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.listed || user == "adm"
+}
+
+// String renders the service as one status line. sessions is how many
+// sessions have it mounted. Dial errors can name internal hosts, so only
+// adm is shown err.
+func (svc *Service) String(sessions int, user string) string {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	state := "unknown"
+	if svc.probed {
+		state = "down"
+		if svc.up {
+			state = "up"
 		}
-		return p9.Qid{Type: p9.QTDIR, Path: uint64(pid) << 8}, nil
 	}
+	lastOK := int64(0)
+	if !svc.lastOK.IsZero() {
+		lastOK = svc.lastOK.Unix()
+	}
+	lastErr := svc.lastErr
+	if user != "adm" {
+		lastErr = ""
+	}
+	return fmt.Sprintf("%s %s rtt=%s ok=%d err=%q sessions=%d\n",
+		plan9Addr(svc.Addr), state, svc.rtt, lastOK, lastErr, sessions)
+}
 
-	if len(parts) == 2 {
-		// /<pid>/file
-		pid, err := strconv.Atoi(parts[0])
-		if err != nil || Registry.Get(uint32(pid)) == nil {
-			return p9.Qid{}, fmt.Errorf("pid not found")
-		}
+// ServiceTable tracks every network address mounted from a manifest or
+// /dev/sys/ctl, replicated or not, and probes each one in the background
+// like HealthMonitor. A service no session has mounted for a whole probe
+// interval is forgotten.
+type ServiceTable struct {
+	mu       sync.Mutex
+	services map[string]*Service
+	order    []string
+	nextID   uint64
+	interval time.Duration
+	started  bool
+}
 
-		switch parts[1] {
-		case "status", "ctl", "ns":
-			// Low bits identify file type
-			ftype := uint64(0)
-			if parts[1] == "status" {
-				ftype = 1
-			}
-			if parts[1] == "ctl" {
-				ftype = 2
-			}
-			if parts[1] == "ns" {
-				ftype = 3
-			}
+var Services = &ServiceTable{
+	services: make(map[string]*Service),
+	nextID:   1,
+	interval: 10 * time.Second,
+}
 
-			return p9.Qid{Type: p9.QTFILE, Path: (uint64(pid) << 8) | ftype}, nil
-		}
+// Track notes that addr is being mounted, starting the prober on first use.
+// listed is set for a manifest's or adm's mount. /srv posts and kernel
+// devices are not tracked.
+func (t *ServiceTable) Track(addr string, d Dialer, listed bool) *Service {
+	if strings.HasPrefix(addr, "/srv/") || strings.HasPrefix(addr, "#") {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	svc, ok := t.services[addr]
+	if !ok {
+		svc = &Service{Addr: addr, id: t.nextID, dialer: d}
+		t.nextID++
+		t.services[addr] = svc
+		t.order = append(t.order, addr)
 	}
+	svc.mu.Lock()
+	svc.seen = time.Now()
+	svc.listed = svc.listed || listed
+	svc.mu.Unlock()
+
+	if !t.started {
+		t.started = true
+		go t.run()
+	}
+	return svc
+}
 
-	return p9.Qid{}, fmt.Errorf("not found")
+// Lookup finds a service by the name of its file in /dev/sys/services.
+func (t *ServiceTable) Lookup(name string) *Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.services[convertAddr(name)]
 }
 
-func readProcFile(path string) ([]byte, error) {
-	if path == "/" {
-		// List Session IDs
-		ids := Registry.List()
-		var data []byte
-		for _, id := range ids {
-			d := p9.Dir{
-				Name:  fmt.Sprintf("%d", id),
-				Qid:   p9.Qid{Type: p9.QTDIR, Path: uint64(id) << 8},
-				Mode:  p9.DMDIR | 0755,
-				Atime: uint32(time.Now().Unix()),
-				Mtime: uint32(time.Now().Unix()),
+// List returns the services in the order they were first mounted.
+func (t *ServiceTable) List() []*Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*Service, 0, len(t.order))
+	for _, addr := range t.order {
+		list = append(list, t.services[addr])
+	}
+	return list
+}
+
+func (t *ServiceTable) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, svc := range t.List() {
+			svc.mu.Lock()
+			stale := time.Since(svc.seen) > t.interval
+			svc.mu.Unlock()
+			if stale && mountCount(svc.Addr) == 0 {
+				t.forget(svc.Addr)
+				continue
 			}
-			data = append(data, d.Bytes()...)
+			svc.result(probe(svc.dialer, svc.Addr))
 		}
-		return data, nil
 	}
+}
 
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) == 1 {
-		// Directory listing of /<pid>
-		pid, _ := strconv.Atoi(parts[0]) // Validated by resolve
-		var data []byte
-		// status
-		d1 := p9.Dir{Name: "status", Qid: p9.Qid{Type: p9.QTFILE, Path: (uint64(pid) << 8) | 1}, Mode: 0644}
-		// ctl
-		d2 := p9.Dir{Name: "ctl", Qid: p9.Qid{Type: p9.QTFILE, Path: (uint64(pid) << 8) | 2}, Mode: 0200}
-		// ns
-		d3 := p9.Dir{Name: "ns", Qid: p9.Qid{Type: p9.QTFILE, Path: (uint64(pid) << 8) | 3}, Mode: 0444}
-
-		data = append(data, d1.Bytes()...)
-		data = append(data, d2.Bytes()...)
-		data = append(data, d3.Bytes()...)
-		return data, nil
+func (t *ServiceTable) forget(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.services, addr)
+	for i, a := range t.order {
+		if a == addr {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
 	}
+}
 
-	if len(parts) == 2 {
-		pid, _ := strconv.Atoi(parts[0])
-		sess := Registry.Get(uint32(pid))
-		if sess == nil {
-			return nil, fmt.Errorf("process gone")
+// mountCount is how many sessions have addr mounted.
+func mountCount(addr string) int {
+	n := 0
+	for _, id := range Registry.List() {
+		if s := Registry.Get(id); s != nil && s.namespace().Mounts(addr) {
+			n++
 		}
+	}
+	return n
+}
 
-		switch parts[1] {
-		case "status":
-			return []byte(fmt.Sprintf("%d %s state=running\n", pid, sess.user)), nil
-		case "ns":
-			return []byte(sess.ns.String()), nil // Need to implement String() on ns?
-		case "ctl":
-			return []byte{}, nil
+// probe dials addr and sends Tversion, returning the round trip.
+func probe(d Dialer, addr string) (time.Duration, error) {
+	start := time.Now()
+	client, err := d.Dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	resp, err := client.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	if err == nil && resp.Type == p9.Rerror {
+		err = errors.New(resp.Ename)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// dialMount dials the backend of a mount: replicas if there are several
+// addresses, else one address or /srv post. Every address is tracked in
+// Services, listed if set. The dial is a single address's first result;
+// replicas wait for the prober.
+func dialMount(d Dialer, addrs []string, listed bool) (*Client, error) {
+	svcs := make([]*Service, 0, len(addrs))
+	for _, addr := range addrs {
+		if svc := Services.Track(addr, d, listed); svc != nil {
+			svcs = append(svcs, svc)
 		}
 	}
+	if len(addrs) > 1 {
+		return DialReplicated(d, addrs)
+	}
+	client, err := Srv.Dial(d, addrs[0])
+	for _, svc := range svcs {
+		svc.result(0, err)
+	}
+	return client, err
+}
 
-	return nil, fmt.Errorf("not a file")
+// --- Cache Logic ---
+
+// A mount with -C reads through the Kernel's file cache, as Plan 9's cfs
+// does for a slow file server. File data and stat results are cached by
+// backend, qid.path and qid.vers, so a file whose qid changes is fetched
+// again. Writes through the mount drop what is cached for the file.
+
+// Cache is shared by every -C mount; CACHE_SIZE bounds it in bytes.
+var Cache = NewFileCache(16 << 20)
+
+type cacheKey struct {
+	backend string
+	path    uint64
 }
 
-// --- Sys Logic ---
+type cacheEntry struct {
+	key  cacheKey
+	vers uint32
+	data []byte // file contents from offset 0
+	eof  bool   // data is the whole file
+	stat []byte // from Rstat, or nil
+}
 
-// SysDevice is a special file server for system control (e.g., /dev/sys/ctl).
-type SysDevice struct {
-	ns     *Namespace
-	dialer Dialer
-	mu     sync.Mutex
-	fids   map[uint32]string // Fid -> Path
+// FileCache is an LRU of file contents and stats, bounded in bytes.
+type FileCache struct {
+	mu      sync.Mutex
+	max     int
+	size    int
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	hits    uint64
+	misses  uint64
 }
 
-func NewSysDevice(ns *Namespace, d Dialer) *SysDevice {
-	return &SysDevice{
-		ns:     ns,
-		dialer: d,
-		fids:   make(map[uint32]string),
+func NewFileCache(max int) *FileCache {
+	return &FileCache{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
 	}
 }
 
-// NewSysClient spawns the SysDevice server and returns a connected Client.
-func NewSysClient(ns *Namespace, d Dialer) *Client {
-	c1, c2 := net.Pipe()
-	sys := NewSysDevice(ns, d)
-	go sys.Serve(c2)
-	return &Client{
-		addr: "internal!sys",
-		conn: c1,
-		tag:  1,
+// SetMax changes the bound, evicting as needed.
+func (c *FileCache) SetMax(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+	c.evictLocked()
+}
+
+// cacheable reports whether a file's contents may be cached. Directory reads
+// depend on the fid's position and append-only files change in place.
+func cacheable(q p9.Qid) bool {
+	return q.Type&(p9.QTDIR|p9.QTAPPEND|p9.QTAUTH) == 0
+}
+
+// Read returns count bytes at offset, if they are cached for key at vers.
+func (c *FileCache) Read(key cacheKey, vers uint32, offset uint64, count uint32) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.getLocked(key, vers); e != nil && (e.eof || offset+uint64(count) <= uint64(len(e.data))) {
+		c.hits++
+		return readAt(e.data, offset, count), true
 	}
+	c.misses++
+	return nil, false
 }
 
-func (sys *SysDevice) Serve(conn net.Conn) {
-	defer conn.Close()
-	for {
-		req, err := p9.ReadFcall(conn)
-		if err != nil {
-			return
+// Fill records data read at offset. Only reads that extend the cached prefix
+// of the file are kept; an empty read at its end marks the end of the file.
+func (c *FileCache) Fill(key cacheKey, vers uint32, offset uint64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entryLocked(key, vers)
+	n := uint64(len(e.data))
+	switch {
+	case len(data) == 0:
+		if offset == n {
+			e.eof = true
 		}
-		resp := sys.handle(req)
-		resp.Tag = req.Tag
-		b, _ := resp.Bytes()
-		conn.Write(b)
+	case offset <= n && offset+uint64(len(data)) > n:
+		tail := data[n-offset:]
+		e.data = append(e.data, tail...)
+		c.size += len(tail)
 	}
+	c.evictLocked()
 }
 
-// file IDs
-const (
-	QidRoot = 0
-	QidCtl  = 1
-)
+// Stat returns the cached Rstat for key at vers.
+func (c *FileCache) Stat(key cacheKey, vers uint32) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.getLocked(key, vers); e != nil && e.stat != nil {
+		c.hits++
+		return e.stat, true
+	}
+	c.misses++
+	return nil, false
+}
 
-func (sys *SysDevice) handle(req *p9.Fcall) *p9.Fcall {
-	resp := &p9.Fcall{Type: req.Type + 1}
-	sys.mu.Lock()
-	defer sys.mu.Unlock()
+// FillStat records the Rstat for key at vers.
+func (c *FileCache) FillStat(key cacheKey, vers uint32, stat []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entryLocked(key, vers)
+	c.size += len(stat) - len(e.stat)
+	e.stat = stat
+	c.evictLocked()
+}
 
-	switch req.Type {
-	case p9.Tversion:
-		resp.Msize = req.Msize
-		resp.Version = "9P2000"
+// Invalidate drops everything cached for key.
+func (c *FileCache) Invalidate(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
 
-	case p9.Tattach:
-		sys.fids[req.Fid] = "/"
-		resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 1, Path: QidRoot}
+// getLocked returns the entry for key if it is at vers. An entry at another
+// version is stale and dropped.
+func (c *FileCache) getLocked(key cacheKey, vers uint32) *cacheEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if e.vers != vers {
+		c.removeLocked(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
 
-	case p9.Twalk:
-		path, ok := sys.fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
-		}
+// entryLocked returns the entry for key at vers, creating it if needed.
+func (c *FileCache) entryLocked(key cacheKey, vers uint32) *cacheEntry {
+	if e := c.getLocked(key, vers); e != nil {
+		return e
+	}
+	e := &cacheEntry{key: key, vers: vers}
+	c.entries[key] = c.lru.PushFront(e)
+	return e
+}
 
-		wqids := []p9.Qid{}
-		newPath := path
+func (c *FileCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.size -= len(e.data) + len(e.stat)
+	delete(c.entries, e.key)
+	c.lru.Remove(el)
+}
 
-		if len(req.Wname) == 0 {
-			sys.fids[req.Newfid] = path
-		} else if len(req.Wname) == 1 && req.Wname[0] == "ctl" && path == "/" {
-			newPath = "/ctl"
-			wqids = append(wqids, p9.Qid{Type: p9.QTFILE, Vers: 1, Path: QidCtl})
-			sys.fids[req.Newfid] = newPath
-		} else {
-			return rError(req, "not found")
-		}
-		resp.Wqid = wqids
+func (c *FileCache) evictLocked() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
 
-	case p9.Topen:
-		path, ok := sys.fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+// String reports usage: bytes=<n>/<max> files=<n> hits=<n> misses=<n>
+func (c *FileCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("bytes=%d/%d files=%d hits=%d misses=%d", c.size, c.max, c.lru.Len(), c.hits, c.misses)
+}
+
+// CacheView is the Client of a mount with -C. It remembers the qid behind
+// each fid so that reads and stats can be answered from Cache.
+type CacheView struct {
+	conn *Client
+	mu   sync.Mutex
+	qids map[uint32]p9.Qid // fid -> qid, from Ropen once the fid is open
+}
+
+// NewCachedClient returns a Client that caches conn's files.
+func NewCachedClient(conn *Client) *Client {
+	return &Client{
+		addr:  conn.addr,
+		cache: &CacheView{conn: conn, qids: make(map[uint32]p9.Qid)},
+	}
+}
+
+func (v *CacheView) qid(fid uint32) (p9.Qid, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	q, ok := v.qids[fid]
+	return q, ok
+}
+
+func (v *CacheView) set(fid uint32, q p9.Qid) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.qids[fid] = q
+}
+
+func (v *CacheView) forget(fid uint32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.qids, fid)
+}
+
+// RPCContext answers Tread and Tstat from Cache when it can and forwards
+// everything else, tracking qids and invalidating on writes.
+func (v *CacheView) RPCContext(ctx context.Context, req *p9.Fcall) (*p9.Fcall, error) {
+	qid, known := v.qid(req.Fid)
+	key := cacheKey{backend: v.conn.addr, path: qid.Path}
+
+	switch {
+	case req.Type == p9.Tread && known && cacheable(qid):
+		if data, ok := Cache.Read(key, qid.Vers, req.Offset, req.Count); ok {
+			return &p9.Fcall{Type: p9.Rread, Tag: req.Tag, Data: data}, nil
 		}
-		if path == "/" {
-			resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 1, Path: QidRoot}
-		} else {
-			resp.Qid = p9.Qid{Type: p9.QTFILE, Vers: 1, Path: QidCtl}
+	case req.Type == p9.Tstat && known && qid.Type&p9.QTAUTH == 0:
+		if stat, ok := Cache.Stat(key, qid.Vers); ok {
+			return &p9.Fcall{Type: p9.Rstat, Tag: req.Tag, Stat: stat}, nil
 		}
-		resp.Iounit = 0 // use msize
+	}
 
-	case p9.Tread:
-		path, ok := sys.fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
-		}
-		if path == "/" {
-			// Dir Read (just ctl)
-			dir := p9.Dir{
-				Qid:    p9.Qid{Type: p9.QTFILE, Path: QidCtl},
-				Mode:   0666,
-				Name:   "ctl",
-				Length: 0,
-				Uid:    "sys", Gid: "sys", Muid: "sys",
-				Atime: uint32(time.Now().Unix()),
-				Mtime: uint32(time.Now().Unix()),
-			}
-			b := dir.Bytes()
-			if req.Offset == 0 && req.Count >= uint32(len(b)) {
-				resp.Data = b
-			} else {
-				resp.Data = []byte{}
-			}
-		} else {
-			// Read ctl - empty?
-			resp.Data = []byte{}
+	resp, err := v.conn.RPCContext(ctx, req)
+	switch req.Type {
+	case p9.Tclunk, p9.Tremove:
+		v.forget(req.Fid)
+		if req.Type == p9.Tremove && known {
+			Cache.Invalidate(key)
 		}
+		return resp, err
+	}
+	if err != nil || resp.Type == p9.Rerror {
+		return resp, err
+	}
 
-	case p9.Twrite:
-		path, ok := sys.fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+	switch req.Type {
+	case p9.Tattach:
+		v.set(req.Fid, resp.Qid)
+	case p9.Twalk:
+		switch {
+		case len(resp.Wqid) < len(req.Wname):
+			// Partial walk: newfid was not created
+		case len(req.Wname) > 0:
+			v.set(req.Newfid, resp.Wqid[len(resp.Wqid)-1])
+		case known:
+			v.set(req.Newfid, qid)
 		}
-		if path != "/ctl" {
-			return rError(req, "permission denied")
+	case p9.Topen, p9.Tcreate:
+		if known && (req.Type == p9.Tcreate || req.Mode&p9.OTRUNC != 0) {
+			Cache.Invalidate(key) // The directory gained an entry, or the file was truncated
 		}
-
-		// Execute Command
-		cmd := string(req.Data)
-		if err := sys.execute(cmd); err != nil {
-			return rError(req, err.Error())
+		v.set(req.Fid, resp.Qid)
+	case p9.Tread:
+		if known && cacheable(qid) {
+			Cache.Fill(key, qid.Vers, req.Offset, resp.Data)
 		}
-		resp.Count = req.Count
+	case p9.Tstat:
+		if known && qid.Type&p9.QTAUTH == 0 {
+			Cache.FillStat(key, qid.Vers, resp.Stat)
+		}
+	case p9.Twrite, p9.Twstat:
+		// The fid's qid is stale now; it bypasses the cache from here on
+		if known {
+			Cache.Invalidate(key)
+		}
+		v.forget(req.Fid)
+	}
+	return resp, err
+}
 
-	case p9.Tclunk:
-		delete(sys.fids, req.Fid)
-		resp.Type = p9.Rclunk
+// Close hangs up the cached connection. What it cached stays in Cache.
+func (v *CacheView) Close() error {
+	return v.conn.Close()
+}
 
-	case p9.Tstat:
-		resp.Stat = make([]byte, 0)
+// --- Metrics Logic ---
+
+// latencyBuckets are the upper bounds of the RPC latency histogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
 
-	default:
-		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
-	}
-	return resp
+// Histogram counts RPCs to one backend by latency.
+type Histogram struct {
+	counts []uint64 // per bucket; the last counts everything slower
+	sum    time.Duration
+	n      uint64
+	errors uint64
 }
 
-func (sys *SysDevice) execute(cmd string) error {
-	parts := strings.Fields(cmd)
-	if len(parts) == 0 {
-		return nil
+func (h *Histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.sum += d
+	h.n++
+}
+
+// Metrics aggregates counters for the whole Kernel.
+// Session.dispatch counts ops and errors; Client.RPCContext times backends.
+type Metrics struct {
+	mu         sync.Mutex
+	ops        map[string]uint64 // Tmsg -> count
+	errors     map[string]uint64 // error class (see errorClass) -> count
+	backends   map[string]*Histogram
+	rx, tx     atomic.Uint64 // bytes relayed to and from clients
+	recoveries atomic.Uint64 // stale fids recovered
+}
+
+var Stats = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:      make(map[string]uint64),
+		errors:   make(map[string]uint64),
+		backends: make(map[string]*Histogram),
 	}
+}
 
-	switch parts[0] {
-	case "mount":
-		// mount <addr> <path> [flags]
-		// e.g. mount tcp!localhost:9999 /ext -c
-		if len(parts) < 3 {
-			return fmt.Errorf("usage: mount <addr> <path> [flags]")
-		}
-		addr := convertAddr(parts[1])
-		path := parts[2]
-		flags, _ := parseFlags(parts[3:])
+// Op counts a handled request and, if it failed, its error.
+func (m *Metrics) Op(t uint8, resp *p9.Fcall) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops[p9.TypeName(t)]++
+	if resp.Type == p9.Rerror {
+		m.errors[errorClass(resp.Ename)]++
+	}
+}
 
-		client, err := sys.dialer.Dial(addr)
-		if err != nil {
-			return err
+// errorClasses are the classes errors are counted in, each with the ename
+// fragments that put an error in it. The first match wins.
+var errorClasses = []struct {
+	class     string
+	fragments []string
+}{
+	{"interrupted", []string{"interrupted"}},
+	{"shutting_down", []string{"kernel_shutting_down"}},
+	{"limited", []string{"rate_limited", "too_many_"}},
+	{"fid", []string{"fid_", "fid "}},
+	{"auth", []string{"auth", "signature", "ticket_", "resume_", "unknown_peer"}},
+	{"backend", []string{"_error", "_failed", "unavailable", "no_healthy_replica", "connection", "hung up"}},
+	{"permission", []string{"permission denied"}},
+	{"not_found", []string{"not found", "not_found", "does not exist", "no such file"}},
+	{"exists", []string{"exists"}},
+	{"full", []string{"file system full", "no space"}},
+	{"bad_request", []string{"invalid", "unknown", "unexpected", "bad ", "not a directory", "is a directory", "not open", "not empty", "cannot", "empty"}},
+}
+
+// errorClass maps ename to one of errorClasses, or "other". Enames carry
+// names and paths, which must not become metric labels.
+func errorClass(ename string) string {
+	ename = strings.ToLower(ename)
+	for _, c := range errorClasses {
+		for _, f := range c.fragments {
+			if strings.Contains(ename, f) {
+				return c.class
+			}
 		}
+	}
+	return "other"
+}
 
-		// Attempt Attach? Usually mount implies Attach.
-		// Standard Plan 9 mount does: dial -> ssl -> auth -> attach.
-		// Here we do dial -> attach.
-		// Tattach(root)
-		// We can't attach here easily because Client.Attach is not exposed nicely,
-		// but Client assumes attached?
-		// No, `Dial` methods returns a Client, but that client is just a connection wrapper.
-		// We need to perform Tver/Tattach.
+// RPC records one backend round trip.
+func (m *Metrics) RPC(addr string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.backends[addr]
+	if !ok {
+		h = &Histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.backends[addr] = h
+	}
+	if err != nil {
+		h.errors++
+		return
+	}
+	h.observe(d)
+}
 
-		// Perform Handshake
-		if _, err := client.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
-			client.Close()
-			return err
+// active counts live sessions and their fids.
+func (m *Metrics) active() (sessions, fids int) {
+	Registry.mu.RLock()
+	defer Registry.mu.RUnlock()
+	for _, s := range Registry.sessions {
+		s.mu.Lock()
+		fids += len(s.fids)
+		s.mu.Unlock()
+	}
+	return len(Registry.sessions), fids
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String is the content of /dev/sys/stats.
+func (m *Metrics) String() string {
+	sessions, fids := m.active()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "sessions %d\n", sessions)
+	fmt.Fprintf(&sb, "fids %d\n", fids)
+	fmt.Fprintf(&sb, "rx %d\n", m.rx.Load())
+	fmt.Fprintf(&sb, "tx %d\n", m.tx.Load())
+	fmt.Fprintf(&sb, "recoveries %d\n", m.recoveries.Load())
+	fmt.Fprintf(&sb, "cache %s\n", Cache)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range sortedKeys(m.ops) {
+		fmt.Fprintf(&sb, "op %s %d\n", op, m.ops[op])
+	}
+	for _, e := range sortedKeys(m.errors) {
+		fmt.Fprintf(&sb, "error %q %d\n", e, m.errors[e])
+	}
+	for _, addr := range sortedKeys(m.backends) {
+		h := m.backends[addr]
+		fmt.Fprintf(&sb, "backend %s n=%d errors=%d sum=%s", plan9Addr(addr), h.n, h.errors, h.sum)
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(&sb, " %s=%d", le, h.counts[i])
 		}
-		if _, err := client.RPC(&p9.Fcall{Type: p9.Tattach, Fid: 0, Uname: "user", Aname: "/"}); err != nil {
-			client.Close()
-			return err
+		fmt.Fprintf(&sb, " inf=%d\n", h.counts[len(latencyBuckets)])
+	}
+	return sb.String()
+}
+
+// Prometheus renders the metrics in the Prometheus text exposition format.
+func (m *Metrics) Prometheus() string {
+	sessions, fids := m.active()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# TYPE ten_sessions gauge\nten_sessions %d\n", sessions)
+	fmt.Fprintf(&sb, "# TYPE ten_fids gauge\nten_fids %d\n", fids)
+	fmt.Fprintf(&sb, "# TYPE ten_bytes_total counter\nten_bytes_total{dir=\"rx\"} %d\nten_bytes_total{dir=\"tx\"} %d\n", m.rx.Load(), m.tx.Load())
+	fmt.Fprintf(&sb, "# TYPE ten_recoveries_total counter\nten_recoveries_total %d\n", m.recoveries.Load())
+	Cache.mu.Lock()
+	fmt.Fprintf(&sb, "# TYPE ten_cache_bytes gauge\nten_cache_bytes %d\n", Cache.size)
+	fmt.Fprintf(&sb, "# TYPE ten_cache_requests_total counter\nten_cache_requests_total{result=\"hit\"} %d\nten_cache_requests_total{result=\"miss\"} %d\n", Cache.hits, Cache.misses)
+	Cache.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sb.WriteString("# TYPE ten_ops_total counter\n")
+	for _, op := range sortedKeys(m.ops) {
+		fmt.Fprintf(&sb, "ten_ops_total{op=%q} %d\n", op, m.ops[op])
+	}
+	sb.WriteString("# TYPE ten_errors_total counter\n")
+	for _, e := range sortedKeys(m.errors) {
+		fmt.Fprintf(&sb, "ten_errors_total{class=%q} %d\n", e, m.errors[e])
+	}
+	sb.WriteString("# TYPE ten_backend_errors_total counter\n")
+	for _, addr := range sortedKeys(m.backends) {
+		fmt.Fprintf(&sb, "ten_backend_errors_total{backend=%q} %d\n", addr, m.backends[addr].errors)
+	}
+	sb.WriteString("# TYPE ten_backend_rpc_seconds histogram\n")
+	for _, addr := range sortedKeys(m.backends) {
+		h := m.backends[addr]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(&sb, "ten_backend_rpc_seconds_bucket{backend=%q,le=\"%g\"} %d\n", addr, le.Seconds(), cum)
 		}
-		// Now Fid 0 is Root.
-		// Wait, Client struct handles tag, but FID management is up to caller usually?
-		// No, Client struct is very thin.
-		// Namespace expects Client to be ready to accept Walks from Fid 0?
-		// Let's check kernel/session.go logic or Client.
+		fmt.Fprintf(&sb, "ten_backend_rpc_seconds_bucket{backend=%q,le=\"+Inf\"} %d\n", addr, h.n)
+		fmt.Fprintf(&sb, "ten_backend_rpc_seconds_sum{backend=%q} %g\n", addr, h.sum.Seconds())
+		fmt.Fprintf(&sb, "ten_backend_rpc_seconds_count{backend=%q} %d\n", addr, h.n)
+	}
+	return sb.String()
+}
 
-		sys.ns.Mount(path, client, flags)
-		log.Printf("Sys: Mounted %s at %s (flags=%d)", addr, path, flags)
-		return nil
+// --- Limits Logic ---
+
+// LimitsPath holds the Kernel's rate limits and quotas, one rule per line:
+//
+//	<user>|* [ops=<n>] [bytes=<n>] [userops=<n>] [userbytes=<n>] [fids=<n>] [sessions=<n>]
+//
+// ops and bytes are per-second rates for each session, userops and userbytes
+// the same across all of a user's sessions. fids caps a session's fids and
+// sessions a user's concurrent sessions. A user's rule overrides * key by key;
+// 0 or a missing key means no limit. Lines starting with # are comments.
+const LimitsPath = "/adm/limits"
+
+// Limits is the policy for one user.
+type Limits struct {
+	Ops, Bytes         float64 // per session, per second
+	UserOps, UserBytes float64 // per user, per second
+	Fids               int     // per session
+	Sessions           int     // per user
+}
 
-	case "bind":
-		// bind <old> <new> [flags]
-		// e.g. bind /data /alias -b
-		if len(parts) < 3 {
-			return fmt.Errorf("usage: bind <old> <new> [flags]")
+// ParseLimits parses the content of LimitsPath.
+func ParseLimits(data string) (map[string]Limits, error) {
+	rules := make(map[string]Limits)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
 		}
-		oldPath := parts[1]
-		newPath := parts[2]
-		flags, _ := parseFlags(parts[3:])
-
-		if err := sys.ns.Bind(oldPath, newPath, flags); err != nil {
-			return err
+		lim := rules[fields[0]]
+		for _, f := range fields[1:] {
+			k, v, ok := strings.Cut(f, "=")
+			n, err := strconv.ParseUint(v, 10, 63)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("bad limit %q for %s", f, fields[0])
+			}
+			switch k {
+			case "ops":
+				lim.Ops = float64(n)
+			case "bytes":
+				lim.Bytes = float64(n)
+			case "userops":
+				lim.UserOps = float64(n)
+			case "userbytes":
+				lim.UserBytes = float64(n)
+			case "fids":
+				lim.Fids = int(n)
+			case "sessions":
+				lim.Sessions = int(n)
+			default:
+				return nil, fmt.Errorf("unknown limit %q for %s", k, fields[0])
+			}
 		}
-		log.Printf("Sys: Bound %s to %s (flags=%d)", oldPath, newPath, flags)
-		return nil
+		rules[fields[0]] = lim
+	}
+	return rules, nil
+}
 
-	default:
-		return fmt.Errorf("unknown command: %s", parts[0])
+// limitString formats a cap, "-" meaning none.
+func limitString(n int) string {
+	if n <= 0 {
+		return "-"
 	}
+	return strconv.Itoa(n)
 }
 
-// --- Env Logic ---
+// Bucket is a token bucket refilled at rate tokens per second and holding
+// at most one second's worth. A zero rate never runs dry.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
 
-const (
-	ORCLOSE = 0x40
-	OTRUNC  = 0x10
-)
+// SetRate changes the refill rate, keeping the tokens already earned.
+func (b *Bucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate == b.rate {
+		return
+	}
+	if b.rate == 0 || b.tokens > rate {
+		b.tokens = rate
+	}
+	b.rate = rate
+	b.last = time.Now()
+}
 
-// EnvFS provides a read/write interface to environment variables.
-type EnvFS struct {
-	vars map[string]string // Variable Name -> Value
-	mu   sync.Mutex
+// Take removes n tokens if the bucket holds them. A request for more than
+// the bucket can hold needs a full bucket.
+func (b *Bucket) Take(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	n = min(n, b.rate)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
 }
 
-func NewEnvFS() *EnvFS {
-	return &EnvFS{
-		vars: make(map[string]string),
+// String is "<tokens>/<rate>", or "-" without a limit.
+func (b *Bucket) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return "-"
 	}
+	tokens := min(b.rate, b.tokens+time.Since(b.last).Seconds()*b.rate)
+	return fmt.Sprintf("%.0f/%.0f", tokens, b.rate)
 }
 
-// NewEnvClient creates a client connection to a new EnvFS instance.
-func NewEnvClient() *Client {
-	c1, c2 := net.Pipe()
-	fs := NewEnvFS()
+// Limiter holds the policy from LimitsPath and each user's usage of it.
+type Limiter struct {
+	mu    sync.Mutex
+	rules map[string]Limits
+	users map[string]*userUsage
+}
 
-	// Default variables
-	fs.vars["user"] = "glenda" // Default, can be overwritten
+type userUsage struct {
+	sessions int
+	ops      Bucket
+	bytes    Bucket
+}
 
-	go fs.Serve(c2)
+// Quotas is the Kernel's limiter. Without rules nothing is limited.
+var Quotas = NewLimiter()
 
-	return &Client{
-		addr: "internal!env",
-		conn: c1,
-		tag:  1,
+func NewLimiter() *Limiter {
+	return &Limiter{
+		rules: make(map[string]Limits),
+		users: make(map[string]*userUsage),
 	}
 }
 
-func (fs *EnvFS) Serve(conn net.Conn) {
-	defer conn.Close()
-	// Track open FIDs
-	fids := make(map[uint32]*envFid)
+// Set replaces the policy.
+func (l *Limiter) Set(rules map[string]Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = rules
+}
 
-	for {
-		req, err := p9.ReadFcall(conn)
-		if err != nil {
-			return
+// For returns the limits that apply to user.
+func (l *Limiter) For(user string) Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.forLocked(user)
+}
+
+func (l *Limiter) forLocked(user string) Limits {
+	lim := l.rules["*"]
+	if r, ok := l.rules[user]; ok {
+		if r.Ops != 0 {
+			lim.Ops = r.Ops
+		}
+		if r.Bytes != 0 {
+			lim.Bytes = r.Bytes
+		}
+		if r.UserOps != 0 {
+			lim.UserOps = r.UserOps
+		}
+		if r.UserBytes != 0 {
+			lim.UserBytes = r.UserBytes
+		}
+		if r.Fids != 0 {
+			lim.Fids = r.Fids
+		}
+		if r.Sessions != 0 {
+			lim.Sessions = r.Sessions
 		}
+	}
+	return lim
+}
 
-		resp := fs.handle(req, fids)
-		resp.Tag = req.Tag
+func (l *Limiter) usageLocked(user string) *userUsage {
+	u, ok := l.users[user]
+	if !ok {
+		u = &userUsage{}
+		l.users[user] = u
+	}
+	return u
+}
 
-		b, _ := resp.Bytes()
-		conn.Write(b)
+// Admit counts a new session for user under key (see Session.quotaKey),
+// failing if the key is at user's quota.
+func (l *Limiter) Admit(user, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usageLocked(key)
+	if quota := l.forLocked(user).Sessions; quota > 0 && u.sessions >= quota {
+		return fmt.Errorf("too_many_sessions")
 	}
+	u.sessions++
+	return nil
 }
 
-type envFid struct {
-	path   string // "/" or "/VARNAME"
-	isOpen bool
-	mode   uint8
+// Leave uncounts a session admitted under key.
+func (l *Limiter) Leave(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if u, ok := l.users[key]; ok {
+		if u.sessions--; u.sessions <= 0 {
+			delete(l.users, key)
+		}
+	}
 }
 
-func (fs *EnvFS) handle(req *p9.Fcall, fids map[uint32]*envFid) *p9.Fcall {
-	resp := &p9.Fcall{Type: req.Type + 1}
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+// Sessions is "<count>/<max>" for user's sessions under key.
+func (l *Limiter) Sessions(user, key string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	if u, ok := l.users[key]; ok {
+		n = u.sessions
+	}
+	return fmt.Sprintf("%d/%s", n, limitString(l.forLocked(user).Sessions))
+}
 
-	switch req.Type {
-	case p9.Tversion:
-		resp.Msize = req.Msize
-		resp.Version = "9P2000"
+// Charge takes ops and bytes from the buckets shared under key.
+func (l *Limiter) Charge(key string, lim Limits, ops, bytes float64) bool {
+	l.mu.Lock()
+	u := l.usageLocked(key)
+	l.mu.Unlock()
+	u.ops.SetRate(lim.UserOps)
+	u.bytes.SetRate(lim.UserBytes)
+	return u.ops.Take(ops) && u.bytes.Take(bytes)
+}
 
-	case p9.Tattach:
-		fids[req.Fid] = &envFid{path: "/"}
-		resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
+// quotaKey is what user's sessions on this connection are counted under:
+// the user, except that anonymous sessions are counted per remote host so
+// that one client cannot use up everyone's "none" quota. User names never
+// contain a space.
+func (s *Session) quotaKey(user string) string {
+	if user != "none" {
+		return user
+	}
+	_, remote, _ := strings.Cut(s.transport, "!")
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return "none " + remote
+}
 
-	case p9.Twalk:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+// admit counts the session against user's session quota, moving it off the
+// user it was attached as before.
+func (s *Session) admit(user string) error {
+	key := s.quotaKey(user)
+	s.mu.Lock()
+	prev := s.admitted
+	s.mu.Unlock()
+	if prev == key {
+		return nil
+	}
+	if err := Quotas.Admit(user, key); err != nil {
+		s.limited.Add(1)
+		return err
+	}
+	if prev != "" {
+		Quotas.Leave(prev)
+	}
+	s.mu.Lock()
+	s.admitted = key
+	s.mu.Unlock()
+	return nil
+}
+
+// limit charges req to the session's and its user's limits and returns the
+// error to refuse it with, or "" to let it through. Tversion, Tflush and
+// Tclunk are never refused. Reads are charged the bytes they ask for.
+func (s *Session) limit(req *p9.Fcall) string {
+	switch req.Type {
+	case p9.Tversion, p9.Tflush, p9.Tclunk:
+		return ""
+	}
+	user := s.uname()
+	lim := Quotas.For(user)
+
+	if lim.Fids > 0 && (req.Type == p9.Twalk && req.Newfid != req.Fid || req.Type == p9.Tattach) {
+		s.mu.Lock()
+		_, reused := s.fids[req.Newfid]
+		if req.Type == p9.Tattach {
+			_, reused = s.fids[req.Fid]
 		}
+		full := !reused && len(s.fids) >= lim.Fids
+		s.mu.Unlock()
+		if full {
+			s.limited.Add(1)
+			return "too_many_fids"
+		}
+	}
 
-		wqids := []p9.Qid{}
-		currPath := fid.path
+	n := float64(len(req.Data))
+	if req.Type == p9.Tread {
+		n = float64(req.Count)
+	}
+	s.opsRate.SetRate(lim.Ops)
+	s.bytesRate.SetRate(lim.Bytes)
+	if !s.opsRate.Take(1) || !s.bytesRate.Take(n) || !Quotas.Charge(s.quotaKey(user), lim, 1, n) {
+		s.limited.Add(1)
+		return "rate_limited"
+	}
+	return ""
+}
 
-		for _, name := range req.Wname {
-			if name == ".." {
-				currPath = "/"
-				wqids = append(wqids, p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0})
-				continue
+// WatchLimits reloads LimitsPath from VFS every interval. A missing file
+// means no limits; a malformed one, or one not owned by adm, keeps the
+// previous policy.
+func WatchLimits(vfsAddr string, d Dialer, host *HostIdentity, interval time.Duration) {
+	var last string
+	for {
+		data, err := readOwnedFile(vfsAddr, d, host, LimitsPath, 0, "adm")
+		if err != nil {
+			log.Printf("Limits: poll failed: %v", err)
+		} else if data != last {
+			if rules, err := ParseLimits(data); err != nil {
+				log.Printf("Limits: %v", err)
+			} else {
+				Quotas.Set(rules)
+				last = data
+				log.Printf("Limits: loaded %d rules", len(rules))
 			}
+		}
+		time.Sleep(interval)
+	}
+}
 
-			// Only 1 level deep
-			if currPath != "/" {
-				return rError(req, "not found")
-			}
+// --- Audit Logic ---
 
-			// Variable exists?
-			if _, exists := fs.vars[name]; exists {
-				// It exists
-				wqids = append(wqids, p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)})
-				currPath = "/" + name
-			} else {
-				// We allow walking to non-existent if we are going to create it?
-				// No, 9P Walk fails if not found.
-				// But Tcreate requires walking to parent first.
-				// Wait, to Create /env/foo, we Walk to /env (which we are at), then Tcreate "foo".
-				// So we don't need to Walk to "foo" unless it exists.
-				return rError(req, "not found")
-			}
+// AuditLog records security-relevant operations as key=value lines in an
+// append-only (DMAPPEND) file per day in VFS: <dir>/<YYYY-MM-DD>.
+// Records are queued and written by one goroutine so sessions never wait
+// on VFS; if VFS is unreachable they go to the Kernel log instead.
+type AuditLog struct {
+	vfsAddr string
+	dir     string // e.g. /sys/log/audit
+	dialer  Dialer
+	host    *HostIdentity
+	queue   chan string
+	flush   chan chan struct{}
+
+	client *Client // connection to VFS, owned by run
+	day    string  // date of the open file
+	fid    uint32  // open file on client
+}
+
+// Audit is the Kernel's audit log. A nil Audit records to the Kernel log only.
+var Audit *AuditLog
+
+func NewAuditLog(vfsAddr, dir string, d Dialer, host *HostIdentity) *AuditLog {
+	a := &AuditLog{
+		vfsAddr: vfsAddr,
+		dir:     dir,
+		dialer:  d,
+		host:    host,
+		queue:   make(chan string, 1024),
+		flush:   make(chan chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Record queues one audit line: time=<rfc3339> event=<event> k=v ...
+// Values containing spaces, quotes or '=' are quoted.
+func (a *AuditLog) Record(event string, kv ...string) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "time=%s event=%s", time.Now().UTC().Format(time.RFC3339), event)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := kv[i+1]
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
 		}
+		fmt.Fprintf(&sb, " %s=%s", kv[i], v)
+	}
+	line := sb.String() + "\n"
 
-		if len(wqids) == len(req.Wname) {
-			fids[req.Newfid] = &envFid{path: currPath}
-			resp.Wqid = wqids
-		} else {
-			// Partial walk?
-			// Since we checked existence, this logic implies complete success or immediate fail.
+	if a == nil {
+		log.Printf("AUDIT %s", strings.TrimSpace(line))
+		return
+	}
+	select {
+	case a.queue <- line:
+	default:
+		log.Printf("AUDIT (queue full) %s", strings.TrimSpace(line))
+	}
+}
+
+// Flush waits until the records queued so far are written, or ctx is done.
+func (a *AuditLog) Flush(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case a.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (a *AuditLog) run() {
+	for {
+		select {
+		case line := <-a.queue:
+			a.append(line)
+		case done := <-a.flush:
+			for len(a.queue) > 0 {
+				a.append(<-a.queue)
+			}
+			close(done)
 		}
+	}
+}
 
-	case p9.Topen:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+// append writes line, falling back to the Kernel log on failure.
+func (a *AuditLog) append(line string) {
+	if err := a.write(line); err != nil {
+		log.Printf("Audit: write failed: %v", err)
+		log.Printf("AUDIT %s", strings.TrimSpace(line))
+		if a.client != nil {
+			a.client.Close()
+			a.client = nil
 		}
+	}
+}
 
-		if fid.path == "/" {
-			if req.Mode&3 != 0 && req.Mode&3 != 3 { // OREAD or OEXEC only
-				return rError(req, "permission denied")
-			}
-			resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
-		} else {
-			// File
-			name := fid.path[1:]
-			if _, exists := fs.vars[name]; !exists {
-				// It might have been deleted?
-				return rError(req, "not found")
-			}
-			if req.Mode&ORCLOSE != 0 {
-				// ORCLOSE not supported on root, handled in remove?
-				// Standard says remove on clunk if ORCLOSE.
-				// Ignoring for MVP simple env.
-			}
-			if req.Mode&OTRUNC != 0 {
-				fs.vars[name] = ""
-			}
-			resp.Qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
+// write appends line to today's file, (re)connecting and rotating as needed.
+func (a *AuditLog) write(line string) error {
+	day := time.Now().UTC().Format("2006-01-02")
+	if a.client == nil || a.day != day {
+		if err := a.open(day); err != nil {
+			return err
 		}
-		fid.isOpen = true
-		fid.mode = req.Mode
-		resp.Iounit = 8192
+	}
+	resp, err := a.client.RPC(&p9.Fcall{Type: p9.Twrite, Fid: a.fid, Data: []byte(line), Count: uint32(len(line))})
+	if err != nil {
+		return err
+	}
+	if resp.Type == p9.Rerror {
+		return fmt.Errorf("9p_error: %s", resp.Ename)
+	}
+	return nil
+}
 
-	case p9.Tcreate:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+// open attaches to VFS as the kernel and opens <dir>/<day> for append,
+// creating the directories and the file (DMAPPEND) if needed.
+func (a *AuditLog) open(day string) error {
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := a.client.RPC(req)
+		if err != nil {
+			return nil, err
 		}
-		if fid.path != "/" {
-			return rError(req, "not a directory")
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
 		}
+		return resp, nil
+	}
 
-		// Create variable
-		name := req.Name
-		if name == "" || name == "." || name == ".." {
-			return rError(req, "invalid name")
+	if a.client == nil {
+		client, err := a.dialer.Dial(a.vfsAddr)
+		if err != nil {
+			return fmt.Errorf("dial_vfs_failed: %w", err)
 		}
-		fs.vars[name] = ""
+		a.client = client
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+			return err
+		}
+		afid, err := HostAuthHandshake(client, a.host)
+		if err != nil {
+			afid = p9.NOFID
+		}
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: "kernel", Aname: "/"}); err != nil {
+			return err
+		}
+		a.day = ""
+	} else if a.day != "" {
+		a.client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: a.fid})
+	}
 
-		// Update FID to point to new file
-		fid.path = "/" + name
-		fid.isOpen = true
-		fid.mode = req.Mode
-		resp.Qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
-		resp.Iounit = 8192
+	// Walk down, creating missing directories
+	a.fid = 2
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: a.fid}); err != nil {
+		return err
+	}
+	var walked []string
+	for _, name := range strings.Split(strings.Trim(a.dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		walked = append(walked, name)
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: a.fid, Newfid: a.fid, Wname: []string{name}}); err == nil {
+			continue
+		}
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Tcreate, Fid: a.fid, Name: name, Perm: p9.DMDIR | 0775, Mode: p9.OREAD}); err != nil {
+			return fmt.Errorf("create %s: %w", name, err)
+		}
+		// Tcreate leaves the fid open on the new directory; walk a fresh one
+		a.client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: a.fid})
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: a.fid, Wname: walked}); err != nil {
+			return err
+		}
+	}
 
-	case p9.Tread:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+	// Open today's file, or create it append-only
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: a.fid, Newfid: 3, Wname: []string{day}}); err == nil {
+		a.client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: a.fid})
+		a.fid = 3
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Topen, Fid: a.fid, Mode: p9.OWRITE}); err != nil {
+			return err
 		}
-		if !fid.isOpen {
-			return rError(req, "file not open")
+	} else if _, err := rpcCheck(&p9.Fcall{Type: p9.Tcreate, Fid: a.fid, Name: day, Perm: p9.DMAPPEND | 0664, Mode: p9.OWRITE}); err != nil {
+		return fmt.Errorf("create %s: %w", day, err)
+	}
+	a.day = day
+	return nil
+}
+
+// --- Socket Logic ---
+
+// Socket wraps a WebSocket connection.
+type Socket struct {
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	remote string // client address
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Subprotocol is the WebSocket subprotocol clients of /ws must offer.
+const Subprotocol = "9p2000"
+
+// MaxMsize is the largest 9P message the Kernel accepts (MAX_MSIZE).
+// Tversion negotiates down to it.
+var MaxMsize uint32 = 65536
+
+// IOHDRSZ is the room kept for the header of an Rread or Twrite,
+// so the data of one fits in msize-IOHDRSZ bytes.
+const IOHDRSZ = 24
+
+// WSOrigins are the host patterns (path.Match syntax, e.g. "*.example.com")
+// allowed in a WebSocket Origin header, besides the request's own host.
+var WSOrigins []string
+
+// ParseOrigins parses a comma-separated WS_ORIGINS value.
+func ParseOrigins(val string) []string {
+	var origins []string
+	for _, o := range strings.Split(val, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
 		}
+	}
+	return origins
+}
 
-		var content []byte
-		if fid.path == "/" {
-			// List directory
-			for name := range fs.vars {
-				d := p9.Dir{
-					Qid:    p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)},
-					Mode:   0644,
-					Name:   name,
-					Length: uint64(len(fs.vars[name])),
-					Uid:    "sys",
-					Gid:    "sys",
-					Muid:   "sys",
-					Atime:  uint32(time.Now().Unix()),
-					Mtime:  uint32(time.Now().Unix()),
-				}
-				content = append(content, d.Bytes()...)
+// Upgrade upgrades the HTTP request to a WebSocket connection.
+// Cross-origin requests must match WSOrigins and the client must offer
+// Subprotocol. Messages are limited to MaxMsize until Tversion negotiates
+// a smaller msize. The connection is pinged every Timeouts.Ping and dropped
+// if a pong does not come back within the interval.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Socket, error) {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:   []string{Subprotocol},
+		OriginPatterns: WSOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Subprotocol() != Subprotocol {
+		c.Close(websocket.StatusPolicyViolation, "subprotocol "+Subprotocol+" required")
+		return nil, fmt.Errorf("client did not offer subprotocol %s", Subprotocol)
+	}
+	c.SetReadLimit(int64(MaxMsize))
+	s := &Socket{conn: c, remote: r.RemoteAddr, closed: make(chan struct{})}
+	if Timeouts.Ping > 0 {
+		go s.keepalive(Timeouts.Ping)
+	}
+	return s, nil
+}
+
+// Close closes the connection.
+func (s *Socket) Close() error {
+	return s.close(websocket.StatusNormalClosure, "")
+}
+
+// close closes the connection with code, once.
+func (s *Socket) close(code websocket.StatusCode, reason string) error {
+	err := net.ErrClosed
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.conn.Close(code, reason)
+	})
+	return err
+}
+
+// keepalive pings the peer until the socket closes. Pongs are read by the
+// session's ReadMsg loop.
+func (s *Socket) keepalive(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-tick.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := s.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Printf("WS %s: keepalive failed: %v", s.remote, err)
+				s.once.Do(func() {
+					close(s.closed)
+					s.conn.CloseNow()
+				})
 			}
-		} else {
-			name := fid.path[1:]
-			val, exists := fs.vars[name]
-			if !exists {
-				return rError(req, "not found")
+			return
+		}
+	}
+}
+
+// SetMsize limits incoming messages to the negotiated msize.
+func (s *Socket) SetMsize(msize uint32) {
+	s.conn.SetReadLimit(int64(msize))
+}
+
+// ReadMsg reads a 9P message from a WebSocket binary frame.
+// Framing: [4-byte size][9P Message]
+// A malformed frame closes the connection with a protocol error; the
+// WebSocket library closes it as too big if it exceeds the msize.
+func (s *Socket) ReadMsg(ctx context.Context) (*p9.Fcall, error) {
+	typ, data, err := s.conn.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typ != websocket.MessageBinary {
+		s.close(websocket.StatusUnsupportedData, "9P messages must be binary")
+		return nil, fmt.Errorf("text frame")
+	}
+
+	// Validate size prefix
+	if len(data) < 4 {
+		s.close(websocket.StatusProtocolError, "frame too short")
+		return nil, fmt.Errorf("frame too short")
+	}
+	size := binary.LittleEndian.Uint32(data[0:4])
+	if uint32(len(data)) != size {
+		s.close(websocket.StatusProtocolError, "frame size mismatch")
+		return nil, fmt.Errorf("frame size mismatch: header says %d, got %d", size, len(data))
+	}
+
+	// Unmarshal 9P message (skipping 4 byte size header, p9.Unmarshal expects type at index 0)
+	f, err := p9.Unmarshal(data[4:], size)
+	if err != nil {
+		s.close(websocket.StatusProtocolError, "malformed fcall")
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteMsg writes a 9P message to a WebSocket binary frame.
+func (s *Socket) WriteMsg(ctx context.Context, buf []byte) error {
+	// One write at a time; a peer that stops reading stalls the session's
+	// replies until the write deadline drops the connection.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if Timeouts.Write > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, Timeouts.Write)
+		defer cancel()
+	}
+	return s.conn.Write(ctx, websocket.MessageBinary, buf)
+}
+
+// --- Proc Logic ---
+
+// ProcFS serves /proc for one session: a directory per visible session.
+// Users see their own sessions; adm sees all.
+type ProcFS struct {
+	session *Session // the viewer
+	mu      sync.Mutex
+	wmu     sync.Mutex // serializes replies on conn
+	fids    map[uint32]*PFid
+	pending map[uint16]context.CancelFunc // tag -> outstanding request
+}
+
+type PFid struct {
+	Path string
+	Pos  uint64 // trace stream position
+}
+
+var procFiles = []sysFile{
+	{"status", 1, 0444},
+	{"ctl", 2, 0200},
+	{"ns", 3, 0444},
+	{"fd", 4, 0444},
+	{"trace", 5, 0444},
+	{"note", QidProcNote, 0200},
+}
+
+// QidProcNote is the file index of /proc/<pid>/note.
+const QidProcNote = 6
+
+// procAddr is the address of every session's /proc client.
+const procAddr = "internal!proc"
+
+func NewProcFS(s *Session) *ProcFS {
+	return &ProcFS{
+		session: s,
+		fids:    make(map[uint32]*PFid),
+		pending: make(map[uint16]context.CancelFunc),
+	}
+}
+
+// NewProcClient spawns the ProcFS server for a session and returns a connected Client.
+func NewProcClient(s *Session) *Client {
+	c1, c2 := net.Pipe()
+	p := NewProcFS(s)
+	go p.Serve(c2)
+	return &Client{
+		addr: procAddr,
+		conn: c1,
+		tag:  1,
+	}
+}
+
+// Serve handles each request in its own goroutine so reads of trace can
+// block; Tflush cancels them.
+func (p *ProcFS) Serve(conn net.Conn) {
+	defer conn.Close()
+
+	write := func(resp *p9.Fcall) {
+		b, _ := resp.Bytes()
+		p.wmu.Lock()
+		defer p.wmu.Unlock()
+		conn.Write(b)
+	}
+
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("procfs read error: %v", err)
 			}
-			content = []byte(val)
+			return
 		}
 
-		if req.Offset >= uint64(len(content)) {
-			resp.Data = []byte{}
-		} else {
-			end := int(req.Offset) + int(req.Count)
-			if end > len(content) {
-				end = len(content)
+		if req.Type == p9.Tflush {
+			p.mu.Lock()
+			if cancel, ok := p.pending[req.Oldtag]; ok {
+				cancel()
 			}
-			resp.Data = content[req.Offset:end]
+			p.mu.Unlock()
+			write(&p9.Fcall{Type: p9.Rflush, Tag: req.Tag})
+			continue
 		}
 
-	case p9.Twrite:
-		fid, ok := fids[req.Fid]
+		ctx, cancel := context.WithCancel(context.Background())
+		p.mu.Lock()
+		p.pending[req.Tag] = cancel
+		p.mu.Unlock()
+
+		go func(req *p9.Fcall) {
+			resp := p.handle(ctx, req)
+			resp.Tag = req.Tag
+
+			p.mu.Lock()
+			delete(p.pending, req.Tag)
+			p.mu.Unlock()
+			if ctx.Err() == nil {
+				write(resp)
+			}
+			cancel()
+		}(req)
+	}
+}
+
+func (p *ProcFS) fid(id uint32) (*PFid, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.fids[id]
+	return f, ok
+}
+
+func (p *ProcFS) handle(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Version = "9P2000"
+		resp.Msize = req.Msize
+
+	case p9.Tattach:
+		p.mu.Lock()
+		p.fids[req.Fid] = &PFid{Path: "/"}
+		p.mu.Unlock()
+		resp.Qid = p9.Qid{Type: p9.QTDIR, Path: 0, Vers: 0}
+
+	case p9.Twalk:
+		fid, ok := p.fid(req.Fid)
 		if !ok {
 			return rError(req, "fid not found")
 		}
-		if !fid.isOpen {
-			return rError(req, "file not open")
+
+		wqid := make([]p9.Qid, 0)
+		currPath := fid.Path
+
+		for _, w := range req.Wname {
+			nextPath := resolvePath(currPath, w)
+			q, err := p.resolve(nextPath)
+			if err != nil {
+				if len(wqid) == 0 {
+					return rError(req, err.Error())
+				}
+				break // Partial walk
+			}
+			wqid = append(wqid, q)
+			currPath = nextPath
 		}
-		if fid.path == "/" {
-			return rError(req, "is a directory")
+		if len(wqid) == len(req.Wname) {
+			p.mu.Lock()
+			p.fids[req.Newfid] = &PFid{Path: currPath}
+			p.mu.Unlock()
 		}
+		resp.Wqid = wqid
 
-		name := fid.path[1:]
-		if _, exists := fs.vars[name]; !exists {
+	case p9.Topen:
+		fid, ok := p.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		q, err := p.resolve(fid.Path)
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		if sess, file, _ := p.lookup(fid.Path); file == "trace" {
+			p.mu.Lock()
+			fid.Pos = sess.trace.Start() // Start from the retained ring
+			p.mu.Unlock()
+		}
+		resp.Qid = q
+		resp.Iounit = 8192
+
+	case p9.Tread:
+		fid, ok := p.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if sess, file, _ := p.lookup(fid.Path); file == "trace" {
+			p.mu.Lock()
+			start := fid.Pos
+			p.mu.Unlock()
+			data, pos, err := sess.trace.Read(ctx, start, req.Count)
+			if err != nil {
+				return rError(req, "interrupted")
+			}
+			p.mu.Lock()
+			fid.Pos = pos
+			p.mu.Unlock()
+			resp.Data = data
+			break
+		}
+		data, err := p.read(fid.Path)
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Data = readAt(data, req.Offset, req.Count)
+
+	case p9.Twrite:
+		fid, ok := p.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		sess, file, err := p.lookup(fid.Path)
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		switch file {
+		case "ctl":
+			err = p.ctl(sess, string(req.Data))
+			p.session.audit("ctl", err, "file", fmt.Sprintf("/proc/%d/ctl", sess.id), "cmd", strings.TrimSpace(string(req.Data)))
+		case "note":
+			note := strings.TrimRight(string(req.Data), "\n")
+			err = sess.Note(note)
+			p.session.audit("note", err, "file", fmt.Sprintf("/proc/%d/note", sess.id), "note", note)
+		default:
+			return rError(req, "permission denied")
+		}
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Count = req.Count
+
+	case p9.Tstat:
+		fid, ok := p.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		d, err := p.stat(fid.Path)
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Stat = d.Bytes()
+
+	case p9.Tclunk:
+		p.mu.Lock()
+		delete(p.fids, req.Fid)
+		p.mu.Unlock()
+		resp.Type = p9.Rclunk
+
+	default:
+		return rError(req, "unknown type")
+	}
+	return resp
+}
+
+// visible reports whether the viewer may see sess.
+func (p *ProcFS) visible(sess *Session) bool {
+	viewer := p.session.uname()
+	if sess == p.session || viewer == "adm" {
+		return true
+	}
+	return viewer != "" && viewer != "none" && sess.uname() == viewer
+}
+
+// lookup resolves /<pid>[/<file>] to a visible session and file name.
+func (p *ProcFS) lookup(path string) (*Session, string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 2 {
+		return nil, "", fmt.Errorf("not found")
+	}
+	pid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("not found")
+	}
+	sess := Registry.Get(uint32(pid))
+	if sess == nil || !p.visible(sess) {
+		return nil, "", fmt.Errorf("pid not found")
+	}
+	if len(parts) == 1 {
+		return sess, "", nil
+	}
+	if _, ok := lookupProcFile(parts[1]); !ok {
+		return nil, "", fmt.Errorf("not found")
+	}
+	return sess, parts[1], nil
+}
+
+func lookupProcFile(name string) (sysFile, bool) {
+	for _, f := range procFiles {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return sysFile{}, false
+}
+
+func (p *ProcFS) resolve(path string) (p9.Qid, error) {
+	d, err := p.stat(path)
+	return d.Qid, err
+}
+
+// stat describes a /proc path. Qid paths are pid<<8 | file index.
+func (p *ProcFS) stat(path string) (p9.Dir, error) {
+	now := uint32(time.Now().Unix())
+	if path == "/" {
+		return p9.Dir{
+			Qid:  p9.Qid{Type: p9.QTDIR, Path: 0},
+			Mode: p9.DMDIR | 0555,
+			Name: "proc",
+			Uid:  "sys", Gid: "sys", Muid: "sys",
+			Atime: now, Mtime: now,
+		}, nil
+	}
+
+	sess, file, err := p.lookup(path)
+	if err != nil {
+		return p9.Dir{}, err
+	}
+	owner := sess.uname()
+	d := p9.Dir{
+		Uid: owner, Gid: owner, Muid: owner,
+		Atime: uint32(sess.start.Unix()),
+		Mtime: now,
+	}
+	if file == "" {
+		d.Qid = p9.Qid{Type: p9.QTDIR, Path: uint64(sess.id) << 8}
+		d.Mode = p9.DMDIR | 0555
+		d.Name = strconv.FormatUint(uint64(sess.id), 10)
+		return d, nil
+	}
+	f, _ := lookupProcFile(file)
+	d.Qid = p9.Qid{Type: p9.QTFILE, Path: uint64(sess.id)<<8 | f.qid}
+	d.Mode = f.mode
+	d.Name = f.name
+	return d, nil
+}
+
+func (p *ProcFS) read(path string) ([]byte, error) {
+	if path == "/" {
+		// List visible Session IDs
+		var data []byte
+		for _, id := range Registry.List() {
+			if d, err := p.stat(fmt.Sprintf("/%d", id)); err == nil {
+				data = append(data, d.Bytes()...)
+			}
+		}
+		return data, nil
+	}
+
+	sess, file, err := p.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch file {
+	case "":
+		// Directory listing of /<pid>
+		var data []byte
+		for _, f := range procFiles {
+			d, _ := p.stat(path + "/" + f.name)
+			data = append(data, d.Bytes()...)
+		}
+		return data, nil
+	case "status":
+		return []byte(sess.Status()), nil
+	case "ns":
+		return []byte(sess.namespace().String()), nil
+	case "fd":
+		return []byte(sess.Fds()), nil
+	}
+	return []byte{}, nil // ctl reads empty
+}
+
+// ctl executes a command written to /proc/<pid>/ctl.
+// lookup has already checked that the writer may see sess; ns needs adm.
+//
+//	kill                 close the session's transport
+//	hangup <mountpoint>  unmount it, hanging up backends no other path uses
+//	debug on|off         log every Fcall of the session
+//	trace on|off         record relayed Fcalls in /proc/<pid>/trace
+//	ns <manifest-line>   apply a mount or bind line to the session's namespace
+func (p *ProcFS) ctl(sess *Session, cmd string) error {
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	switch parts[0] {
+	case "kill":
+		log.Printf("Proc: %s killed session %d", p.session.uname(), sess.id)
+		return sess.kill()
+
+	case "hangup":
+		if len(parts) != 2 {
+			return fmt.Errorf("usage: hangup <mountpoint>")
+		}
+		clients, ok := sess.namespace().Unmount(parts[1])
+		if !ok {
+			return fmt.Errorf("not mounted: %s", parts[1])
+		}
+		for _, c := range clients {
+			c.Close()
+		}
+		log.Printf("Proc: %s hung up %s in session %d", p.session.uname(), parts[1], sess.id)
+		return nil
+
+	case "debug":
+		if p.session.uname() != "adm" {
+			return fmt.Errorf("permission denied")
+		}
+		if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+			return fmt.Errorf("usage: debug on|off")
+		}
+		sess.debug.Store(parts[1] == "on")
+		return nil
+
+	case "trace":
+		if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+			return fmt.Errorf("usage: trace on|off")
+		}
+		sess.tracing.Store(parts[1] == "on")
+		return nil
+
+	case "ns":
+		if p.session.uname() != "adm" {
+			return fmt.Errorf("permission denied")
+		}
+		line := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), "ns"))
+		if f := strings.Fields(line); len(f) == 0 || (f[0] != "mount" && f[0] != "bind") {
+			return fmt.Errorf("usage: ns mount|bind ...")
+		}
+		if err := sess.namespace().Build(line, sess.dialer); err != nil {
+			return err
+		}
+		log.Printf("Proc: %s applied %q to session %d", p.session.uname(), line, sess.id)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command: %s", parts[0])
+	}
+}
+
+// Status is the content of /proc/<pid>/status.
+func (s *Session) Status() string {
+	s.mu.Lock()
+	nfids, user, transport := len(s.fids), s.user, s.transport
+	s.mu.Unlock()
+	lim := Quotas.For(user)
+	return fmt.Sprintf("%d %s state=running transport=%s start=%d rx=%d tx=%d ops=%d fids=%d/%s oprate=%s byterate=%s sessions=%s limited=%d\n",
+		s.id, user, transport, s.start.Unix(), s.rx.Load(), s.tx.Load(), s.ops.Load(), nfids, limitString(lim.Fids),
+		s.opsRate.String(), s.bytesRate.String(), Quotas.Sessions(user, s.quotaKey(user)), s.limited.Load())
+}
+
+// Fds is the content of /proc/<pid>/fd: one "<fid> <mode> <path> <backend>" line per fid.
+func (s *Session) Fds() string {
+	s.mu.Lock()
+	ids := make([]uint32, 0, len(s.fids))
+	for id := range s.fids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var sb strings.Builder
+	for _, id := range ids {
+		ref := s.fids[id]
+		mode := "-"
+		if ref.isOpen {
+			mode = [...]string{"r", "w", "rw", "x"}[ref.openMode&3]
+		}
+		fmt.Fprintf(&sb, "%d %s %s %s\n", id, mode, ref.path, plan9Addr(ref.client.addr))
+	}
+	s.mu.Unlock()
+	return sb.String()
+}
+
+// --- Sys Logic ---
+
+// SysDevice is a special file server for system control (e.g., /dev/sys/ctl).
+type SysDevice struct {
+	session *Session
+	ns      *Namespace
+	dialer  Dialer
+	mu      sync.Mutex
+	fids    map[uint32]string // Fid -> Path
+}
+
+func NewSysDevice(s *Session, ns *Namespace) *SysDevice {
+	return &SysDevice{
+		session: s,
+		ns:      ns,
+		dialer:  s.dialer,
+		fids:    make(map[uint32]string),
+	}
+}
+
+// NewSysClient spawns the SysDevice server for a session and returns a connected Client.
+func NewSysClient(s *Session, ns *Namespace) *Client {
+	c1, c2 := net.Pipe()
+	sys := NewSysDevice(s, ns)
+	go sys.Serve(c2)
+	return &Client{
+		addr: "internal!sys",
+		conn: c1,
+		tag:  1,
+	}
+}
+
+func (sys *SysDevice) Serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+		resp := sys.handle(req)
+		resp.Tag = req.Tag
+		b, _ := resp.Bytes()
+		conn.Write(b)
+	}
+}
+
+// file IDs
+const (
+	QidRoot     = 0
+	QidCtl      = 1
+	QidReplicas = 2
+	QidStats    = 3
+	QidKeys     = 4
+	QidServices = 5 // a service's file is id<<8 | QidServices
+)
+
+// sysFile describes one file in /dev/sys.
+type sysFile struct {
+	name string
+	qid  uint64
+	mode uint32
+}
+
+var sysFiles = []sysFile{
+	{"ctl", QidCtl, 0666},
+	{"replicas", QidReplicas, 0444},
+	{"stats", QidStats, 0444},
+	{"keys", QidKeys, 0444},
+	{"services", QidServices, p9.DMDIR | 0555},
+}
+
+func lookupSysFile(name string) (sysFile, bool) {
+	for _, f := range sysFiles {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return sysFile{}, false
+}
+
+func (sys *SysDevice) handle(req *p9.Fcall) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = req.Msize
+		resp.Version = "9P2000"
+
+	case p9.Tattach:
+		sys.fids[req.Fid] = "/"
+		resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 1, Path: QidRoot}
+
+	case p9.Twalk:
+		path, ok := sys.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		wqids := []p9.Qid{}
+		for _, name := range req.Wname {
+			next := resolvePath(path, name)
+			q, ok := sys.qid(next)
+			if !ok {
+				break
+			}
+			wqids = append(wqids, q)
+			path = next
+		}
+		if len(wqids) == 0 && len(req.Wname) > 0 {
+			return rError(req, "not found")
+		}
+		if len(wqids) == len(req.Wname) {
+			sys.fids[req.Newfid] = path
+		}
+		resp.Wqid = wqids
+
+	case p9.Topen:
+		path, ok := sys.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		q, ok := sys.qid(path)
+		if !ok {
 			return rError(req, "not found")
 		}
+		resp.Qid = q
+		resp.Iounit = 0 // use msize
+
+	case p9.Tread:
+		path, ok := sys.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if path == "/" {
+			// Dir Read
+			var b []byte
+			for _, f := range sysFiles {
+				dir := p9.Dir{
+					Qid:    p9.Qid{Type: uint8(f.mode >> 24), Path: f.qid},
+					Mode:   f.mode,
+					Name:   f.name,
+					Length: 0,
+					Uid:    "sys", Gid: "sys", Muid: "sys",
+					Atime: uint32(time.Now().Unix()),
+					Mtime: uint32(time.Now().Unix()),
+				}
+				b = append(b, dir.Bytes()...)
+			}
+			if req.Offset == 0 && req.Count >= uint32(len(b)) {
+				resp.Data = b
+			} else {
+				resp.Data = []byte{}
+			}
+		} else if svcPath, ok := strings.CutPrefix(path, "/services"); ok {
+			resp.Data = readAt(readServices(strings.TrimPrefix(svcPath, "/"), sys.session.uname()), req.Offset, req.Count)
+		} else {
+			resp.Data = readAt(sys.read(path[1:]), req.Offset, req.Count)
+		}
+
+	case p9.Twrite:
+		path, ok := sys.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if path != "/ctl" {
+			return rError(req, "permission denied")
+		}
+
+		// Execute Command
+		cmd := string(req.Data)
+		err := sys.execute(cmd)
+		sys.session.audit("ctl", err, "file", "/dev/sys/ctl", "cmd", strings.TrimSpace(cmd))
+		if err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Count = req.Count
+
+	case p9.Tclunk:
+		delete(sys.fids, req.Fid)
+		resp.Type = p9.Rclunk
+
+	case p9.Tstat:
+		resp.Stat = make([]byte, 0)
+
+	default:
+		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+	}
+	return resp
+}
+
+// qid resolves a /dev/sys path: a top-level file, or a service in
+// /dev/sys/services.
+func (sys *SysDevice) qid(path string) (p9.Qid, bool) {
+	if path == "/" {
+		return p9.Qid{Type: p9.QTDIR, Vers: 1, Path: QidRoot}, true
+	}
+	if name, ok := strings.CutPrefix(path, "/services/"); ok {
+		svc := Services.Lookup(name)
+		if svc == nil || !svc.visible(sys.session.uname()) {
+			return p9.Qid{}, false
+		}
+		return p9.Qid{Type: p9.QTFILE, Path: svc.id<<8 | QidServices}, true
+	}
+	f, ok := lookupSysFile(strings.TrimPrefix(path, "/"))
+	if !ok {
+		return p9.Qid{}, false
+	}
+	return p9.Qid{Type: uint8(f.mode >> 24), Vers: 1, Path: f.qid}, true
+}
+
+// readServices returns the status line of the service in /dev/sys/services
+// called name, or the directory itself if name is empty, as user sees them.
+func readServices(name, user string) []byte {
+	if name != "" {
+		svc := Services.Lookup(name)
+		if svc == nil || !svc.visible(user) {
+			return []byte{}
+		}
+		return []byte(svc.String(mountCount(svc.Addr), user))
+	}
+	var b []byte
+	now := uint32(time.Now().Unix())
+	for _, svc := range Services.List() {
+		if !svc.visible(user) {
+			continue
+		}
+		line := svc.String(mountCount(svc.Addr), user)
+		dir := p9.Dir{
+			Qid:    p9.Qid{Type: p9.QTFILE, Path: svc.id<<8 | QidServices},
+			Mode:   0444,
+			Name:   plan9Addr(svc.Addr),
+			Length: uint64(len(line)),
+			Uid:    "sys", Gid: "sys", Muid: "sys",
+			Atime: now,
+			Mtime: now,
+		}
+		b = append(b, dir.Bytes()...)
+	}
+	return b
+}
+
+// read returns the content of a /dev/sys file.
+func (sys *SysDevice) read(name string) []byte {
+	switch name {
+	case "replicas":
+		return []byte(Health.String())
+	case "stats":
+		return []byte(Stats.String())
+	case "keys":
+		return []byte(sys.session.keys.String())
+	}
+	return []byte{} // ctl reads empty
+}
+
+// readAt returns the slice of data visible to a Tread at offset/count.
+func readAt(data []byte, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(data)) {
+		return []byte{}
+	}
+	end := offset + uint64(count)
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	return data[offset:end]
+}
+
+func (sys *SysDevice) execute(cmd string) error {
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	switch parts[0] {
+	case "mount":
+		// mount <addr> [<addr>...] <path> [flags]
+		// e.g. mount tcp!localhost:9999 /ext -c, or mount /srv/name /mnt/x
+		flags, args := parseFlags(parts[1:])
+		if len(args) < 2 {
+			return fmt.Errorf("usage: mount <addr> [<addr>...] <path> [flags]")
+		}
+		path := args[len(args)-1]
+		addrs := make([]string, 0, len(args)-1)
+		for _, a := range args[:len(args)-1] {
+			addrs = append(addrs, convertAddr(a))
+		}
+		addr := strings.Join(addrs, " ")
+
+		var client *Client
+		var err error
+		if addrs[0] == "#e" {
+			// The user's shared environment group
+			user := sys.session.uname()
+			if user == "" || user == "none" {
+				return fmt.Errorf("permission denied")
+			}
+			client = EnvGroups.Dial(user)
+		} else {
+			client, err = dialMount(sys.dialer, addrs, sys.session.uname() == "adm")
+		}
+		if err != nil {
+			return err
+		}
+
+		// Attempt Attach? Usually mount implies Attach.
+		// Standard Plan 9 mount does: dial -> ssl -> auth -> attach.
+		// Here we do dial -> attach.
+		// Tattach(root)
+		// We can't attach here easily because Client.Attach is not exposed nicely,
+		// but Client assumes attached?
+		// No, `Dial` methods returns a Client, but that client is just a connection wrapper.
+		// We need to perform Tver/Tattach.
+
+		// Perform Handshake
+		if _, err := client.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+			client.Close()
+			return err
+		}
+		if _, err := client.RPC(&p9.Fcall{Type: p9.Tattach, Fid: 0, Uname: "user", Aname: "/"}); err != nil {
+			client.Close()
+			return err
+		}
+		// Now Fid 0 is Root.
+		// Wait, Client struct handles tag, but FID management is up to caller usually?
+		// No, Client struct is very thin.
+		// Namespace expects Client to be ready to accept Walks from Fid 0?
+		// Let's check kernel/session.go logic or Client.
+
+		sys.ns.Mount(path, client, flags)
+		log.Printf("Sys: Mounted %s at %s (flags=%d)", addr, path, flags)
+		return nil
+
+	case "import":
+		// import <host> <path> <mountpoint> [flags]
+		// e.g. import tcp!prod!9010 /proc /n/prod/proc
+		flags, args := parseFlags(parts[1:])
+		if len(args) != 3 {
+			return fmt.Errorf("usage: import <host> <path> <mountpoint> [flags]")
+		}
+		user := sys.session.uname()
+		if user == "none" || (user != "adm" && !importAllowed(args[0])) {
+			sys.session.audit("import", errors.New("permission denied"), "host", args[0], "path", args[1], "mount", args[2])
+			return fmt.Errorf("permission denied")
+		}
+		client, err := Import(sys.dialer, convertAddr(args[0]), user, args[1], sys.session.host)
+		if err != nil {
+			sys.session.audit("import", err, "host", args[0], "path", args[1], "mount", args[2])
+			return err
+		}
+		sys.ns.Mount(args[2], client, flags)
+		sys.session.audit("import", nil, "host", args[0], "path", args[1], "mount", args[2])
+		log.Printf("Sys: Imported %s from %s at %s (flags=%d)", args[1], args[0], args[2], flags)
+		return nil
+
+	case "bind":
+		// bind <old> <new> [flags]
+		// e.g. bind /data /alias -b
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: bind <old> <new> [flags]")
+		}
+		oldPath := parts[1]
+		newPath := parts[2]
+		flags, _ := parseFlags(parts[3:])
+
+		if err := sys.ns.Bind(oldPath, newPath, flags); err != nil {
+			return err
+		}
+		log.Printf("Sys: Bound %s to %s (flags=%d)", oldPath, newPath, flags)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command: %s", parts[0])
+	}
+}
+
+// --- Dev Logic ---
+
+// consHistory is how much of /dev/cons a late reader can still see.
+const consHistory = 64 * 1024
+
+// Cons is a session's console: a log that apps append to and readers follow.
+// Each reader keeps its own position in the stream and blocks at the end
+// until more is written.
+type Cons struct {
+	mu     sync.Mutex
+	buf    []byte        // retained tail of the stream
+	base   uint64        // stream offset of buf[0]
+	wait   chan struct{} // closed on the next write
+	closed bool
+}
+
+func NewCons() *Cons {
+	return &Cons{wait: make(chan struct{})}
+}
+
+// Write appends p to the stream and wakes blocked readers.
+func (c *Cons) Write(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = append(c.buf, p...)
+	if over := len(c.buf) - consHistory; over > 0 {
+		c.buf = append([]byte(nil), c.buf[over:]...)
+		c.base += uint64(over)
+	}
+	close(c.wait)
+	c.wait = make(chan struct{})
+}
+
+// Start is the oldest stream position still retained.
+func (c *Cons) Start() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.base
+}
+
+// Read returns up to count bytes from stream position pos, blocking until
+// data is available, ctx is done or the console is closed. It returns the
+// position following the data.
+func (c *Cons) Read(ctx context.Context, pos uint64, count uint32) ([]byte, uint64, error) {
+	for {
+		c.mu.Lock()
+		if pos < c.base {
+			pos = c.base // Reader fell behind the retained history
+		}
+		end := c.base + uint64(len(c.buf))
+		if pos < end {
+			data := readAt(c.buf, pos-c.base, count)
+			data = append([]byte(nil), data...)
+			c.mu.Unlock()
+			return data, pos + uint64(len(data)), nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return []byte{}, pos, nil
+		}
+		wait := c.wait
+		c.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, pos, ctx.Err()
+		}
+	}
+}
+
+// Close wakes all readers; reads at the end of the stream then return EOF.
+func (c *Cons) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.wait)
+	}
+}
+
+// Notes are short messages posted to a session, as on Plan 9: at most
+// maxNoteLen bytes, and at most maxNotes waiting to be read.
+const (
+	maxNoteLen = 256
+	maxNotes   = 32
+)
+
+// NoteQueue holds the notes posted to a session until /dev/note reads them.
+// Each read takes one note.
+type NoteQueue struct {
+	mu    sync.Mutex
+	notes []string
+	wait  chan struct{} // closed on the next post
+}
+
+func NewNoteQueue() *NoteQueue {
+	return &NoteQueue{wait: make(chan struct{})}
+}
+
+// Post queues note and wakes a blocked reader.
+func (q *NoteQueue) Post(note string) error {
+	if note == "" || len(note) > maxNoteLen {
+		return fmt.Errorf("bad note")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.notes) >= maxNotes {
+		return fmt.Errorf("too many notes")
+	}
+	q.notes = append(q.notes, note)
+	close(q.wait)
+	q.wait = make(chan struct{})
+	return nil
+}
+
+// Read takes the oldest note, blocking until one is posted or ctx is done.
+func (q *NoteQueue) Read(ctx context.Context) (string, error) {
+	for {
+		q.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			q.mu.Unlock()
+			return "", err
+		}
+		if len(q.notes) > 0 {
+			note := q.notes[0]
+			q.notes = q.notes[1:]
+			q.mu.Unlock()
+			return note, nil
+		}
+		wait := q.wait
+		q.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// DevFS serves a session's kernel-synthetic files in /dev:
+// user, cons, time, bintime, sysname, random, resume, note and wall.
+type DevFS struct {
+	session *Session
+	cons    *Cons
+	mu      sync.Mutex
+	wmu     sync.Mutex // serializes replies on conn
+	fids    map[uint32]*devFid
+	pending map[uint16]context.CancelFunc // tag -> outstanding request
+}
+
+type devFid struct {
+	name string // "" for the directory
+	pos  uint64 // cons stream position
+}
+
+// Qid paths for /dev files
+const (
+	QidDevRoot = iota
+	QidDevUser
+	QidDevCons
+	QidDevTime
+	QidDevBintime
+	QidDevSysname
+	QidDevRandom
+	QidDevResume
+	QidDevNote
+	QidDevWall
+)
+
+var devFiles = []sysFile{
+	{"user", QidDevUser, 0444},
+	{"cons", QidDevCons, 0666},
+	{"time", QidDevTime, 0444},
+	{"bintime", QidDevBintime, 0444},
+	{"sysname", QidDevSysname, 0444},
+	{"random", QidDevRandom, 0444},
+	{"resume", QidDevResume, 0400},
+	{"note", QidDevNote, 0444},
+	{"wall", QidDevWall, 0220},
+}
+
+func lookupDevFile(name string) (sysFile, bool) {
+	for _, f := range devFiles {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return sysFile{}, false
+}
+
+// boot is the origin of the tick counter in /dev/time and /dev/bintime.
+var boot = time.Now()
+
+func NewDevFS(s *Session) *DevFS {
+	return &DevFS{
+		session: s,
+		cons:    NewCons(),
+		fids:    make(map[uint32]*devFid),
+		pending: make(map[uint16]context.CancelFunc),
+	}
+}
+
+// NewDevClient spawns the DevFS server for a session and returns a connected Client.
+// devAddr is the address of every session's /dev client.
+const devAddr = "internal!dev"
+
+func NewDevClient(s *Session) *Client {
+	c1, c2 := net.Pipe()
+	dev := NewDevFS(s)
+	go dev.Serve(c2)
+	return &Client{
+		addr: devAddr,
+		conn: c1,
+		tag:  1,
+	}
+}
+
+// Serve handles each request in its own goroutine so reads of /dev/cons and
+// /dev/note can block; Tflush cancels them.
+func (dev *DevFS) Serve(conn net.Conn) {
+	defer dev.cons.Close()
+	defer conn.Close()
+	defer func() {
+		// Notes outlive the connection; stop waiting for them
+		dev.mu.Lock()
+		for _, cancel := range dev.pending {
+			cancel()
+		}
+		dev.mu.Unlock()
+	}()
+
+	write := func(resp *p9.Fcall) {
+		b, _ := resp.Bytes()
+		dev.wmu.Lock()
+		defer dev.wmu.Unlock()
+		conn.Write(b)
+	}
+
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+
+		if req.Type == p9.Tflush {
+			dev.mu.Lock()
+			if cancel, ok := dev.pending[req.Oldtag]; ok {
+				cancel()
+			}
+			dev.mu.Unlock()
+			write(&p9.Fcall{Type: p9.Rflush, Tag: req.Tag})
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		dev.mu.Lock()
+		dev.pending[req.Tag] = cancel
+		dev.mu.Unlock()
+
+		go func(req *p9.Fcall) {
+			resp := dev.handle(ctx, req)
+			resp.Tag = req.Tag
+
+			dev.mu.Lock()
+			delete(dev.pending, req.Tag)
+			dev.mu.Unlock()
+			if ctx.Err() == nil {
+				write(resp)
+			}
+			cancel()
+		}(req)
+	}
+}
+
+func (dev *DevFS) fid(id uint32) (*devFid, bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	f, ok := dev.fids[id]
+	return f, ok
+}
+
+func (dev *DevFS) handle(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = req.Msize
+		resp.Version = "9P2000"
+
+	case p9.Tattach:
+		dev.mu.Lock()
+		dev.fids[req.Fid] = &devFid{}
+		dev.mu.Unlock()
+		resp.Qid = p9.Qid{Type: p9.QTDIR, Path: QidDevRoot}
+
+	case p9.Twalk:
+		f, ok := dev.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		wqids := []p9.Qid{}
+		var nf *devFid
+		if len(req.Wname) == 0 {
+			nf = &devFid{name: f.name}
+		} else if df, ok := lookupDevFile(req.Wname[0]); ok && len(req.Wname) == 1 && f.name == "" {
+			wqids = append(wqids, p9.Qid{Type: p9.QTFILE, Path: df.qid})
+			nf = &devFid{name: df.name}
+		} else {
+			return rError(req, "not found")
+		}
+		dev.mu.Lock()
+		dev.fids[req.Newfid] = nf
+		dev.mu.Unlock()
+		resp.Wqid = wqids
+
+	case p9.Topen:
+		f, ok := dev.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if f.name == "" {
+			resp.Qid = p9.Qid{Type: p9.QTDIR, Path: QidDevRoot}
+		} else {
+			df, _ := lookupDevFile(f.name)
+			if req.Mode&3 != 0 && df.mode&0222 == 0 {
+				return rError(req, "permission denied")
+			}
+			resp.Qid = p9.Qid{Type: p9.QTFILE, Path: df.qid}
+			if f.name == "cons" {
+				dev.mu.Lock()
+				f.pos = dev.cons.Start() // New readers see the retained history
+				dev.mu.Unlock()
+			}
+		}
+
+	case p9.Tread:
+		f, ok := dev.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		switch f.name {
+		case "":
+			// Dir Read
+			var b []byte
+			now := uint32(time.Now().Unix())
+			user := dev.session.uname()
+			for _, df := range devFiles {
+				dir := p9.Dir{
+					Qid:  p9.Qid{Type: p9.QTFILE, Path: df.qid},
+					Mode: df.mode,
+					Name: df.name,
+					Uid:  user, Gid: user, Muid: user,
+					Atime: now,
+					Mtime: now,
+				}
+				b = append(b, dir.Bytes()...)
+			}
+			resp.Data = readAt(b, req.Offset, req.Count)
+		case "cons":
+			dev.mu.Lock()
+			start := f.pos
+			dev.mu.Unlock()
+			data, pos, err := dev.cons.Read(ctx, start, req.Count)
+			if err != nil {
+				return rError(req, "interrupted")
+			}
+			dev.mu.Lock()
+			f.pos = pos
+			dev.mu.Unlock()
+			resp.Data = data
+		case "note":
+			note, err := dev.session.notes.Read(ctx)
+			if err != nil {
+				return rError(req, "interrupted")
+			}
+			resp.Data = readAt([]byte(note), 0, req.Count)
+		case "random":
+			resp.Data = make([]byte, min(req.Count, MaxMsize-IOHDRSZ))
+			rand.Read(resp.Data)
+		default:
+			resp.Data = readAt(dev.read(f.name, req.Count), req.Offset, req.Count)
+		}
+
+	case p9.Twrite:
+		f, ok := dev.fid(req.Fid)
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		switch f.name {
+		case "cons":
+			dev.cons.Write(req.Data)
+		case "wall":
+			// Broadcast a note to every session
+			if dev.session.uname() != "adm" {
+				return rError(req, "permission denied")
+			}
+			note := strings.TrimRight(string(req.Data), "\n")
+			if note == "" || len(note) > maxNoteLen {
+				return rError(req, "bad note")
+			}
+			n := Registry.Note(note)
+			dev.session.audit("wall", nil, "note", note, "sessions", strconv.Itoa(n))
+		default:
+			return rError(req, "permission denied")
+		}
+		resp.Count = uint32(len(req.Data))
+
+	case p9.Tclunk:
+		dev.mu.Lock()
+		delete(dev.fids, req.Fid)
+		dev.mu.Unlock()
+		resp.Type = p9.Rclunk
+
+	case p9.Tstat:
+		resp.Stat = make([]byte, 0)
+
+	default:
+		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+	}
+	return resp
+}
+
+// read returns the content of a fixed /dev file.
+func (dev *DevFS) read(name string, count uint32) []byte {
+	now := time.Now()
+	ticks := uint64(now.Sub(boot))
+	const hz = uint64(time.Second)
+
+	switch name {
+	case "user":
+		return []byte(dev.session.uname())
+	case "time":
+		// seconds nanoseconds ticks hz, as on Plan 9
+		return []byte(fmt.Sprintf("%12d %21d %21d %21d ", now.Unix(), now.UnixNano(), ticks, hz))
+	case "bintime":
+		// Big-endian nanoseconds, followed by ticks and hz if there is room
+		b := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+		if count >= 24 {
+			b = binary.BigEndian.AppendUint64(b, ticks)
+			b = binary.BigEndian.AppendUint64(b, hz)
+		}
+		return b
+	case "sysname":
+		return []byte(sysname())
+	case "resume":
+		dev.session.mu.Lock()
+		defer dev.session.mu.Unlock()
+		return []byte(dev.session.resume)
+	}
+	return []byte{}
+}
+
+// --- Srv Logic ---
+
+// SrvRegistry holds the connections posted in /srv. It is shared by every
+// session: a post made in one session can be mounted from any other.
+// Manifests and announced services resolve names through it, so unprefixed
+// names are reserved for adm and announcements; other users post under
+// <user>.<name>.
+type SrvRegistry struct {
+	mu    sync.RWMutex
+	posts map[string]*srvPost
+}
+
+type srvPost struct {
+	addr  string   // Plan 9 dial address, as written
+	owner *Session // post is removed when its owner disconnects
+	conn  *Client  // announced connection, shared through per-session views
+}
+
+var Srv = &SrvRegistry{
+	posts: make(map[string]*srvPost),
+}
+
+// Post registers addr under name.
+func (r *SrvRegistry) Post(name, addr string, owner *Session) error {
+	if !srvAllowed(owner.uname(), name) {
+		return fmt.Errorf("permission denied")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.posts[name]; ok && p.owner != owner {
+		return fmt.Errorf("exists: %s", name)
+	}
+	r.posts[name] = &srvPost{addr: addr, owner: owner}
+	log.Printf("Srv: %s posted %s", name, addr)
+	return nil
+}
+
+// PostConn registers an announced connection under name. The service proved
+// its name, so it replaces any earlier post or announcement of it.
+func (r *SrvRegistry) PostConn(name string, c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.posts[name]; ok && p.conn != nil {
+		p.conn.Close() // Stale announcement; the service reconnected
+	}
+	r.posts[name] = &srvPost{addr: c.addr, conn: c}
+	log.Printf("Srv: %s announced from %s", name, c.addr)
+}
+
+// srvAllowed reports whether user may post name: adm any name, others only
+// <user>.<name>.
+func srvAllowed(user, name string) bool {
+	if user == "adm" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(name, user+".")
+	return ok && user != "" && user != "none" && rest != ""
+}
+
+// Withdraw removes name if it still refers to the announced connection c.
+func (r *SrvRegistry) Withdraw(name string, c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.posts[name]; ok && p.conn == c {
+		delete(r.posts, name)
+		log.Printf("Srv: %s withdrawn", name)
+	}
+}
+
+// Lookup returns the address posted under name.
+func (r *SrvRegistry) Lookup(name string) (string, bool) {
+	p, ok := r.get(name)
+	if !ok {
+		return "", false
+	}
+	return p.addr, true
+}
+
+func (r *SrvRegistry) get(name string) (*srvPost, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.posts[name]
+	return p, ok
+}
+
+// Remove withdraws a post. Only its owner may remove it.
+func (r *SrvRegistry) Remove(name string, s *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.posts[name]
+	if !ok {
+		return fmt.Errorf("not found: %s", name)
+	}
+	if p.conn != nil || p.owner != s {
+		return fmt.Errorf("permission denied")
+	}
+	delete(r.posts, name)
+	return nil
+}
+
+// Drop removes every post made by owner.
+func (r *SrvRegistry) Drop(owner *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, p := range r.posts {
+		if p.conn == nil && p.owner == owner {
+			delete(r.posts, name)
+			log.Printf("Srv: %s withdrawn", name)
+		}
+	}
+}
+
+// Names lists the posted names in order.
+func (r *SrvRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.posts))
+	for name := range r.posts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dial dials addr, or the address posted under it if addr is /srv/<name>.
+// An announced service is not dialed; the caller gets a view of its connection.
+func (r *SrvRegistry) Dial(d Dialer, addr string) (*Client, error) {
+	name, ok := strings.CutPrefix(addr, "/srv/")
+	if !ok {
+		return d.Dial(addr)
+	}
+	p, ok := r.get(name)
+	if !ok {
+		return nil, fmt.Errorf("srv not found: %s", name)
+	}
+	if p.conn != nil {
+		return NewFidView(p.conn), nil
+	}
+	return d.Dial(convertAddr(p.addr))
+}
+
+// SrvFS is a session's view of the shared SrvRegistry, mounted at /srv.
+// Create /srv/<name> and write a dial address to post it; remove it to withdraw.
+type SrvFS struct {
+	session *Session
+	mu      sync.Mutex
+	fids    map[uint32]string // Fid -> name ("" for the directory)
+}
+
+func NewSrvFS(s *Session) *SrvFS {
+	return &SrvFS{
+		session: s,
+		fids:    make(map[uint32]string),
+	}
+}
+
+// NewSrvClient spawns the SrvFS server for a session and returns a connected Client.
+func NewSrvClient(s *Session) *Client {
+	c1, c2 := net.Pipe()
+	fs := NewSrvFS(s)
+	go fs.Serve(c2)
+	return &Client{
+		addr: "internal!srv",
+		conn: c1,
+		tag:  1,
+	}
+}
+
+func (fs *SrvFS) Serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+		resp := fs.handle(req)
+		resp.Tag = req.Tag
+		b, _ := resp.Bytes()
+		conn.Write(b)
+	}
+}
+
+func (fs *SrvFS) handle(req *p9.Fcall) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = req.Msize
+		resp.Version = "9P2000"
+
+	case p9.Tattach:
+		fs.fids[req.Fid] = ""
+		resp.Qid = p9.Qid{Type: p9.QTDIR, Path: 0}
+
+	case p9.Twalk:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		wqids := []p9.Qid{}
+		if len(req.Wname) == 0 {
+			fs.fids[req.Newfid] = name
+		} else if _, posted := Srv.Lookup(req.Wname[0]); posted && len(req.Wname) == 1 && name == "" {
+			wqids = append(wqids, p9.Qid{Type: p9.QTFILE, Path: hashPath(req.Wname[0])})
+			fs.fids[req.Newfid] = req.Wname[0]
+		} else {
+			return rError(req, "not found")
+		}
+		resp.Wqid = wqids
+
+	case p9.Topen:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if name == "" {
+			resp.Qid = p9.Qid{Type: p9.QTDIR, Path: 0}
+		} else {
+			resp.Qid = p9.Qid{Type: p9.QTFILE, Path: hashPath(name)}
+		}
+
+	case p9.Tcreate:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if name != "" {
+			return rError(req, "not a directory")
+		}
+		if !srvAllowed(fs.session.uname(), req.Name) {
+			return rError(req, "permission denied")
+		}
+		if req.Name == "" || req.Name == "." || req.Name == ".." || strings.Contains(req.Name, "/") {
+			return rError(req, "invalid name")
+		}
+		if _, posted := Srv.Lookup(req.Name); posted {
+			return rError(req, "exists")
+		}
+		// The post is made when the address is written.
+		fs.fids[req.Fid] = req.Name
+		resp.Qid = p9.Qid{Type: p9.QTFILE, Path: hashPath(req.Name)}
+
+	case p9.Tread:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if name == "" {
+			// Dir Read
+			var b []byte
+			for _, n := range Srv.Names() {
+				dir := p9.Dir{
+					Qid:  p9.Qid{Type: p9.QTFILE, Path: hashPath(n)},
+					Mode: 0666,
+					Name: n,
+					Uid:  "sys", Gid: "sys", Muid: "sys",
+					Atime: uint32(time.Now().Unix()),
+					Mtime: uint32(time.Now().Unix()),
+				}
+				b = append(b, dir.Bytes()...)
+			}
+			resp.Data = readAt(b, req.Offset, req.Count)
+		} else {
+			addr, _ := Srv.Lookup(name)
+			resp.Data = readAt([]byte(addr), req.Offset, req.Count)
+		}
+
+	case p9.Twrite:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if name == "" {
+			return rError(req, "is a directory")
+		}
+		addr := strings.TrimSpace(string(req.Data))
+		if addr == "" {
+			return rError(req, "empty address")
+		}
+		if err := Srv.Post(name, addr, fs.session); err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Count = uint32(len(req.Data))
+
+	case p9.Tremove:
+		name, ok := fs.fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		delete(fs.fids, req.Fid)
+		if name == "" {
+			return rError(req, "permission denied")
+		}
+		if err := Srv.Remove(name, fs.session); err != nil {
+			return rError(req, err.Error())
+		}
+		resp.Type = p9.Rremove
+
+	case p9.Tclunk:
+		delete(fs.fids, req.Fid)
+		resp.Type = p9.Rclunk
+
+	case p9.Tstat:
+		resp.Stat = make([]byte, 0)
+
+	default:
+		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+	}
+	return resp
+}
+
+// --- Announce Logic ---
+
+// A service that cannot be dialed announces itself instead. It dials the
+// Kernel's announce listener and, acting as a 9P client, proves its identity:
+//
+//	Tversion
+//	Tauth  afid uname=<service>   (Kernel generates a nonce)
+//	Tread  afid                   -> 32-byte nonce
+//	Twrite afid <signature>       (Ed25519 over the nonce, by the service's host key)
+//	Tattach afid uname=<service>
+//
+// After Rattach the roles flip: the Kernel is the client and the service
+// serves its tree on the same connection, which is posted as /srv/<service>.
+
+// StartAnnounceServer accepts announcements from the services named in keys.
+func StartAnnounceServer(addr string, keys map[string]ed25519.PublicKey) error {
+	conf, err := TLS.listenConfig(TLS != nil && TLS.ClientAuth)
+	if err != nil {
+		return err
+	}
+	ln, err := listen(addr, conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kernel listening on %s (%s)", addr, listenProto(TLS, "Announce", "Announce over TLS"))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if shuttingDown() {
+				return nil
+			}
+			log.Printf("Accept failed: %v", err)
+			continue
+		}
+		go handleAnnounce(conn, keys)
+	}
+}
+
+// ParseAnnounceKeys parses "name=base64pub,name=base64pub" (ANNOUNCE_KEYS).
+func ParseAnnounceKeys(val string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, b64, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid announce key entry: %s", entry)
+		}
+		b, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid announce key for %s", name)
+		}
+		keys[name] = ed25519.PublicKey(b)
+	}
+	return keys, nil
+}
+
+func handleAnnounce(conn net.Conn, keys map[string]ed25519.PublicKey) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	name, err := acceptAnnounce(conn, keys)
+	if err != nil {
+		log.Printf("Announce from %s rejected: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Flip: from here on the Kernel is the client.
+	c := &Client{
+		addr:    "announce!" + conn.RemoteAddr().String(),
+		conn:    conn,
+		pending: make(map[uint16]chan *p9.Fcall),
+	}
+	done := make(chan struct{})
+	go func() {
+		c.readLoop()
+		close(done)
+	}()
+
+	if _, err := c.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		log.Printf("Announce %s: version failed: %v", name, err)
+		conn.Close()
+		return
+	}
+	Srv.PostConn(name, c)
+
+	<-done // The service hung up
+	Srv.Withdraw(name, c)
+	conn.Close()
+}
+
+// announceMessage is what an announcing service signs: the nonce, bound to
+// the name it announces and kept apart from anything else the key signs.
+func announceMessage(name string, nonce []byte) []byte {
+	return append([]byte("ten-announce\x00"+name), nonce...)
+}
+
+// acceptAnnounce runs the Kernel side of the announce handshake and returns
+// the authenticated service name.
+func acceptAnnounce(conn net.Conn, keys map[string]ed25519.PublicKey) (string, error) {
+	var name string
+	var nonce []byte
+	afid := p9.NOFID
+	verified := false
+
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return "", err
+		}
+		resp := &p9.Fcall{Type: req.Type + 1, Tag: req.Tag}
+
+		switch {
+		case req.Type == p9.Tversion:
+			resp.Msize = req.Msize
+			resp.Version = "9P2000"
+
+		case req.Type == p9.Tauth:
+			if _, ok := keys[req.Uname]; !ok {
+				resp = rError(req, "unknown service: "+req.Uname)
+				break
+			}
+			name, afid, verified = req.Uname, req.Afid, false
+			nonce = make([]byte, 32)
+			rand.Read(nonce)
+			resp.Qid = p9.Qid{Type: p9.QTAUTH}
+
+		// Until a Tauth succeeds there is no nonce and no afid to use
+		case req.Type == p9.Tread && nonce != nil && req.Fid == afid:
+			resp.Data = readAt(nonce, req.Offset, req.Count)
+
+		case req.Type == p9.Twrite && nonce != nil && req.Fid == afid:
+			if key := keys[name]; len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, announceMessage(name, nonce), req.Data) {
+				resp = rError(req, "signature verification failed")
+				break
+			}
+			verified = true
+			resp.Count = req.Count
+
+		case req.Type == p9.Tattach:
+			if !verified || req.Afid != afid || req.Uname != name {
+				resp = rError(req, "permission denied")
+				break
+			}
+			resp.Qid = p9.Qid{Type: p9.QTDIR}
+			b, _ := resp.Bytes()
+			if _, err := conn.Write(b); err != nil {
+				return "", err
+			}
+			return name, nil
+
+		default:
+			resp = rError(req, "announce: unexpected message")
+		}
+
+		b, _ := resp.Bytes()
+		if _, err := conn.Write(b); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Announce dials the Kernel's announce listener and authenticates as name
+// with the host key. On success the caller must serve 9P on the returned conn.
+func Announce(addr, name string, host *HostIdentity) (net.Conn, error) {
+	if host == nil {
+		return nil, fmt.Errorf("announce requires a host key")
+	}
+	conn, err := DialNet(addr, TLS)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	rpc := func(req *p9.Fcall) (*p9.Fcall, error) {
+		b, err := req.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		resp, err := p9.ReadFcall(conn)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+
+	afid := uint32(1)
+	steps := []func() error{
+		func() error {
+			_, err := rpc(&p9.Fcall{Type: p9.Tversion, Tag: p9.NOTAG, Msize: 8192, Version: "9P2000"})
+			return err
+		},
+		func() error {
+			_, err := rpc(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: name, Aname: "announce"})
+			return err
+		},
+		func() error {
+			resp, err := rpc(&p9.Fcall{Type: p9.Tread, Fid: afid, Count: 32})
+			if err != nil {
+				return err
+			}
+			sig := host.Sign(announceMessage(name, resp.Data))
+			_, err = rpc(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: sig, Count: uint32(len(sig))})
+			return err
+		},
+		func() error {
+			_, err := rpc(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: name, Aname: "/"})
+			return err
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("announce failed: %w", err)
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// AnnounceLoop keeps name announced at addr, calling serve for each
+// connection and re-announcing with backoff when it ends.
+func AnnounceLoop(addr, name string, host *HostIdentity, serve func(net.Conn)) {
+	cfg := DefaultRetryConfig()
+	backoff := cfg.InitialBackoff
+	for {
+		conn, err := Announce(addr, name, host)
+		if err != nil {
+			log.Printf("Announce %s to %s: %v", name, addr, err)
+			time.Sleep(backoff)
+			backoff = time.Duration(float64(backoff) * cfg.Multiplier)
+			if backoff > cfg.MaxBackoff {
+				backoff = cfg.MaxBackoff
+			}
+			continue
+		}
+		log.Printf("Announced %s to %s", name, addr)
+		backoff = cfg.InitialBackoff
+		serve(conn)
+	}
+}
+
+// FidView gives one session its own fid space on a connection shared with
+// other sessions, such as an announced service.
+type FidView struct {
+	conn *Client
+	mu   sync.Mutex
+	fids map[uint32]uint32 // session fid -> connection fid
+}
+
+// NewFidView returns a Client whose fids are private to it but whose
+// requests travel over conn.
+func NewFidView(conn *Client) *Client {
+	return &Client{
+		addr: conn.addr,
+		view: &FidView{conn: conn, fids: make(map[uint32]uint32)},
+	}
+}
+
+// RPCContext translates the fids in req and forwards it on the shared connection.
+func (v *FidView) RPCContext(ctx context.Context, req *p9.Fcall) (*p9.Fcall, error) {
+	if req.Type == p9.Tversion {
+		// Versioning would reset the connection for everyone; it was done at announce.
+		return &p9.Fcall{Type: p9.Rversion, Tag: req.Tag, Msize: req.Msize, Version: "9P2000"}, nil
+	}
+
+	fReq := *req
+	var fresh []uint32 // fids allocated for this request
+	v.mu.Lock()
+	lookup := func(fid uint32) uint32 {
+		if fid == p9.NOFID {
+			return p9.NOFID
+		}
+		if remote, ok := v.fids[fid]; ok {
+			return remote
+		}
+		return p9.NOFID // Unknown fid; the service rejects it
+	}
+	alloc := func(fid uint32) uint32 {
+		remote := v.conn.NextFid()
+		v.fids[fid] = remote
+		fresh = append(fresh, fid)
+		return remote
+	}
+	switch req.Type {
+	case p9.Tauth:
+		fReq.Afid = alloc(req.Afid)
+	case p9.Tattach:
+		fReq.Afid = lookup(req.Afid)
+		fReq.Fid = alloc(req.Fid)
+	case p9.Twalk:
+		fReq.Fid = lookup(req.Fid)
+		fReq.Newfid = fReq.Fid
+		if req.Newfid != req.Fid {
+			fReq.Newfid = alloc(req.Newfid)
+		}
+	default:
+		fReq.Fid = lookup(req.Fid)
+	}
+	v.mu.Unlock()
+
+	resp, err := v.conn.RPCContext(ctx, &fReq)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	failed := err != nil || resp.Type == p9.Rerror ||
+		(req.Type == p9.Twalk && len(resp.Wqid) < len(req.Wname))
+	if failed {
+		for _, fid := range fresh {
+			delete(v.fids, fid)
+		}
+	}
+	if req.Type == p9.Tclunk || req.Type == p9.Tremove {
+		delete(v.fids, req.Fid)
+	}
+	if resp != nil {
+		resp.Tag = req.Tag
+	}
+	return resp, err
+}
+
+// Close clunks the view's fids; the shared connection stays up.
+func (v *FidView) Close() error {
+	v.mu.Lock()
+	remote := make([]uint32, 0, len(v.fids))
+	for _, r := range v.fids {
+		remote = append(remote, r)
+	}
+	v.fids = make(map[uint32]uint32)
+	v.mu.Unlock()
+
+	for _, r := range remote {
+		v.conn.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: r})
+	}
+	return nil
+}
+
+// --- Export Logic ---
+
+// A Kernel exports its users' namespaces to peer Kernels, as exportfs does.
+// The importing Kernel dials the export listener and speaks for one of its
+// users by proving its own host key:
+//
+//	Tversion
+//	Tauth  afid uname=<user> aname=<key ID of the importer's host key>
+//	Tread  afid                   -> 32-byte nonce
+//	Twrite afid <signature>       (Ed25519 over importMessage, by the importer's host key)
+//	Tattach fid afid uname=<user> aname=<path>
+//
+// The connection is then an ordinary session whose namespace, unions and
+// Kernel devices included, is cut off at <path>. A peer speaks only for the
+// users listed with its key.
+
+// importMessage is what an importer signs: the nonce, bound to the
+// importer's key ID and kept apart from anything else the host key signs.
+func importMessage(kid string, nonce []byte) []byte {
+	return append([]byte("ten-import\x00"+kid), nonce...)
+}
+
+// ExportPeer is a Kernel allowed to import, and the users it may speak for.
+// "*" is any user but adm, which must be listed by name.
+type ExportPeer struct {
+	Key   ed25519.PublicKey
+	Users map[string]bool
+}
+
+// SpeaksFor reports whether the peer may import user's namespace.
+func (p ExportPeer) SpeaksFor(user string) bool {
+	if user == "" || user == "none" {
+		return false
+	}
+	return p.Users[user] || (p.Users["*"] && user != "adm")
+}
+
+// StartExportServer serves users' namespaces to the peer Kernels in peers.
+func StartExportServer(addr, vfsAddr string, keys *TrustedKeys, host *HostIdentity, dialer Dialer, peers map[string]ExportPeer) error {
+	conf, err := TLS.listenConfig(TLS != nil && TLS.ClientAuth)
+	if err != nil {
+		return err
+	}
+	ln, err := listen(addr, conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kernel listening on %s (%s)", addr, listenProto(TLS, "Export", "Export over TLS"))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if shuttingDown() {
+				return nil
+			}
+			log.Printf("Accept failed: %v", err)
+			continue
+		}
+
+		go func(c net.Conn) {
+			sess := NewSession(&TCPTransport{conn: c}, vfsAddr, keys, host, dialer)
+			sess.peers = peers
+			sess.Serve()
+		}(conn)
+	}
+}
+
+// ParseExportKeys parses "base64pub:user user,base64pub:*" (EXPORT_KEYS),
+// the host keys of the Kernels allowed to import and the users each may
+// speak for, indexed by key ID.
+func ParseExportKeys(val string) (map[string]ExportPeer, error) {
+	peers := make(map[string]ExportPeer)
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		b64, users, _ := strings.Cut(entry, ":")
+		b, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid export key: %s", b64)
+		}
+		peer := ExportPeer{Key: ed25519.PublicKey(b), Users: make(map[string]bool)}
+		for _, user := range strings.Fields(users) {
+			peer.Users[user] = true
+		}
+		if len(peer.Users) == 0 {
+			return nil, fmt.Errorf("export key %s names no users", b64)
+		}
+		peers[KeyID(b)] = peer
+	}
+	return peers, nil
+}
+
+// peerAuth answers a Tread or Twrite on an export listener's afid: the nonce
+// is read from it and the peer's signature over the nonce written back.
+func (s *Session) peerAuth(conv *authConv, req *p9.Fcall) *p9.Fcall {
+	if req.Type == p9.Tread {
+		return &p9.Fcall{Type: p9.Rread, Tag: req.Tag, Data: readAt(conv.nonce, req.Offset, req.Count)}
+	}
+	if !ed25519.Verify(s.peers[conv.peer].Key, importMessage(conv.peer, conv.nonce), req.Data) {
+		s.audit("import_denied", errors.New("signature verification failed"), "peer", conv.peer, "uname", conv.user)
+		return rError(req, "signature verification failed")
+	}
+	conv.finish(&Ticket{User: conv.user})
+	return &p9.Fcall{Type: p9.Rwrite, Tag: req.Tag, Count: uint32(len(req.Data))}
+}
+
+// exportAttach handles Tattach on an export listener. The first attach needs
+// an afid on which the peer answered the host challenge; it builds uname's
+// namespace and roots the session at aname. Later attaches, like the probes
+// the importer makes when it walks across its mount point, land on that root.
+func (s *Session) exportAttach(ctx context.Context, req *p9.Fcall) *p9.Fcall {
+	if root, _ := s.exportRoot(); root != "" {
+		if req.Uname != s.uname() {
+			return rError(req, "auth_user_mismatch")
+		}
+		qid, ename := s.walkRoot(ctx, req.Fid, root)
+		if ename != "" {
+			return rError(req, ename)
+		}
+		return &p9.Fcall{Type: p9.Rattach, Tag: req.Tag, Qid: qid}
+	}
+
+	conv, ok := s.getAuth(req.Afid)
+	if !ok {
+		return rError(req, "auth_required")
+	}
+	ticket := conv.done()
+	if ticket == nil {
+		return rError(req, "auth_incomplete")
+	}
+	if ticket.User != req.Uname {
+		return rError(req, "auth_user_mismatch")
+	}
+	if ticket.User == "" || ticket.User == "none" {
+		return rError(req, "permission denied")
+	}
+
+	manifest, err := fetchNamespaceManifest(s.vfsAddr, s.dialer, s.host)
+	if err != nil {
+		return rError(req, "vfs_unavailable: "+err.Error())
+	}
+	if err := s.admit(ticket.User); err != nil {
+		return rError(req, err.Error())
+	}
+	ns := NewNamespace()
+	if err := ns.Build(manifest, s.dialer); err != nil {
+		return rError(req, "namespace_build_failed: "+err.Error())
+	}
+	s.mountDevices(ns, ticket.User)
+	s.setIdentity(ticket.User, ns)
+	s.mu.Lock()
+	s.attached = time.Now()
+	s.mu.Unlock()
+
+	root := path.Clean("/" + req.Aname)
+	qid, ename := s.walkRoot(ctx, req.Fid, root)
+	if ename != "" {
+		s.audit("export", errors.New(ename), "peer", conv.peer, "path", root)
+		return rError(req, ename)
+	}
+	s.mu.Lock()
+	s.root, s.rootQid = root, qid
+	s.mu.Unlock()
+	s.audit("export", nil, "peer", conv.peer, "path", root)
+	return &p9.Fcall{Type: p9.Rattach, Tag: req.Tag, Qid: qid}
+}
+
+// exportRoot returns the subtree an export session is cut off at, or "" for
+// any other session.
+func (s *Session) exportRoot() (string, p9.Qid) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.root, s.rootQid
+}
+
+// walkRoot attaches fid to the namespace root and walks it down to root.
+func (s *Session) walkRoot(ctx context.Context, fid uint32, root string) (p9.Qid, string) {
+	qid, ename := s.attachRoot(fid)
+	if ename != "" || root == "/" {
+		return qid, ename
+	}
+	names := strings.Split(strings.TrimPrefix(root, "/"), "/")
+	resp := s.handle(ctx, &p9.Fcall{Type: p9.Twalk, Fid: fid, Newfid: fid, Wname: names})
+	if resp.Type == p9.Rerror || len(resp.Wqid) < len(names) {
+		s.handle(ctx, &p9.Fcall{Type: p9.Tclunk, Fid: fid})
+		if resp.Type == p9.Rerror {
+			return p9.Qid{}, resp.Ename
+		}
+		return p9.Qid{}, "not_found: " + root
+	}
+	return resp.Wqid[len(resp.Wqid)-1], ""
+}
+
+// ImportAddrs are the export listeners users other than adm may import
+// from (IMPORT_ADDRS). Import signs with the host key, so it is not offered
+// for arbitrary addresses.
+var ImportAddrs []string
+
+// importAllowed reports whether addr is in ImportAddrs.
+func importAllowed(addr string) bool {
+	for _, a := range ImportAddrs {
+		if convertAddr(a) == convertAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Import dials the export listener of the Kernel at addr and attaches to
+// aname in user's namespace there, answering the host challenge with this
+// Kernel's host key. The returned Client is ready to be mounted.
+func Import(d Dialer, addr, user, aname string, host *HostIdentity) (*Client, error) {
+	if host == nil {
+		return nil, errors.New("import requires a host key")
+	}
+	client, err := d.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+
+	kid := KeyID(host.Key.Public().(ed25519.PublicKey))
+	afid := client.NextFid()
+	steps := []func() error{
+		func() error {
+			_, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+			return err
+		},
+		func() error {
+			_, err := rpcCheck(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: user, Aname: kid})
+			return err
+		},
+		func() error {
+			resp, err := rpcCheck(&p9.Fcall{Type: p9.Tread, Fid: afid, Count: 32})
+			if err != nil {
+				return err
+			}
+			sig := host.Sign(importMessage(kid, resp.Data))
+			_, err = rpcCheck(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: sig, Count: uint32(len(sig))})
+			return err
+		},
+		func() error {
+			// Proves aname exists; sessions attach again as they walk in
+			_, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: user, Aname: aname})
+			return err
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("import failed: %w", err)
+		}
+	}
+	client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 0})
+	client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: afid})
+	return client, nil
+}
+
+// --- Env Logic ---
+
+const (
+	ORCLOSE = 0x40
+	OTRUNC  = 0x10
+)
+
+// EnvFS provides a read/write interface to environment variables.
+// Values are bytes, as on Plan 9: rc stores a list as its elements, each
+// followed by a NUL.
+type EnvFS struct {
+	vars  map[string]string // Variable Name -> Value
+	mu    sync.Mutex
+	store *envStore // persists changes; nil for a shared group
+	refs  int       // connections to a shared group, guarded by EnvGroups.mu
+}
+
+func NewEnvFS() *EnvFS {
+	return &EnvFS{
+		vars: make(map[string]string),
+	}
+}
+
+// envFile is where a user's /env is kept between sessions.
+func envFile(user string) string {
+	return "/usr/" + user + "/lib/env"
+}
+
+// sessionEnv names the variables a session is given at attach. They are
+// never persisted.
+var sessionEnv = map[string]bool{"user": true, "home": true, "sysname": true, "service": true}
+
+// sysname is the Kernel's machine name: SYSNAME, else the host name.
+func sysname() string {
+	if name := os.Getenv("SYSNAME"); name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// NewEnvClient serves a session's /env. It starts from the variables saved
+// in the user's envFile, overlaid with user, home, sysname and service, and
+// saves every change back. Sessions attached as none keep nothing.
+func NewEnvClient(s *Session, user string) *Client {
+	c1, c2 := net.Pipe()
+	fs := NewEnvFS()
+
+	if user != "" && user != "none" {
+		path := envFile(user)
+		data, err := readKernelFile(s.vfsAddr, s.dialer, s.host, path, 0)
+		if err != nil {
+			log.Printf("Env: read %s: %v", path, err)
+		}
+		for name, val := range ParseEnv(data) {
+			if !sessionEnv[name] {
+				fs.vars[name] = val
+			}
+		}
+		fs.store = newEnvStore(s.vfsAddr, s.dialer, s.host, user)
+	}
+	service, _, _ := strings.Cut(s.transport, "!")
+	fs.vars["user"] = user
+	fs.vars["home"] = "/usr/" + user
+	fs.vars["sysname"] = sysname()
+	fs.vars["service"] = service
+
+	go fs.Serve(c2)
+
+	return &Client{
+		addr: "internal!env",
+		conn: c1,
+		tag:  1,
+	}
+}
+
+// changed hands a new value, or a removal, to the store. Caller holds fs.mu.
+func (fs *EnvFS) changed(name string) {
+	if fs.store == nil || sessionEnv[name] {
+		return
+	}
+	if val, ok := fs.vars[name]; ok {
+		fs.store.Set(name, &val)
+	} else {
+		fs.store.Set(name, nil)
+	}
+}
+
+// ParseEnv parses an envFile: one "name=<Go-quoted value>" per line.
+// Malformed lines are skipped.
+func ParseEnv(data string) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(data, "\n") {
+		name, quoted, ok := strings.Cut(line, "=")
+		if !ok || name == "" {
+			continue
+		}
+		val, err := strconv.Unquote(quoted)
+		if err != nil {
+			continue
+		}
+		vars[name] = val
+	}
+	return vars
+}
+
+// FormatEnv is the inverse of ParseEnv, in name order.
+func FormatEnv(vars map[string]string) string {
+	var sb strings.Builder
+	for _, name := range sortedKeys(vars) {
+		fmt.Fprintf(&sb, "%s=%s\n", name, strconv.Quote(vars[name]))
+	}
+	return sb.String()
+}
+
+// envStore writes a user's /env changes back to VFS behind the session,
+// merging them into the file one variable at a time so that concurrent
+// sessions do not undo each other's changes.
+type envStore struct {
+	vfsAddr string
+	dialer  Dialer
+	host    *HostIdentity
+	user    string
+	path    string // envFile(user)
+
+	mu      sync.Mutex
+	pending map[string]*string // name -> new value; nil removes it
+	busy    bool               // a flush is running
+}
+
+// envFiles serializes the read-modify-write of every envFile.
+var envFiles sync.Mutex
+
+func newEnvStore(vfsAddr string, d Dialer, host *HostIdentity, user string) *envStore {
+	return &envStore{vfsAddr: vfsAddr, dialer: d, host: host, user: user, path: envFile(user), pending: make(map[string]*string)}
+}
+
+// Set queues a change and starts a flush if none is running.
+func (st *envStore) Set(name string, val *string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pending[name] = val
+	if !st.busy {
+		st.busy = true
+		go st.flush()
+	}
+}
+
+func (st *envStore) flush() {
+	for {
+		st.mu.Lock()
+		if len(st.pending) == 0 {
+			st.busy = false
+			st.mu.Unlock()
+			return
+		}
+		batch := st.pending
+		st.pending = make(map[string]*string)
+		st.mu.Unlock()
+
+		if err := st.merge(batch); err != nil {
+			log.Printf("Env: save %s: %v", st.path, err)
+		}
+	}
+}
+
+func (st *envStore) merge(batch map[string]*string) error {
+	envFiles.Lock()
+	defer envFiles.Unlock()
+	data, err := readKernelFile(st.vfsAddr, st.dialer, st.host, st.path, 0)
+	if err != nil {
+		return err
+	}
+	vars := ParseEnv(data)
+	for name, val := range batch {
+		if val == nil {
+			delete(vars, name)
+		} else {
+			vars[name] = *val
+		}
+	}
+	data = FormatEnv(vars)
+	err = writeKernelFile(st.vfsAddr, st.dialer, st.host, st.path, []byte(data))
+	if errors.Is(err, errNoDir) {
+		// /usr/$user/lib went missing since login; put it back
+		Homes.Forget(st.user)
+		if _, err = Homes.Provision(st.vfsAddr, st.dialer, st.host, st.user); err != nil {
+			return err
+		}
+		err = writeKernelFile(st.vfsAddr, st.dialer, st.host, st.path, []byte(data))
+	}
+	return err
+}
+
+// EnvGroupTable holds the shared environment groups, one per user, like
+// Plan 9's #e shared by the processes of an environment group. A session
+// mounts its user's group with "mount #e <path>" in /dev/sys/ctl. A group
+// lives in memory while any session has it mounted.
+type EnvGroupTable struct {
+	mu     sync.Mutex
+	groups map[string]*EnvFS
+}
+
+var EnvGroups = &EnvGroupTable{
+	groups: make(map[string]*EnvFS),
+}
+
+// Dial connects to user's group, creating it with user, home and sysname set.
+func (t *EnvGroupTable) Dial(user string) *Client {
+	t.mu.Lock()
+	fs, ok := t.groups[user]
+	if !ok {
+		fs = NewEnvFS()
+		fs.vars["user"] = user
+		fs.vars["home"] = "/usr/" + user
+		fs.vars["sysname"] = sysname()
+		t.groups[user] = fs
+	}
+	fs.refs++
+	t.mu.Unlock()
+
+	c1, c2 := net.Pipe()
+	go func() {
+		fs.Serve(c2)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if fs.refs--; fs.refs == 0 && t.groups[user] == fs {
+			delete(t.groups, user)
+		}
+	}()
+	return &Client{
+		addr: "internal!env!" + user,
+		conn: c1,
+		tag:  1,
+	}
+}
+
+func (fs *EnvFS) Serve(conn net.Conn) {
+	defer conn.Close()
+	// Track open FIDs
+	fids := make(map[uint32]*envFid)
+
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+
+		resp := fs.handle(req, fids)
+		resp.Tag = req.Tag
+
+		b, _ := resp.Bytes()
+		conn.Write(b)
+	}
+}
+
+type envFid struct {
+	path   string // "/" or "/VARNAME"
+	isOpen bool
+	mode   uint8
+}
+
+func (fs *EnvFS) handle(req *p9.Fcall, fids map[uint32]*envFid) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = req.Msize
+		resp.Version = "9P2000"
+
+	case p9.Tattach:
+		fids[req.Fid] = &envFid{path: "/"}
+		resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
+
+	case p9.Twalk:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		wqids := []p9.Qid{}
+		currPath := fid.path
+
+		for _, name := range req.Wname {
+			if name == ".." {
+				currPath = "/"
+				wqids = append(wqids, p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0})
+				continue
+			}
+
+			// Only 1 level deep
+			if currPath != "/" {
+				return rError(req, "not found")
+			}
+
+			// Variable exists?
+			if _, exists := fs.vars[name]; exists {
+				// It exists
+				wqids = append(wqids, p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)})
+				currPath = "/" + name
+			} else {
+				// We allow walking to non-existent if we are going to create it?
+				// No, 9P Walk fails if not found.
+				// But Tcreate requires walking to parent first.
+				// Wait, to Create /env/foo, we Walk to /env (which we are at), then Tcreate "foo".
+				// So we don't need to Walk to "foo" unless it exists.
+				return rError(req, "not found")
+			}
+		}
+
+		if len(wqids) == len(req.Wname) {
+			fids[req.Newfid] = &envFid{path: currPath}
+			resp.Wqid = wqids
+		} else {
+			// Partial walk?
+			// Since we checked existence, this logic implies complete success or immediate fail.
+		}
+
+	case p9.Topen:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		if fid.path == "/" {
+			if req.Mode&3 != 0 && req.Mode&3 != 3 { // OREAD or OEXEC only
+				return rError(req, "permission denied")
+			}
+			resp.Qid = p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
+		} else {
+			// File
+			name := fid.path[1:]
+			if _, exists := fs.vars[name]; !exists {
+				// It might have been deleted?
+				return rError(req, "not found")
+			}
+			if req.Mode&ORCLOSE != 0 {
+				// ORCLOSE not supported on root, handled in remove?
+				// Standard says remove on clunk if ORCLOSE.
+				// Ignoring for MVP simple env.
+			}
+			if req.Mode&OTRUNC != 0 {
+				fs.vars[name] = ""
+				fs.changed(name)
+			}
+			resp.Qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
+		}
+		fid.isOpen = true
+		fid.mode = req.Mode
+		resp.Iounit = 8192
+
+	case p9.Tcreate:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if fid.path != "/" {
+			return rError(req, "not a directory")
+		}
+
+		// Create variable
+		name := req.Name
+		if name == "" || name == "." || name == ".." {
+			return rError(req, "invalid name")
+		}
+		fs.vars[name] = ""
+		fs.changed(name)
+
+		// Update FID to point to new file
+		fid.path = "/" + name
+		fid.isOpen = true
+		fid.mode = req.Mode
+		resp.Qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
+		resp.Iounit = 8192
+
+	case p9.Tread:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if !fid.isOpen {
+			return rError(req, "file not open")
+		}
+
+		var content []byte
+		if fid.path == "/" {
+			// List directory
+			for name := range fs.vars {
+				d := p9.Dir{
+					Qid:    p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)},
+					Mode:   0644,
+					Name:   name,
+					Length: uint64(len(fs.vars[name])),
+					Uid:    "sys",
+					Gid:    "sys",
+					Muid:   "sys",
+					Atime:  uint32(time.Now().Unix()),
+					Mtime:  uint32(time.Now().Unix()),
+				}
+				content = append(content, d.Bytes()...)
+			}
+		} else {
+			name := fid.path[1:]
+			val, exists := fs.vars[name]
+			if !exists {
+				return rError(req, "not found")
+			}
+			content = []byte(val)
+		}
+
+		if req.Offset >= uint64(len(content)) {
+			resp.Data = []byte{}
+		} else {
+			end := int(req.Offset) + int(req.Count)
+			if end > len(content) {
+				end = len(content)
+			}
+			resp.Data = content[req.Offset:end]
+		}
+
+	case p9.Twrite:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if !fid.isOpen {
+			return rError(req, "file not open")
+		}
+		if fid.path == "/" {
+			return rError(req, "is a directory")
+		}
+
+		name := fid.path[1:]
+		if _, exists := fs.vars[name]; !exists {
+			return rError(req, "not found")
+		}
+
+		// Simple overwrite or append?
+		// Usually environment writes are small and atomic-ish.
+		// We'll support append via offsets, but simplest is just replacing string.
+		// If Offset == 0, replace? Or just patch?
+		// To allow `echo val > file` (truncates) vs `echo val >> file`.
+
+		// The shell handles truncation by opening with OTRUNC.
+		// If we are here, we just modify the buffer at offset.
+
+		val := []byte(fs.vars[name])
+		off := int(req.Offset)
+		data := req.Data
+
+		// Grow if needed
+		if off+len(data) > len(val) {
+			newVal := make([]byte, off+len(data))
+			copy(newVal, val)
+			val = newVal
+		}
+		copy(val[off:], data)
+		fs.vars[name] = string(val)
+		fs.changed(name)
+		resp.Count = uint32(len(data))
+
+	case p9.Tremove:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if fid.path != "/" {
+			name := fid.path[1:]
+			delete(fs.vars, name)
+			fs.changed(name)
+		}
+		delete(fids, req.Fid)
+		resp.Type = p9.Rremove
+
+	case p9.Tclunk:
+		delete(fids, req.Fid)
+		resp.Type = p9.Rclunk
+
+	case p9.Tstat:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+
+		// Stat logic...
+		// Minimal
+		name := "env"
+		qid := p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
+		mode := uint32(p9.DMDIR | 0755)
+		length := uint64(0)
+
+		if fid.path != "/" {
+			name = fid.path[1:]
+			qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
+			mode = 0644
+			if v, ok := fs.vars[name]; ok {
+				length = uint64(len(v))
+			}
+		}
+
+		d := p9.Dir{
+			Qid:    qid,
+			Mode:   mode,
+			Name:   name,
+			Length: length,
+			Uid:    "sys",
+			Gid:    "sys",
+			Muid:   "sys",
+			Atime:  uint32(time.Now().Unix()),
+			Mtime:  uint32(time.Now().Unix()),
+		}
+		resp.Stat = d.Bytes()
+
+	default:
+		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+	}
+
+	return resp
+}
+
+func hashPath(s string) uint64 {
+	h := uint64(0)
+	for i := 0; i < len(s); i++ {
+		h = 31*h + uint64(s[i])
+	}
+	return h
+}
+
+// --- Tmp Logic ---
+
+// TmpSize caps the bytes of file data a session's /tmp may hold; TMP_SIZE
+// sets it.
+var TmpSize = 16 << 20
+
+// RamFS is an in-memory file tree, like Plan 9's ramfs. Every session
+// mounts its own at /tmp; it is discarded with the session's namespace.
+type RamFS struct {
+	mu    sync.Mutex
+	root  *ramFile
+	owner string
+	size  int    // bytes of file data held
+	max   int    // cap on size
+	path  uint64 // last qid.path handed out
+}
+
+type ramFile struct {
+	qid      p9.Qid
+	name     string
+	mode     uint32
+	mtime    uint32
+	data     []byte
+	parent   *ramFile            // the root is its own parent
+	children map[string]*ramFile // nil for a file
+}
+
+type ramFid struct {
+	file   *ramFile
+	isOpen bool
+	mode   uint8
+}
+
+func NewRamFS(owner string, max int) *RamFS {
+	fs := &RamFS{owner: owner, max: max}
+	fs.root = &ramFile{
+		qid:      p9.Qid{Type: p9.QTDIR},
+		name:     "/",
+		mode:     p9.DMDIR | 0777,
+		mtime:    uint32(time.Now().Unix()),
+		children: make(map[string]*ramFile),
+	}
+	fs.root.parent = fs.root
+	return fs
+}
+
+// NewTmpClient serves a fresh RamFS, owned by user and capped at TmpSize.
+func NewTmpClient(user string) *Client {
+	c1, c2 := net.Pipe()
+	fs := NewRamFS(user, TmpSize)
+	go fs.Serve(c2)
+	return &Client{
+		addr: "internal!tmp",
+		conn: c1,
+		tag:  1,
+	}
+}
+
+func (fs *RamFS) Serve(conn net.Conn) {
+	defer conn.Close()
+	fids := make(map[uint32]*ramFid)
+
+	for {
+		req, err := p9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+
+		resp := fs.handle(req, fids)
+		resp.Tag = req.Tag
+
+		b, _ := resp.Bytes()
+		conn.Write(b)
+	}
+}
+
+// stat is f's directory entry.
+func (fs *RamFS) stat(f *ramFile) p9.Dir {
+	return p9.Dir{
+		Qid:    f.qid,
+		Mode:   f.mode,
+		Atime:  f.mtime,
+		Mtime:  f.mtime,
+		Length: uint64(len(f.data)),
+		Name:   f.name,
+		Uid:    fs.owner,
+		Gid:    fs.owner,
+		Muid:   fs.owner,
+	}
+}
+
+// resize sets the length of f's data, failing if the tree would outgrow its
+// cap. Caller holds fs.mu.
+func (fs *RamFS) resize(f *ramFile, n int) error {
+	if grow := n - len(f.data); grow > 0 && fs.size+grow > fs.max {
+		return fmt.Errorf("file system full")
+	}
+	fs.size += n - len(f.data)
+	if n <= cap(f.data) {
+		f.data = f.data[:n]
+	} else {
+		data := make([]byte, n)
+		copy(data, f.data)
+		f.data = data
+	}
+	return nil
+}
+
+// touch records a change to f's contents. Caller holds fs.mu.
+func touch(f *ramFile) {
+	f.qid.Vers++
+	f.mtime = uint32(time.Now().Unix())
+}
+
+// remove unlinks f from its directory. Caller holds fs.mu.
+func (fs *RamFS) remove(f *ramFile) error {
+	if f == fs.root {
+		return fmt.Errorf("permission denied")
+	}
+	if len(f.children) > 0 {
+		return fmt.Errorf("directory not empty")
+	}
+	fs.size -= len(f.data)
+	delete(f.parent.children, f.name)
+	touch(f.parent)
+	return nil
+}
+
+func (fs *RamFS) handle(req *p9.Fcall, fids map[uint32]*ramFid) *p9.Fcall {
+	resp := &p9.Fcall{Type: req.Type + 1}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch req.Type {
+	case p9.Tversion:
+		resp.Msize = req.Msize
+		resp.Version = "9P2000"
+
+	case p9.Tattach:
+		fids[req.Fid] = &ramFid{file: fs.root}
+		resp.Qid = fs.root.qid
+
+	case p9.Twalk:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if fid.isOpen {
+			return rError(req, "fid is open")
+		}
+
+		wqids := []p9.Qid{}
+		f := fid.file
+		for _, name := range req.Wname {
+			next := f.parent
+			if name != ".." {
+				if next = f.children[name]; next == nil {
+					break
+				}
+			}
+			f = next
+			wqids = append(wqids, f.qid)
+		}
+		if len(wqids) == 0 && len(req.Wname) > 0 {
+			return rError(req, "not found")
+		}
+		if len(wqids) == len(req.Wname) {
+			fids[req.Newfid] = &ramFid{file: f}
+		}
+		resp.Wqid = wqids
+
+	case p9.Topen:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		f := fid.file
+		if f.children != nil && req.Mode&3 != p9.OREAD && req.Mode&3 != p9.OEXEC {
+			return rError(req, "is a directory")
+		}
+		if req.Mode&OTRUNC != 0 && f.children == nil && f.mode&p9.DMAPPEND == 0 {
+			fs.resize(f, 0)
+			touch(f)
+		}
+		fid.isOpen = true
+		fid.mode = req.Mode
+		resp.Qid = f.qid
+		resp.Iounit = 8192
+
+	case p9.Tcreate:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		dir := fid.file
+		if dir.children == nil {
+			return rError(req, "not a directory")
+		}
+		name := req.Name
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return rError(req, "invalid name")
+		}
+		if _, exists := dir.children[name]; exists {
+			return rError(req, "file exists")
+		}
+
+		fs.path++
+		f := &ramFile{
+			qid:    p9.Qid{Type: uint8(req.Perm >> 24), Path: fs.path},
+			name:   name,
+			mode:   req.Perm,
+			mtime:  uint32(time.Now().Unix()),
+			parent: dir,
+		}
+		if req.Perm&p9.DMDIR != 0 {
+			f.children = make(map[string]*ramFile)
+		}
+		dir.children[name] = f
+		touch(dir)
+
+		fid.file = f
+		fid.isOpen = true
+		fid.mode = req.Mode
+		resp.Qid = f.qid
+		resp.Iounit = 8192
+
+	case p9.Tread:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if !fid.isOpen {
+			return rError(req, "file not open")
+		}
+
+		content := fid.file.data
+		if fid.file.children != nil {
+			content = nil
+			for _, name := range sortedKeys(fid.file.children) {
+				d := fs.stat(fid.file.children[name])
+				content = append(content, d.Bytes()...)
+			}
+		}
+
+		if req.Offset >= uint64(len(content)) {
+			resp.Data = []byte{}
+		} else {
+			end := min(req.Offset+uint64(req.Count), uint64(len(content)))
+			resp.Data = append([]byte(nil), content[req.Offset:end]...)
+		}
+
+	case p9.Twrite:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		if !fid.isOpen || fid.mode&3 == p9.OREAD {
+			return rError(req, "file not open for writing")
+		}
+		f := fid.file
+		// Checked before converting, so a huge offset cannot wrap int
+		if f.mode&p9.DMAPPEND == 0 && req.Offset > uint64(fs.max) {
+			return rError(req, "file system full")
+		}
+		off := int(req.Offset)
+		if f.mode&p9.DMAPPEND != 0 {
+			off = len(f.data)
+		}
+		if end := off + len(req.Data); end > len(f.data) {
+			if err := fs.resize(f, end); err != nil {
+				return rError(req, err.Error())
+			}
+		}
+		copy(f.data[off:], req.Data)
+		touch(f)
+		resp.Count = uint32(len(req.Data))
+
+	case p9.Tremove:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		delete(fids, req.Fid)
+		if err := fs.remove(fid.file); err != nil {
+			return rError(req, err.Error())
+		}
+
+	case p9.Tclunk:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		delete(fids, req.Fid)
+		if fid.isOpen && fid.mode&ORCLOSE != 0 {
+			fs.remove(fid.file)
+		}
+
+	case p9.Tstat:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		d := fs.stat(fid.file)
+		resp.Stat = d.Bytes()
+
+	case p9.Twstat:
+		fid, ok := fids[req.Fid]
+		if !ok {
+			return rError(req, "fid not found")
+		}
+		d, _, err := p9.UnmarshalDir(req.Stat)
+		if err != nil {
+			return rError(req, "invalid stat data")
+		}
+		f := fid.file
+		if d.Name != "" && d.Name != f.name {
+			if f == fs.root || strings.Contains(d.Name, "/") || d.Name == "." || d.Name == ".." {
+				return rError(req, "invalid name")
+			}
+			if _, exists := f.parent.children[d.Name]; exists {
+				return rError(req, "file exists")
+			}
+		}
+		if d.Length != ^uint64(0) && d.Length != uint64(len(f.data)) {
+			if f.children != nil || f.mode&p9.DMAPPEND != 0 {
+				return rError(req, "cannot change length")
+			}
+			if d.Length > uint64(fs.max) {
+				return rError(req, "file system full")
+			}
+			if err := fs.resize(f, int(d.Length)); err != nil {
+				return rError(req, err.Error())
+			}
+			touch(f)
+		}
+		if d.Name != "" && d.Name != f.name {
+			delete(f.parent.children, f.name)
+			f.name = d.Name
+			f.parent.children[f.name] = f
+		}
+		if d.Mode != ^uint32(0) {
+			f.mode = f.mode&(p9.DMDIR|p9.DMAPPEND) | d.Mode&0777
+		}
+		if d.Mtime != ^uint32(0) {
+			f.mtime = d.Mtime
+		}
+
+	default:
+		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+	}
+
+	return resp
+}
+
+// --- Home Logic ---
+
+// homeDirs are created in /usr/<user> on the user's first login.
+var homeDirs = []string{"lib", "tmp", "bin", "bin/rc"}
+
+// HomeTable remembers the users whose home directories are known to exist,
+// so only a user's first login after the Kernel starts touches VFS.
+type HomeTable struct {
+	mu   sync.Mutex
+	done map[string]bool
+	busy map[string]chan struct{} // closed when the running Provision for a user ends
+}
+
+var Homes = &HomeTable{
+	done: make(map[string]bool),
+	busy: make(map[string]chan struct{}),
+}
+
+// Forget makes the next Provision for user look at VFS again.
+func (t *HomeTable) Forget(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.done, user)
+}
+
+// Provision makes sure /usr/<user> and its homeDirs exist in VFS, creating
+// what is missing owned by user. It reports whether anything was created.
+// Logins of one user wait for each other; other users' do not.
+func (t *HomeTable) Provision(vfsAddr string, d Dialer, host *HostIdentity, user string) (bool, error) {
+	if user == "" || user == "none" || user == "." || user == ".." || strings.Contains(user, "/") {
+		return false, fmt.Errorf("bad user name: %q", user)
+	}
+	t.mu.Lock()
+	for !t.done[user] && t.busy[user] != nil {
+		busy := t.busy[user]
+		t.mu.Unlock()
+		<-busy
+		t.mu.Lock()
+	}
+	if t.done[user] {
+		t.mu.Unlock()
+		return false, nil
+	}
+	busy := make(chan struct{})
+	t.busy[user] = busy
+	t.mu.Unlock()
+
+	created, err := provisionHome(vfsAddr, d, host, user)
+
+	t.mu.Lock()
+	if err == nil {
+		t.done[user] = true
+	}
+	delete(t.busy, user)
+	t.mu.Unlock()
+	close(busy)
+	return created, err
+}
+
+// provisionHome does the work of Provision.
+func provisionHome(vfsAddr string, d Dialer, host *HostIdentity, user string) (bool, error) {
+	client, err := d.Dial(vfsAddr)
+	if err != nil {
+		return false, fmt.Errorf("dial_vfs_failed: %w", err)
+	}
+	defer client.Close()
+
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		return false, err
+	}
+	afid, err := HostAuthHandshake(client, host)
+	if err != nil {
+		afid = p9.NOFID
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: "kernel", Aname: "/"}); err != nil {
+		return false, err
+	}
+
+	// Parents come before their children
+	dirs := []string{"usr", "usr/" + user}
+	for _, dir := range homeDirs {
+		dirs = append(dirs, "usr/"+user+"/"+dir)
+	}
+	owner := p9.Dir{Mode: 0xFFFFFFFF, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF, Length: 0xFFFFFFFFFFFFFFFF, Uid: user, Gid: user}
+
+	created := false
+	for _, dir := range dirs {
+		wname := strings.Split(dir, "/")
+		if resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: wname}); err == nil && len(resp.Wqid) == len(wname) {
+			client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+			continue
+		}
+		parent := wname[:len(wname)-1]
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: parent}); err != nil {
+			return created, err
+		}
+		// Tcreate leaves fid 1 open on the new directory
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: wname[len(wname)-1], Perm: p9.DMDIR | 0775, Mode: p9.OREAD}); err != nil {
+			client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+			return created, fmt.Errorf("create /%s: %w", dir, err)
+		}
+		created = true
+		if dir != "usr" {
+			if _, err := rpcCheck(&p9.Fcall{Type: p9.Twstat, Fid: 1, Stat: owner.Bytes()}); err != nil {
+				client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+				return created, fmt.Errorf("chown /%s: %w", dir, err)
+			}
+		}
+		client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+	}
+	return created, nil
+}
+
+// --- PLACEHOLDER: UTILS & AUTH ---
+
+// --- Auth & Host Identity ---
+
+// HostIdentity represents the kernel's identity for signing and auth.
+type HostIdentity struct {
+	Key ed25519.PrivateKey
+}
+
+// LoadHostIdentity loads the host identity from environment or disk.
+func LoadHostIdentity() (*HostIdentity, error) {
+	val := os.Getenv("HOST_KEY_BASE64")
+	if val == "" {
+		return nil, fmt.Errorf("HOST_KEY_BASE64 env var not set")
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 HOST_KEY_BASE64: %w", err)
+	}
+
+	if len(keyBytes) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid key length: want %d, got %d", ed25519.PrivateKeySize, len(keyBytes))
+	}
+
+	return &HostIdentity{Key: ed25519.PrivateKey(keyBytes)}, nil
+}
+
+// Sign signs the given data with the host key.
+func (h *HostIdentity) Sign(data []byte) []byte {
+	return ed25519.Sign(h.Key, data)
+}
+
+// HostAuthContext prefixes the nonce a host signs to authenticate to VFS or
+// Factotum (see vfs.HostAuthContext and factotum.HostAuthContext).
+const HostAuthContext = "ten-host\x00"
+
+// HostAuthHandshake performs the Tauth -> Tread(nonce) -> Twrite(sig) ceremony.
+// Returns the authenticated afid, or NOFID if auth failed/not attempted.
+func HostAuthHandshake(client *Client, host *HostIdentity) (uint32, error) {
+	if host == nil {
+		return p9.NOFID, nil
+	}
+
+	afid := uint32(100) // Reserved range for internal auth?
+
+	// Helper to reduce boilerplate
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+
+	// 1. Tauth
+	_, err := rpcCheck(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: "kernel", Aname: "/"})
+	if err != nil {
+		// Log warning but allow proceeding (maybe VFS has auth disabled?)
+		// But if auth is required later, it will fail then.
+		log.Printf("Boot Warning: Tauth failed: %v", err)
+		return p9.NOFID, nil
+	}
+
+	// 2. Read Nonce (32 bytes)
+	rResp, err := rpcCheck(&p9.Fcall{Type: p9.Tread, Fid: afid, Offset: 0, Count: 32})
+	if err != nil {
+		return p9.NOFID, fmt.Errorf("auth_read_nonce_failed: %w", err)
+	}
+	nonce := rResp.Data
+
+	// 3. Sign Nonce
+	sig := host.Sign(append([]byte(HostAuthContext), nonce...))
+
+	// 4. Write Signature
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: sig, Count: uint32(len(sig))}); err != nil {
+		return p9.NOFID, fmt.Errorf("auth_write_sig_failed: %w", err)
+	}
+	return afid, nil
+}
+
+// --- TLS Logic ---
+
+// TLSSettings configures TLS on the Kernel's listeners and on tls!host!port
+// dials. A peer is trusted if its certificate chains to Roots or carries one
+// of the pinned Ed25519 keys, so services can present certificates derived
+// from their host keys without a CA.
+type TLSSettings struct {
+	Cert       *tls.Certificate    // served by listeners, presented when dialing
+	Roots      *x509.CertPool      // CAs for peer certificates; nil means the system pool
+	Pins       []ed25519.PublicKey // peer keys trusted without a CA
+	ClientAuth bool                // TCP listeners require client certificates (mutual TLS)
+}
+
+// TLS is the Kernel's TLS configuration. Nil serves plaintext and dials
+// tls! addresses against the system roots.
+var TLS *TLSSettings
+
+// LoadTLSSettings reads TLS configuration from the environment:
+//
+//	TLS_CERT, TLS_KEY  PEM certificate and key; TLS_CERT=host derives a
+//	                   self-signed certificate from the host key
+//	TLS_CA             PEM file of CAs trusted for peers
+//	TLS_PINS           comma-separated base64 Ed25519 keys trusted for peers
+//	TLS_CLIENT_AUTH    "require" to demand client certificates
+//
+// It returns nil if none is set.
+func LoadTLSSettings(host *HostIdentity) (*TLSSettings, error) {
+	certPath, keyPath := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	caPath, pins := os.Getenv("TLS_CA"), os.Getenv("TLS_PINS")
+	clientAuth := os.Getenv("TLS_CLIENT_AUTH")
+	if certPath == "" && caPath == "" && pins == "" && clientAuth == "" {
+		return nil, nil
+	}
+
+	t := &TLSSettings{}
+	switch {
+	case certPath == "host":
+		if host == nil {
+			return nil, fmt.Errorf("TLS_CERT=host needs HOST_KEY_BASE64")
+		}
+		cert, err := host.Certificate()
+		if err != nil {
+			return nil, err
+		}
+		t.Cert = &cert
+	case certPath != "":
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_CERT/TLS_KEY: %w", err)
+		}
+		t.Cert = &cert
+	}
+
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_CA: %w", err)
+		}
+		t.Roots = x509.NewCertPool()
+		if !t.Roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid TLS_CA: no certificates in %s", caPath)
+		}
+	}
+
+	for _, b64 := range strings.Split(pins, ",") {
+		if b64 = strings.TrimSpace(b64); b64 == "" {
+			continue
+		}
+		if err := t.Pin(b64); err != nil {
+			return nil, fmt.Errorf("invalid TLS_PINS: %w", err)
+		}
+	}
+
+	switch clientAuth {
+	case "":
+	case "require":
+		t.ClientAuth = true
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH: %q", clientAuth)
+	}
+	return t, nil
+}
+
+// Pin trusts the base64 Ed25519 public key b64 for peer certificates.
+func (t *TLSSettings) Pin(b64 string) error {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("bad ed25519 key %q", b64)
+	}
+	t.Pins = append(t.Pins, ed25519.PublicKey(b))
+	return nil
+}
+
+// ServerConfig is the configuration for a TLS listener. Client certificates
+// are required and verified if ClientAuth is set, which needs Roots or Pins:
+// the system roots would admit any publicly issued client certificate.
+func (t *TLSSettings) ServerConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.Cert != nil {
+		cfg.Certificates = []tls.Certificate{*t.Cert}
+	}
+	if t.ClientAuth {
+		if t.Roots == nil && len(t.Pins) == 0 {
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH=require needs TLS_CA or TLS_PINS")
+		}
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = t.verifyPeer("", x509.ExtKeyUsageClientAuth)
+	}
+	return cfg, nil
+}
+
+// ClientConfig is the configuration for dialing serverName. The certificate,
+// if any, is presented for mutual TLS. A nil t verifies against the system
+// roots only.
+func (t *TLSSettings) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if t == nil {
+		return cfg
+	}
+	if t.Cert != nil {
+		cfg.Certificates = []tls.Certificate{*t.Cert}
+	}
+	// Verify ourselves so pinned self-signed certificates are accepted
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = t.verifyPeer(serverName, x509.ExtKeyUsageServerAuth)
+	return cfg
+}
+
+// listenConfig is the configuration for a Kernel listener, or nil to serve
+// plaintext. Browsers have no client certificates, so the WebSocket
+// listener passes clientAuth false.
+func (t *TLSSettings) listenConfig(clientAuth bool) (*tls.Config, error) {
+	if t == nil || t.Cert == nil {
+		return nil, nil
+	}
+	if !clientAuth {
+		cfg := *t
+		cfg.ClientAuth = false
+		return cfg.ServerConfig()
+	}
+	return t.ServerConfig()
+}
+
+// verifyPeer checks a peer's certificates against the pins, then the roots;
+// with pins but no Roots, only pinned certificates pass. serverName is empty
+// when verifying clients.
+func (t *TLSSettings) verifyPeer(serverName string, usage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("tls: no peer certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("tls: bad peer certificate: %w", err)
+			}
+			certs[i] = c
+		}
+		leaf := certs[0]
+
+		// The handshake proved the peer holds the leaf's key
+		if pub, ok := leaf.PublicKey.(ed25519.PublicKey); ok {
+			for _, pin := range t.Pins {
+				if pub.Equal(pin) {
+					if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+						return fmt.Errorf("tls: pinned certificate %s expired", KeyID(pub))
+					}
+					return nil
+				}
+			}
+		}
+		// Nil Roots would mean the system pool, which pins alone must not widen
+		if t.Roots == nil && len(t.Pins) > 0 {
+			return fmt.Errorf("tls: peer certificate not pinned")
+		}
+
+		inter := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			inter.AddCert(c)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         t.Roots,
+			Intermediates: inter,
+			DNSName:       serverName,
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		})
+		return err
+	}
+}
+
+// Certificate returns a self-signed TLS certificate for the host key, valid
+// for a year. Peers trust it by pinning the Ed25519 key rather than a CA.
+func (h *HostIdentity) Certificate() (tls.Certificate, error) {
+	pub := h.Key.Public().(ed25519.PublicKey)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ten host " + KeyID(pub)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, h.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: h.Key}, nil
+}
+
+// DialNet connects to a Plan 9 address: tcp!host!port, tls!host!port or
+// host:port. tls! addresses are dialed with t's client configuration.
+func DialNet(addr string, t *TLSSettings) (net.Conn, error) {
+	rest, ok := strings.CutPrefix(addr, "tls!")
+	if !ok {
+		return net.Dial("tcp", convertAddr(addr))
+	}
+	hostport := strings.Replace(rest, "!", ":", 1)
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", hostport, t.ClientConfig(host))
+}
+
+// --- Ticket Logic ---
+
+// Ticket represents a verified session token.
+type Ticket struct {
+	User   string
+	Expiry time.Time
+	Nonce  string
+}
+
+// TrustedKeys are the Factotum signing keys tickets may be signed with,
+// by key ID. After a rotation the previous keys stay trusted until their
+// grace period ends, so tickets issued before the rotation keep working.
+// The key from SIGNING_KEY_PATH is the root of trust: Refresh accepts a new
+// key only if it is endorsed through Factotum's chain by an unexpired
+// trusted key, so the root stops endorsing once it is retired and expires.
+type TrustedKeys struct {
+	mu   sync.RWMutex
+	keys map[string]trustedKey
+}
+
+type trustedKey struct {
+	pub   ed25519.PublicKey
+	until time.Time // zero for the current key
+}
+
+// NewTrustedKeys trusts pub, which may be nil, as the root key.
+func NewTrustedKeys(pub ed25519.PublicKey) *TrustedKeys {
+	k := &TrustedKeys{keys: make(map[string]trustedKey)}
+	if len(pub) == ed25519.PublicKeySize {
+		k.keys[KeyID(pub)] = trustedKey{pub: pub}
+	}
+	return k
+}
+
+// KeyContext prefixes the message a retired signing key signs to endorse
+// its successor (see factotum.Keyring.Chain).
+const KeyContext = "ten-key\x00"
+
+// KeyID names a signing key: the first 8 bytes of its SHA-256, in hex.
+// Factotum appends it to the tickets it signs.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Verify checks sig over msg with the key named kid, or, for tickets that
+// predate key IDs, with any trusted key.
+func (k *TrustedKeys) Verify(kid string, msg, sig []byte) bool {
+	if k == nil {
+		return false
+	}
+	now := time.Now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for id, key := range k.keys {
+		if kid != "" && id != kid {
+			continue
+		}
+		if !key.until.IsZero() && now.After(key.until) {
+			continue
+		}
+		if ed25519.Verify(key.pub, msg, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the trusted keys: <kid> current|<until-unix>.
+func (k *TrustedKeys) String() string {
+	if k == nil {
+		return ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var sb strings.Builder
+	for _, id := range sortedKeys(k.keys) {
+		if until := k.keys[id].until; until.IsZero() {
+			fmt.Fprintf(&sb, "%s current\n", id)
+		} else {
+			fmt.Fprintf(&sb, "%s %d\n", id, until.Unix())
+		}
+	}
+	return sb.String()
+}
+
+// Refresh replaces the trusted keys with those Factotum publishes at addr:
+// /keys/signing/pub (current) and /keys/signing/prev (retired, one
+// "<kid> <base64-pub> <until-unix>" line each). A key is taken only if it is
+// the root, already trusted, or endorsed in /keys/signing/chain by one that
+// is; otherwise the keys are left as they were.
+func (k *TrustedKeys) Refresh(addr string, d Dialer) error {
+	client, err := d.Dial(addr)
+	if err != nil {
+		return fmt.Errorf("dial_factotum_failed: %w", err)
+	}
+	defer client.Close()
+
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
+	read := func(fid uint32, name string) (string, error) {
+		wname := []string{"keys", "signing", name}
+		resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: fid, Wname: wname})
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Wqid) != len(wname) {
+			return "", fmt.Errorf("walk_failed: /keys/signing/%s", name)
+		}
+		defer client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: fid})
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Topen, Fid: fid, Mode: p9.OREAD}); err != nil {
+			return "", err
+		}
+		resp, err = rpcCheck(&p9.Fcall{Type: p9.Tread, Fid: fid, Count: 8192})
+		if err != nil {
+			return "", err
+		}
+		return string(resp.Data), nil
+	}
+
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		return err
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "kernel", Aname: "/"}); err != nil {
+		return err
+	}
+	defer client.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: 0})
+
+	cur, err := read(1, "pub")
+	if err != nil {
+		return err
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cur))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid current signing key")
+	}
+	prev, err := read(2, "prev")
+	if err != nil {
+		log.Printf("Keys: no previous keys: %v", err)
+	}
+	keys := map[string]trustedKey{KeyID(pub): {pub: pub}}
+	for _, line := range strings.Split(prev, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		pub, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(pub) != ed25519.PublicKeySize || KeyID(pub) != fields[0] {
+			log.Printf("Keys: bad previous key %q", fields[0])
+			continue
+		}
+		until, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		keys[fields[0]] = trustedKey{pub: pub, until: time.Unix(until, 0)}
+	}
+
+	chain, err := read(3, "chain")
+	if err != nil {
+		log.Printf("Keys: no key chain: %v", err)
+	}
+	endorsed := k.endorsed(chain, keys)
+	if !endorsed[KeyID(pub)] {
+		return fmt.Errorf("untrusted signing key %s", KeyID(pub))
+	}
+	for id := range keys {
+		if !endorsed[id] {
+			log.Printf("Keys: bad previous key %q", id)
+			delete(keys, id)
+		}
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// endorsed returns the IDs of the keys that are already trusted, or reached
+// from one of those through the lines of chain:
+// "<base64-pub> <signer-kid> <base64-sig>".
+// Only unexpired keys endorse: trusted ones by their own expiry, and keys
+// reached through the chain by their expiry in published.
+func (k *TrustedKeys) endorsed(chain string, published map[string]trustedKey) map[string]bool {
+	now := time.Now()
+	live := func(key trustedKey) bool { return key.until.IsZero() || now.Before(key.until) }
+	pubs := make(map[string]ed25519.PublicKey)
+	signers := make(map[string]bool) // keys in pubs that may endorse
+	k.mu.RLock()
+	for id, key := range k.keys {
+		pubs[id] = key.pub
+		signers[id] = live(key)
+	}
+	k.mu.RUnlock()
+
+	type link struct {
+		pub    ed25519.PublicKey
+		signer string
+		sig    []byte
+	}
+	var links []link
+	for _, line := range strings.Split(chain, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		pub, err1 := base64.StdEncoding.DecodeString(fields[0])
+		sig, err2 := base64.StdEncoding.DecodeString(fields[2])
+		if err1 != nil || err2 != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		links = append(links, link{pub, fields[1], sig})
+	}
+	// Follow the chain until no link adds a key
+	for added := true; added; {
+		added = false
+		for _, l := range links {
+			id := KeyID(l.pub)
+			signer, ok := pubs[l.signer]
+			if _, done := pubs[id]; done || !ok || !signers[l.signer] {
+				continue
+			}
+			if ed25519.Verify(signer, []byte(KeyContext+string(l.pub)), l.sig) {
+				pubs[id] = l.pub
+				key, ok := published[id]
+				signers[id] = ok && live(key)
+				added = true
+			}
+		}
+	}
+
+	ids := make(map[string]bool, len(pubs))
+	for id := range pubs {
+		ids[id] = true
+	}
+	return ids
+}
+
+// WatchSigningKeys refreshes keys from Factotum at addr every interval.
+// The address comes from the Kernel's own configuration (FACTOTUM_ADDR),
+// never from /srv or /lib/namespace, which users can influence.
+func WatchSigningKeys(keys *TrustedKeys, addr string, d Dialer, interval time.Duration) {
+	if addr == "" {
+		log.Printf("Keys: FACTOTUM_ADDR not set, trusting only the signing key")
+		return
+	}
+	for {
+		if err := keys.Refresh(addr, d); err != nil {
+			log.Printf("Keys: refresh from %s failed: %v", addr, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// factotumAddr is FACTOTUM_ADDR, or the /mnt/factotum mount of /lib/namespace.
+func factotumAddr(vfsAddr string, d Dialer, host *HostIdentity) string {
+	if addr := os.Getenv("FACTOTUM_ADDR"); addr != "" {
+		return addr
+	}
+	manifest, err := fetchNamespaceManifest(vfsAddr, d, host)
+	if err != nil {
+		return ""
+	}
+	return findMountAddr(manifest, "/mnt/factotum")
+}
+
+// TicketCache remembers verified tickets for a short time so that Tattach
+// does not dial VFS for every attach. Revoke drops entries immediately and
+// remembers the revocation, so inline tickets, which never touch VFS, are
+// refused too.
+type TicketCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration // 0 disables caching
+	lifetime time.Duration // how long Factotum tickets are valid
+	gen      uint64        // bumped by Revoke; stale validations are not cached
+	entries  map[string]cachedTicket
+	revoked  map[string]time.Time // "user" or "user/nonce" -> revocation time
+	polled   time.Time            // last successful poll of RevocationPath; zero before the first
+	maxStale time.Duration        // inline tickets are refused once polled is older
+}
+
+type cachedTicket struct {
+	ticket  *Ticket
+	expires time.Time
+}
+
+// Tickets is the Kernel's ticket cache, keyed by ticket path.
+var Tickets = NewTicketCache(time.Minute)
+
+func NewTicketCache(ttl time.Duration) *TicketCache {
+	return &TicketCache{
+		ttl:      ttl,
+		lifetime: 7 * 24 * time.Hour,
+		entries:  make(map[string]cachedTicket),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+// SetLifetime tells the cache how long Factotum tickets are valid, which
+// bounds how long revocations must be remembered.
+func (c *TicketCache) SetLifetime(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lifetime = d
+}
+
+// isInlineTicket reports whether aname is a ticket itself,
+// "<user> <expiry> <nonce> <sig> [<kid>]", rather than a ticket path.
+func isInlineTicket(aname string) bool {
+	n := len(strings.Fields(aname))
+	return !strings.HasPrefix(aname, "/") && (n == 4 || n == 5)
+}
+
+// ticketLabel names a ticket in logs without its signature, and a resume
+// token without the token.
+func ticketLabel(aname string) string {
+	if strings.HasPrefix(aname, "resume ") {
+		return "resume <redacted>"
+	}
+	if !isInlineTicket(aname) {
+		return aname
+	}
+	fields := strings.Fields(aname)
+	return "inline:" + fields[0] + "/" + fields[2]
+}
+
+// SetTTL changes how long verified tickets are remembered.
+func (c *TicketCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	if ttl == 0 {
+		c.entries = make(map[string]cachedTicket)
+	}
+}
+
+// Validate verifies aname, either an inline ticket, checked offline, or the
+// path of a ticket in VFS, taken from the cache if it was verified within
+// the TTL, otherwise via ValidateTicket. Revoked tickets are refused.
+func (c *TicketCache) Validate(aname string, vfsAddr string, keys *TrustedKeys, host *HostIdentity, d Dialer) (*Ticket, error) {
+	if isInlineTicket(aname) {
+		ticket, err := parseAndVerify(aname, keys)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// An inline ticket is never checked against VFS, so it is only as
+		// good as the revocations last read: without them, fail closed.
+		if c.polled.IsZero() || time.Since(c.polled) > c.maxStale {
+			return nil, errors.New("revocations_unavailable")
+		}
+		if c.isRevoked(ticket) {
+			return nil, errors.New("ticket_revoked")
+		}
+		return ticket, nil
+	}
+
+	path := aname
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ticket, nil
+	}
+
+	ticket, err := ValidateTicket(path, vfsAddr, keys, host, d)
 
-		// Simple overwrite or append?
-		// Usually environment writes are small and atomic-ish.
-		// We'll support append via offsets, but simplest is just replacing string.
-		// If Offset == 0, replace? Or just patch?
-		// To allow `echo val > file` (truncates) vs `echo val >> file`.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && c.isRevoked(ticket) {
+		err = errors.New("ticket_revoked")
+	}
+	if err != nil || c.ttl == 0 || c.gen != gen {
+		delete(c.entries, path)
+		return ticket, err
+	}
+	expires := now.Add(c.ttl)
+	if ticket.Expiry.Before(expires) {
+		expires = ticket.Expiry
+	}
+	c.entries[path] = cachedTicket{ticket: ticket, expires: expires}
+	return ticket, nil
+}
 
-		// The shell handles truncation by opening with OTRUNC.
-		// If we are here, we just modify the buffer at offset.
+// Polled records a successful poll of RevocationPath at at. Inline tickets
+// are accepted until the last one is older than maxStale.
+func (c *TicketCache) Polled(at time.Time, maxStale time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.polled, c.maxStale = at, maxStale
+}
 
-		val := []byte(fs.vars[name])
-		off := int(req.Offset)
-		data := req.Data
+// isRevoked reports whether t was revoked. Revoking a whole user refuses
+// the tickets issued up to the revocation, i.e. those expiring within one
+// lifetime of it. Caller holds c.mu.
+func (c *TicketCache) isRevoked(t *Ticket) bool {
+	if _, ok := c.revoked[t.User+"/"+t.Nonce]; ok {
+		return true
+	}
+	at, ok := c.revoked[t.User]
+	return ok && !t.Expiry.After(at.Add(c.lifetime))
+}
 
-		// Grow if needed
-		if off+len(data) > len(val) {
-			newVal := make([]byte, off+len(data))
-			copy(newVal, val)
-			val = newVal
-		}
-		copy(val[off:], data)
-		fs.vars[name] = string(val)
-		resp.Count = uint32(len(data))
+// Revoked reports whether t has been revoked.
+func (c *TicketCache) Revoked(t *Ticket) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isRevoked(t)
+}
 
-	case p9.Tremove:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
+// Revoke drops the cached tickets of user, all of them or only nonce, and
+// refuses them from now on. at is when the revocation was issued.
+func (c *TicketCache) Revoke(user, nonce string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	key := user
+	if nonce != "" {
+		key += "/" + nonce
+	}
+	if at.After(c.revoked[key]) {
+		c.revoked[key] = at
+	}
+	// Forget revocations once every ticket they cover has expired
+	for k, t := range c.revoked {
+		if time.Since(t) > c.lifetime {
+			delete(c.revoked, k)
 		}
-		if fid.path != "/" {
-			name := fid.path[1:]
-			delete(fs.vars, name)
+	}
+	for path, e := range c.entries {
+		if e.ticket.User == user && (nonce == "" || e.ticket.Nonce == nonce) {
+			delete(c.entries, path)
 		}
-		delete(fids, req.Fid)
-		resp.Type = p9.Rremove
+	}
+}
 
-	case p9.Tclunk:
-		delete(fids, req.Fid)
-		resp.Type = p9.Rclunk
+// RevocationPath is where Factotum appends one line per revocation:
+// <unix-time> user=<user> [nonce=<nonce>] kid=<kid> sig=<base64>
+const RevocationPath = "/adm/revoked"
 
-	case p9.Tstat:
-		fid, ok := fids[req.Fid]
-		if !ok {
-			return rError(req, "fid not found")
-		}
+// revocationPolls is how many poll intervals may pass without a successful
+// poll of RevocationPath before inline tickets are refused.
+const revocationPolls = 3
 
-		// Stat logic...
-		// Minimal
-		name := "env"
-		qid := p9.Qid{Type: p9.QTDIR, Vers: 0, Path: 0}
-		mode := uint32(p9.DMDIR | 0755)
-		length := uint64(0)
+// RevocationContext prefixes the message Factotum signs for each line of
+// RevocationPath (see factotum.SignRevocation).
+const RevocationContext = "ten-revoke\x00"
 
-		if fid.path != "/" {
-			name = fid.path[1:]
-			qid = p9.Qid{Type: p9.QTFILE, Vers: 0, Path: hashPath(name)}
-			mode = 0644
-			if v, ok := fs.vars[name]; ok {
-				length = uint64(len(v))
+// WatchRevocations polls RevocationPath in VFS every interval. Each new line
+// signed by a trusted key drops the matching cached tickets and hangs up the
+// sessions holding them. Inline tickets are refused until the first poll
+// succeeds and once none has for revocationPolls intervals.
+func WatchRevocations(vfsAddr string, d Dialer, host *HostIdentity, keys *TrustedKeys, interval time.Duration) {
+	tail := &kernelTail{vfsAddr: vfsAddr, dialer: d, host: host, path: RevocationPath}
+	for {
+		data, err := tail.Read()
+		if err != nil {
+			log.Printf("Revocations: poll failed: %v", err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+			if line != "" {
+				applyRevocation(line, keys)
 			}
 		}
-
-		d := p9.Dir{
-			Qid:    qid,
-			Mode:   mode,
-			Name:   name,
-			Length: length,
-			Uid:    "sys",
-			Gid:    "sys",
-			Muid:   "sys",
-			Atime:  uint32(time.Now().Unix()),
-			Mtime:  uint32(time.Now().Unix()),
+		if err == nil {
+			Tickets.Polled(time.Now(), revocationPolls*interval)
 		}
-		resp.Stat = d.Bytes()
+		time.Sleep(interval)
+	}
+}
 
-	default:
-		return rError(req, fmt.Sprintf("unknown type: %d", req.Type))
+// applyRevocation verifies, parses and applies one line of RevocationPath.
+func applyRevocation(line string, keys *TrustedKeys) {
+	body, signed, ok := strings.Cut(line, " kid=")
+	kid, sig64, _ := strings.Cut(signed, " sig=")
+	sig, err := base64.StdEncoding.DecodeString(sig64)
+	if !ok || err != nil || !keys.Verify(kid, []byte(RevocationContext+body), sig) {
+		log.Printf("Revocations: ignoring unsigned line %q", line)
+		return
 	}
 
-	return resp
-}
+	fields := strings.Fields(body)
+	if len(fields) < 2 {
+		return
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		log.Printf("Revocations: bad line %q", line)
+		return
+	}
+	var user, nonce string
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "user":
+			user = v
+		case "nonce":
+			nonce = v
+		}
+	}
+	if user == "" {
+		log.Printf("Revocations: bad line %q", line)
+		return
+	}
 
-func hashPath(s string) uint64 {
-	h := uint64(0)
-	for i := 0; i < len(s); i++ {
-		h = 31*h + uint64(s[i])
+	at := time.Unix(secs, 0)
+	Tickets.Revoke(user, nonce, at)
+	// A revocation only affects sessions attached before it was issued
+	if n := Registry.Revoke(user, nonce, at.Add(time.Second)); n > 0 {
+		Audit.Record("revoke", "user", user, "nonce", nonce, "sessions", strconv.Itoa(n))
 	}
-	return h
 }
 
-// --- PLACEHOLDER: UTILS & AUTH ---
-
-// --- Auth & Host Identity ---
+// kernelTail follows an append-only file in VFS, read as the kernel. It
+// keeps one connection and open fid between reads and redials after an
+// error.
+type kernelTail struct {
+	vfsAddr string
+	dialer  Dialer
+	host    *HostIdentity
+	path    string
 
-// HostIdentity represents the kernel's identity for signing and auth.
-type HostIdentity struct {
-	Key ed25519.PrivateKey
+	client *Client // nil until the file is open
+	offset uint64  // of the first byte not yet returned
 }
 
-// LoadHostIdentity loads the host identity from environment or disk.
-func LoadHostIdentity() (*HostIdentity, error) {
-	val := os.Getenv("HOST_KEY_BASE64")
-	if val == "" {
-		return nil, fmt.Errorf("HOST_KEY_BASE64 env var not set")
+// Read returns the complete lines appended since the last Read. A missing
+// file reads as empty.
+func (t *kernelTail) Read() (string, error) {
+	if t.client == nil {
+		if err := t.open(); err != nil || t.client == nil {
+			return "", err
+		}
+	}
+	var sb strings.Builder
+	for {
+		resp, err := t.client.RPC(&p9.Fcall{Type: p9.Tread, Fid: 1, Offset: t.offset + uint64(sb.Len()), Count: 8192})
+		if err == nil && resp.Type == p9.Rerror {
+			err = fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		if err != nil {
+			t.client.Close()
+			t.client = nil
+			return t.lines(sb.String()), err
+		}
+		if len(resp.Data) == 0 {
+			return t.lines(sb.String()), nil
+		}
+		sb.Write(resp.Data)
 	}
+}
 
-	keyBytes, err := base64.StdEncoding.DecodeString(val)
+// lines consumes the complete lines of data.
+func (t *kernelTail) lines(data string) string {
+	i := strings.LastIndexByte(data, '\n')
+	t.offset += uint64(i + 1)
+	return data[:i+1]
+}
+
+// open dials VFS and opens path at fid 1. If path does not exist yet it
+// leaves t.client nil.
+func (t *kernelTail) open() error {
+	client, err := t.dialer.Dial(t.vfsAddr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid base64 HOST_KEY_BASE64: %w", err)
+		return fmt.Errorf("dial_vfs_failed: %w", err)
 	}
-
-	if len(keyBytes) != ed25519.PrivateKeySize {
-		return nil, fmt.Errorf("invalid key length: want %d, got %d", ed25519.PrivateKeySize, len(keyBytes))
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
 	}
 
-	return &HostIdentity{Key: ed25519.PrivateKey(keyBytes)}, nil
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		client.Close()
+		return err
+	}
+	afid, err := HostAuthHandshake(client, t.host)
+	if err != nil {
+		afid = p9.NOFID
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: "kernel", Aname: "/"}); err != nil {
+		client.Close()
+		return err
+	}
+	wname := strings.Split(strings.TrimPrefix(t.path, "/"), "/")
+	if resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: wname}); err != nil || len(resp.Wqid) != len(wname) {
+		client.Close()
+		return nil
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OREAD}); err != nil {
+		client.Close()
+		return err
+	}
+	t.client = client
+	return nil
 }
 
-// Sign signs the given data with the host key.
-func (h *HostIdentity) Sign(data []byte) []byte {
-	return ed25519.Sign(h.Key, data)
+// readKernelFile returns the content of path in VFS from offset on, read as
+// the kernel. A missing file reads as empty.
+func readKernelFile(vfsAddr string, d Dialer, host *HostIdentity, path string, offset uint64) (string, error) {
+	return readOwnedFile(vfsAddr, d, host, path, offset, "")
 }
 
-// HostAuthHandshake performs the Tauth -> Tread(nonce) -> Twrite(sig) ceremony.
-// Returns the authenticated afid, or NOFID if auth failed/not attempted.
-func HostAuthHandshake(client *Client, host *HostIdentity) (uint32, error) {
-	if host == nil {
-		return p9.NOFID, nil
+// readOwnedFile is readKernelFile, failing unless path is owned by owner,
+// if set. VFS lets only privileged attaches change adm files, so reading
+// policy as an adm file keeps users from writing it.
+func readOwnedFile(vfsAddr string, d Dialer, host *HostIdentity, path string, offset uint64, owner string) (string, error) {
+	client, err := d.Dial(vfsAddr)
+	if err != nil {
+		return "", fmt.Errorf("dial_vfs_failed: %w", err)
 	}
+	defer client.Close()
 
-	afid := uint32(100) // Reserved range for internal auth?
-
-	// Helper to reduce boilerplate
 	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
 		resp, err := client.RPC(req)
 		if err != nil {
@@ -2328,45 +8963,125 @@ func HostAuthHandshake(client *Client, host *HostIdentity) (uint32, error) {
 		return resp, nil
 	}
 
-	// 1. Tauth
-	_, err := rpcCheck(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: "kernel", Aname: "/"})
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		return "", err
+	}
+	afid, err := HostAuthHandshake(client, host)
 	if err != nil {
-		// Log warning but allow proceeding (maybe VFS has auth disabled?)
-		// But if auth is required later, it will fail then.
-		log.Printf("Boot Warning: Tauth failed: %v", err)
-		return p9.NOFID, nil
+		afid = p9.NOFID
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: "kernel", Aname: "/"}); err != nil {
+		return "", err
+	}
+	wname := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: wname}); err != nil || len(resp.Wqid) != len(wname) {
+		return "", nil
+	}
+	if owner != "" {
+		resp, err := rpcCheck(&p9.Fcall{Type: p9.Tstat, Fid: 1})
+		if err != nil {
+			return "", err
+		}
+		d, _, err := p9.UnmarshalDir(resp.Stat)
+		if err != nil {
+			return "", err
+		}
+		if d.Uid != owner {
+			return "", fmt.Errorf("%s: owned by %s, not %s", path, d.Uid, owner)
+		}
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OREAD}); err != nil {
+		return "", err
 	}
 
-	// 2. Read Nonce (32 bytes)
-	rResp, err := rpcCheck(&p9.Fcall{Type: p9.Tread, Fid: afid, Offset: 0, Count: 32})
-	if err != nil {
-		return p9.NOFID, fmt.Errorf("auth_read_nonce_failed: %w", err)
+	var sb strings.Builder
+	for {
+		resp, err := rpcCheck(&p9.Fcall{Type: p9.Tread, Fid: 1, Offset: offset, Count: 8192})
+		if err != nil {
+			return sb.String(), err
+		}
+		if len(resp.Data) == 0 {
+			return sb.String(), nil
+		}
+		sb.Write(resp.Data)
+		offset += uint64(len(resp.Data))
 	}
-	nonce := rResp.Data
+}
 
-	// 3. Sign Nonce
-	sig := host.Sign(nonce)
+// errNoDir is returned by writeKernelFile when the file's directory does
+// not exist.
+var errNoDir = errors.New("not_found")
 
-	// 4. Write Signature
-	if _, err := rpcCheck(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: sig, Count: uint32(len(sig))}); err != nil {
-		return p9.NOFID, fmt.Errorf("auth_write_sig_failed: %w", err)
+// writeKernelFile replaces the contents of path in VFS, creating the file
+// (but not its directory) with mode 0600 if needed.
+func writeKernelFile(vfsAddr string, d Dialer, host *HostIdentity, path string, data []byte) error {
+	client, err := d.Dial(vfsAddr)
+	if err != nil {
+		return fmt.Errorf("dial_vfs_failed: %w", err)
 	}
+	defer client.Close()
 
-	log.Printf("Boot: Host Auth Successful")
-	return afid, nil
-}
+	rpcCheck := func(req *p9.Fcall) (*p9.Fcall, error) {
+		resp, err := client.RPC(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == p9.Rerror {
+			return nil, fmt.Errorf("9p_error: %s", resp.Ename)
+		}
+		return resp, nil
+	}
 
-// --- Ticket Logic ---
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err != nil {
+		return err
+	}
+	afid, err := HostAuthHandshake(client, host)
+	if err != nil {
+		afid = p9.NOFID
+	}
+	if _, err := rpcCheck(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: "kernel", Aname: "/"}); err != nil {
+		return err
+	}
+	slash := strings.LastIndex(path, "/")
+	dir, name := strings.Split(strings.Trim(path[:slash], "/"), "/"), path[slash+1:]
+	if slash == 0 {
+		dir = nil
+	}
+	if resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1, Wname: dir}); err != nil || len(resp.Wqid) != len(dir) {
+		return fmt.Errorf("%w: %s", errNoDir, path[:slash])
+	}
 
-// Ticket represents a verified session token.
-type Ticket struct {
-	User   string
-	Expiry time.Time
-	Nonce  string
+	fid := uint32(2)
+	if resp, err := rpcCheck(&p9.Fcall{Type: p9.Twalk, Fid: 1, Newfid: fid, Wname: []string{name}}); err == nil && len(resp.Wqid) == 1 {
+		// Truncate with a wstat that leaves everything else alone
+		trunc := p9.Dir{Mode: 0xFFFFFFFF, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF}
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Twstat, Fid: fid, Stat: trunc.Bytes()}); err != nil {
+			return err
+		}
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Topen, Fid: fid, Mode: p9.OWRITE}); err != nil {
+			return err
+		}
+	} else {
+		// Tcreate leaves fid 1 open on the new file
+		fid = 1
+		if _, err := rpcCheck(&p9.Fcall{Type: p9.Tcreate, Fid: fid, Name: name, Perm: 0600, Mode: p9.OWRITE}); err != nil {
+			return err
+		}
+	}
+
+	for offset := 0; offset < len(data); {
+		n := min(len(data)-offset, 8000)
+		resp, err := rpcCheck(&p9.Fcall{Type: p9.Twrite, Fid: fid, Offset: uint64(offset), Data: data[offset : offset+n], Count: uint32(n)})
+		if err != nil {
+			return err
+		}
+		offset += int(resp.Count)
+	}
+	return nil
 }
 
 // ValidateTicket fetches a ticket from VFS and verifies its signature.
-func ValidateTicket(path string, vfsAddr string, pubKey ed25519.PublicKey, host *HostIdentity, d Dialer) (*Ticket, error) {
+func ValidateTicket(path string, vfsAddr string, keys *TrustedKeys, host *HostIdentity, d Dialer) (*Ticket, error) {
 	// 1. Dial VFS (Bootstrap connection)
 	client, err := d.Dial(vfsAddr)
 	if err != nil {
@@ -2451,15 +9166,19 @@ func ValidateTicket(path string, vfsAddr string, pubKey ed25519.PublicKey, host
 	}
 
 	// 6. Parse and Verify
-	return parseAndVerify(string(resp.Data), pubKey)
+	return parseAndVerify(string(resp.Data), keys)
 }
 
-func parseAndVerify(content string, pubKey ed25519.PublicKey) (*Ticket, error) {
-	// Format: <user> <expiry> <nonce> <sig>
+func parseAndVerify(content string, keys *TrustedKeys) (*Ticket, error) {
+	// Format: <user> <expiry> <nonce> <sig> [<kid>]
 	fields := strings.Fields(content)
-	if len(fields) != 4 {
+	if len(fields) != 4 && len(fields) != 5 {
 		return nil, errors.New("invalid ticket format")
 	}
+	var kid string
+	if len(fields) == 5 {
+		kid = fields[4]
+	}
 
 	user := fields[0]
 	expiryStr := fields[1]
@@ -2484,7 +9203,7 @@ func parseAndVerify(content string, pubKey ed25519.PublicKey) (*Ticket, error) {
 		return nil, errors.New("invalid signature encoding")
 	}
 
-	if !ed25519.Verify(pubKey, []byte(message), sig) {
+	if !keys.Verify(kid, []byte(message), sig) {
 		return nil, errors.New("invalid_signature")
 	}
 
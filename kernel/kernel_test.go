@@ -0,0 +1,1984 @@
+package kernel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/keaganluttrell/ten/factotum"
+	p9 "github.com/keaganluttrell/ten/pkg/9p"
+	"github.com/keaganluttrell/ten/vfs"
+)
+
+// countDialer refuses every dial and counts them.
+type countDialer struct{ n atomic.Int32 }
+
+func (d *countDialer) Dial(addr string) (*Client, error) {
+	d.n.Add(1)
+	return nil, errors.New("connection refused")
+}
+
+func TestHealthMonitorStop(t *testing.T) {
+	h := &HealthMonitor{replicas: make(map[string]*Replica), interval: 5 * time.Millisecond}
+	d := &countDialer{}
+	h.Track("tcp!a!1", d)
+
+	deadline := time.Now().Add(time.Second)
+	for d.n.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("monitor never probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Stop()
+	time.Sleep(10 * time.Millisecond) // a probe already running may finish
+	n := d.n.Load()
+	time.Sleep(30 * time.Millisecond)
+	if got := d.n.Load(); got != n {
+		t.Fatalf("probes after Stop: %d, want %d", got, n)
+	}
+	h.Stop() // idempotent
+}
+
+// testSystem is a VFS on a temporary tree, reached over a PipeDialer, for
+// sessions to attach to.
+type testSystem struct {
+	root  string
+	host  *HostIdentity
+	keys  *TrustedKeys
+	pipes *PipeDialer
+}
+
+const testVFS = "tcp!vfs!9001"
+
+func newTestSystem(t *testing.T) *testSystem {
+	t.Helper()
+	root := t.TempDir()
+	if err := vfs.Seed(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "lib", "namespace"), []byte("mount / "+testVFS+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := vfs.NewLocalBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipes := NewPipeDialer()
+	ln, err := pipes.Listen(testVFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go vfs.Serve(ln, backend, base64.StdEncoding.EncodeToString(pub))
+	t.Cleanup(func() { ln.Close() })
+	return &testSystem{root: root, host: &HostIdentity{Key: priv}, keys: NewTrustedKeys(nil), pipes: pipes}
+}
+
+// session serves a new Session on a pipe and returns the client end.
+func (ts *testSystem) session(t *testing.T) (*Session, net.Conn) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	s := NewSession(&TCPTransport{conn: c2}, testVFS, ts.keys, ts.host, ts.pipes)
+	go s.Serve()
+	t.Cleanup(func() { c1.Close() })
+	return s, c1
+}
+
+// attach connects a client to a new session, attached as none at fid 0.
+func (ts *testSystem) attach(t *testing.T) (*Session, *Client) {
+	t.Helper()
+	s, conn := ts.session(t)
+	c := &Client{addr: "test", conn: conn, tag: 1}
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "none"})
+	return s, c
+}
+
+func mustRPC(t *testing.T, c *Client, req *p9.Fcall) *p9.Fcall {
+	t.Helper()
+	resp, err := c.RPC(req)
+	if err != nil {
+		t.Fatalf("%v: %v", req, err)
+	}
+	if resp.Type == p9.Rerror {
+		t.Fatalf("%v: %s", req, resp.Ename)
+	}
+	return resp
+}
+
+// open walks fid 0 to path as newfid and opens it with mode.
+func open(t *testing.T, c *Client, newfid uint32, mode uint8, path ...string) {
+	t.Helper()
+	mustRPC(t, c, &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: newfid, Wname: path})
+	mustRPC(t, c, &p9.Fcall{Type: p9.Topen, Fid: newfid, Mode: mode})
+}
+
+// rawRPC writes req as is and reads one reply.
+func rawRPC(t *testing.T, conn net.Conn, req *p9.Fcall) *p9.Fcall {
+	t.Helper()
+	send(t, conn, req)
+	return recv(t, conn)
+}
+
+func send(t *testing.T, conn net.Conn, req *p9.Fcall) {
+	t.Helper()
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recv(t *testing.T, conn net.Conn) *p9.Fcall {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := p9.ReadFcall(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestSessionFlush(t *testing.T) {
+	ts := newTestSystem(t)
+	_, conn := ts.session(t)
+
+	for _, req := range []*p9.Fcall{
+		{Type: p9.Tversion, Tag: p9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: p9.Tattach, Tag: 1, Fid: 0, Afid: p9.NOFID, Uname: "none"},
+		{Type: p9.Twalk, Tag: 1, Fid: 0, Newfid: 1, Wname: []string{"dev", "cons"}},
+		{Type: p9.Topen, Tag: 1, Fid: 1, Mode: p9.OREAD},
+	} {
+		if resp := rawRPC(t, conn, req); resp.Type == p9.Rerror {
+			t.Fatalf("%v: %s", req, resp.Ename)
+		}
+	}
+
+	// The read blocks on the empty console until flushed
+	send(t, conn, &p9.Fcall{Type: p9.Tread, Tag: 5, Fid: 1, Count: 100})
+	send(t, conn, &p9.Fcall{Type: p9.Tflush, Tag: 6, Oldtag: 5})
+	if resp := recv(t, conn); resp.Type != p9.Rflush || resp.Tag != 6 {
+		t.Fatalf("got %v, want Rflush tag 6", resp)
+	}
+
+	// The flushed read never answers; the next reply is the clunk's
+	if resp := rawRPC(t, conn, &p9.Fcall{Type: p9.Tclunk, Tag: 7, Fid: 1}); resp.Type != p9.Rclunk || resp.Tag != 7 {
+		t.Fatalf("got %v, want Rclunk tag 7", resp)
+	}
+
+	// Flushing a tag that is not outstanding still answers
+	if resp := rawRPC(t, conn, &p9.Fcall{Type: p9.Tflush, Tag: 8, Oldtag: 99}); resp.Type != p9.Rflush {
+		t.Fatalf("got %v, want Rflush", resp)
+	}
+}
+
+func TestClientConcurrentRPC(t *testing.T) {
+	ts := newTestSystem(t)
+	_, c := ts.attach(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := range 32 {
+		wg.Add(1)
+		go func(fid uint32) {
+			defer wg.Done()
+			resp, err := c.RPC(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: fid, Wname: []string{"dev", "user"}})
+			if err != nil || resp.Type != p9.Rwalk || len(resp.Wqid) != 2 {
+				errs <- fmt.Errorf("walk fid %d: %v %v", fid, resp, err)
+				return
+			}
+			resp, err = c.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: fid})
+			if err != nil || resp.Type != p9.Rclunk {
+				errs <- fmt.Errorf("clunk fid %d: %v %v", fid, resp, err)
+			}
+		}(uint32(i + 10))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestClientRPCContextCancel(t *testing.T) {
+	ts := newTestSystem(t)
+	_, c := ts.attach(t)
+	open(t, c, 1, p9.OREAD, "dev", "cons")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.RPCContext(ctx, &p9.Fcall{Type: p9.Tread, Fid: 1, Count: 100}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	// The client is still usable after the flush
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tclunk, Fid: 1})
+}
+
+func TestClientClosedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	c := &Client{addr: "test", conn: c1, tag: 1}
+	go func() {
+		p9.ReadFcall(c2)
+		c2.Close()
+	}()
+	if _, err := c.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err == nil {
+		t.Fatal("RPC on a dead connection succeeded")
+	}
+	if _, err := c.RPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"}); err == nil {
+		t.Fatal("RPC after the read loop stopped succeeded")
+	}
+}
+
+// Reattaching while requests run swaps the namespace and user under s.mu.
+func TestSessionReattachRace(t *testing.T) {
+	ts := newTestSystem(t)
+	s, c := ts.attach(t)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func(fid uint32) {
+			defer wg.Done()
+			for range 10 {
+				resp, err := c.RPC(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: fid, Wname: []string{"dev", "user"}})
+				if err == nil && resp.Type == p9.Rwalk {
+					c.RPC(&p9.Fcall{Type: p9.Tclunk, Fid: fid})
+				}
+			}
+		}(uint32(i + 100))
+	}
+	for range 5 {
+		mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 1, Afid: p9.NOFID, Uname: "none"})
+		mustRPC(t, c, &p9.Fcall{Type: p9.Tclunk, Fid: 1})
+		_ = s.namespace().String()
+	}
+	wg.Wait()
+
+	if user := s.uname(); user != "none" {
+		t.Fatalf("user = %q, want none", user)
+	}
+}
+
+func TestReattachClosesNamespace(t *testing.T) {
+	ts := newTestSystem(t)
+	s, c := ts.attach(t)
+	old := s.namespace()
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 1, Afid: p9.NOFID, Uname: "none"})
+	if s.namespace() == old {
+		t.Fatal("namespace not replaced")
+	}
+	if m := old.String(); m != "" {
+		t.Errorf("old namespace still mounted:\n%s", m)
+	}
+	if resp, err := c.RPC(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 2, Wname: []string{"dev", "user"}}); err == nil && resp.Type != p9.Rerror {
+		t.Error("fid from the replaced namespace still walks")
+	}
+	mustRPC(t, c, &p9.Fcall{Type: p9.Twalk, Fid: 1, Newfid: 3, Wname: []string{"dev", "user"}})
+}
+
+func TestSrvPost(t *testing.T) {
+	r := &SrvRegistry{posts: make(map[string]*srvPost)}
+	alice, bob, adm := &Session{user: "alice"}, &Session{user: "bob"}, &Session{user: "adm"}
+	none := &Session{user: "none"}
+
+	for _, tt := range []struct {
+		owner *Session
+		name  string
+		ok    bool
+	}{
+		{alice, "alice.db", true},
+		{alice, "factotum", false},
+		{alice, "bob.db", false},
+		{alice, "alice.", false},
+		{none, "none.x", false},
+		{bob, "alice.db", false},
+		{adm, "factotum", true},
+		{alice, "alice.db", true}, // the owner may repost
+	} {
+		err := r.Post(tt.name, "tcp!h!1", tt.owner)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s posts %s: err=%v, want ok=%v", tt.owner.user, tt.name, err, tt.ok)
+		}
+	}
+
+	// An announcement replaces a post of its name
+	c := &Client{addr: "announce!factotum"}
+	r.PostConn("factotum", c)
+	if p, _ := r.get("factotum"); p.conn != c {
+		t.Fatal("announcement did not replace the post")
+	}
+	if err := r.Remove("factotum", adm); err == nil {
+		t.Fatal("removed an announced service")
+	}
+}
+
+func TestSrvFSWrite(t *testing.T) {
+	fs := NewSrvFS(&Session{user: "alice"})
+	defer Srv.Drop(fs.session)
+
+	for _, tt := range []struct {
+		req   *p9.Fcall
+		ename string
+	}{
+		{&p9.Fcall{Type: p9.Tattach, Fid: 0}, ""},
+		{&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1}, ""},
+		{&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "vfs", Perm: 0666}, "permission denied"},
+		{&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "alice.vfs", Perm: 0666}, ""},
+		{&p9.Fcall{Type: p9.Twrite, Fid: 1, Data: []byte("tcp!vfs!9001\n")}, ""},
+	} {
+		resp := fs.handle(tt.req)
+		if resp.Type == p9.Rerror && resp.Ename != tt.ename || resp.Type != p9.Rerror && tt.ename != "" {
+			t.Fatalf("%v: got %v, want error %q", tt.req, resp, tt.ename)
+		}
+		if tt.req.Type == p9.Twrite && resp.Count != uint32(len(tt.req.Data)) {
+			t.Fatalf("Rwrite count = %d, want %d", resp.Count, len(tt.req.Data))
+		}
+	}
+	if addr, _ := Srv.Lookup("alice.vfs"); addr != "tcp!vfs!9001" {
+		t.Fatalf("posted %q", addr)
+	}
+}
+
+func TestAcceptAnnounce(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := map[string]ed25519.PublicKey{"db": pub, "bad": ed25519.PublicKey("short")}
+
+	// sign answers the nonce read back from the afid as an announcement of name
+	sign := func(key ed25519.PrivateKey, name string) func(nonce []byte) []byte {
+		return func(nonce []byte) []byte { return ed25519.Sign(key, announceMessage(name, nonce)) }
+	}
+	bare := func(nonce []byte) []byte { return ed25519.Sign(priv, nonce) }
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	for _, tt := range []struct {
+		name  string
+		uname string
+		sign  func([]byte) []byte
+		early bool   // Twrite on NOFID before any Tauth
+		want  string // Rerror of the first failing step, or "" for success
+	}{
+		{"ok", "db", sign(priv, "db"), false, ""},
+		{"write before auth", "db", sign(priv, "db"), true, "announce: unexpected message"},
+		{"unknown service", "nope", sign(priv, "nope"), false, "unknown service: nope"},
+		{"wrong key", "db", sign(other, "db"), false, "signature verification failed"},
+		{"malformed key", "bad", sign(priv, "bad"), false, "signature verification failed"},
+		{"bare nonce", "db", bare, false, "signature verification failed"},
+		{"other name", "db", sign(priv, "web"), false, "signature verification failed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			result := make(chan string, 1)
+			go func() {
+				name, _ := acceptAnnounce(c2, keys)
+				c2.Close()
+				result <- name
+			}()
+
+			steps := []*p9.Fcall{{Type: p9.Tversion, Tag: p9.NOTAG, Msize: 8192, Version: "9P2000"}}
+			if tt.early {
+				steps = append(steps, &p9.Fcall{Type: p9.Twrite, Tag: 1, Fid: p9.NOFID, Data: make([]byte, 64)})
+			}
+			steps = append(steps,
+				&p9.Fcall{Type: p9.Tauth, Tag: 1, Afid: 1, Uname: tt.uname},
+				&p9.Fcall{Type: p9.Tread, Tag: 1, Fid: 1, Count: 32},
+				nil, // Twrite of the signature
+				&p9.Fcall{Type: p9.Tattach, Tag: 1, Fid: 0, Afid: 1, Uname: tt.uname},
+			)
+			var nonce []byte
+			for _, req := range steps {
+				if req == nil {
+					req = &p9.Fcall{Type: p9.Twrite, Tag: 1, Fid: 1, Data: tt.sign(nonce)}
+				}
+				resp := rawRPC(t, c1, req)
+				if resp.Type == p9.Rerror {
+					if resp.Ename != tt.want {
+						t.Fatalf("%v: %s, want %q", req, resp.Ename, tt.want)
+					}
+					return
+				}
+				if req.Type == p9.Tread {
+					nonce = resp.Data
+				}
+			}
+			if tt.want != "" {
+				t.Fatalf("handshake succeeded, want %q", tt.want)
+			}
+			if name := <-result; name != tt.uname {
+				t.Fatalf("announced %q, want %q", name, tt.uname)
+			}
+		})
+	}
+}
+
+func TestResumeTokens(t *testing.T) {
+	ts := newTestSystem(t)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	ts.keys = NewTrustedKeys(pub)
+	ticket := factotum.Generate("glenda", priv)
+	Tickets.Polled(time.Now(), time.Hour) // inline tickets need revocations loaded
+	defer Tickets.Polled(time.Time{}, 0)
+
+	// The first connection attaches with a ticket, opens /dev/user and hangs up
+	_, conn := ts.session(t)
+	c := &Client{addr: "test", conn: conn, tag: 1}
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "glenda", Aname: ticket.String()})
+	open(t, c, 1, p9.OREAD, "dev", "resume")
+	token := string(mustRPC(t, c, &p9.Fcall{Type: p9.Tread, Fid: 1, Count: 128}).Data)
+	open(t, c, 2, p9.OREAD, "dev", "user")
+	conn.Close()
+	until := func() time.Time {
+		Resumes.mu.Lock()
+		defer Resumes.mu.Unlock()
+		if d, ok := Resumes.sessions[token]; ok {
+			return d.until
+		}
+		return time.Time{}
+	}
+	waitFor(t, "session to detach", func() bool { return !until().IsZero() })
+	deadline := until()
+
+	tests := []struct {
+		name  string
+		uname string
+		token string
+		fid   uint32
+		ename string
+	}{
+		{"unknown token", "glenda", "0123456789abcdef", 10, "resume_invalid"},
+		{"another user", "bob", token, 10, "resume_user_mismatch"},
+		{"fid in use", "glenda", token, 2, "fid_in_use"},
+		{"resumed", "glenda", token, 10, ""},
+		{"spent", "glenda", token, 10, "resume_invalid"},
+	}
+	for _, tt := range tests {
+		_, conn := ts.session(t)
+		c := &Client{addr: "test", conn: conn, tag: 1}
+		mustRPC(t, c, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+		resp, err := c.RPC(&p9.Fcall{Type: p9.Tattach, Fid: tt.fid, Afid: p9.NOFID, Uname: tt.uname, Aname: "resume " + tt.token})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.Ename != tt.ename {
+			t.Fatalf("%s: got %q, want %q", tt.name, resp.Ename, tt.ename)
+		}
+		// A failed attempt puts the session back without extending its grace
+		if tt.token == token && tt.ename != "" && tt.ename != "resume_invalid" {
+			if got := until(); !got.Equal(deadline) {
+				t.Fatalf("%s: grace ends at %v, want %v", tt.name, got, deadline)
+			}
+		}
+		if tt.ename == "" {
+			// The open fid came back with the session
+			if data := mustRPC(t, c, &p9.Fcall{Type: p9.Tread, Fid: 2, Count: 128}).Data; string(data) != "glenda" {
+				t.Fatalf("%s: /dev/user reads %q", tt.name, data)
+			}
+		}
+	}
+}
+
+func TestSessionTxBytes(t *testing.T) {
+	ts := newTestSystem(t)
+	s, conn := ts.session(t)
+	resp := rawRPC(t, conn, &p9.Fcall{Type: p9.Tversion, Tag: p9.NOTAG, Msize: 8192, Version: "9P2000"})
+	b, _ := resp.Bytes()
+	if got := s.tx.Load(); got != uint64(len(b)) {
+		t.Fatalf("tx = %d, want %d", got, len(b))
+	}
+}
+
+func TestNamespaceUnmountShared(t *testing.T) {
+	ns := NewNamespace()
+	root := &Client{addr: "root"}
+	other := &Client{addr: "other"}
+	ns.Mount("/", root, MREPL)
+	ns.Mount("/n/other", other, MREPL)
+	if err := ns.Bind("/lib", "/x", MREPL); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want []*Client
+		ok   bool
+	}{
+		{"/x", nil, true},  // bound from the root client, still in use at /
+		{"/x", nil, false}, // already gone
+		{"/n/other", []*Client{other}, true},
+		{"/", []*Client{root}, true},
+	}
+	for _, tt := range tests {
+		got, ok := ns.Unmount(tt.path)
+		if ok != tt.ok || len(got) != len(tt.want) {
+			t.Fatalf("Unmount(%s) = %v, %v; want %v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("Unmount(%s) = %v; want %v", tt.path, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestProcCtlDebugAdm(t *testing.T) {
+	ts := newTestSystem(t)
+	s, _ := ts.attach(t)
+	p := NewProcFS(s)
+	if err := p.ctl(s, "debug on"); err == nil || s.debug.Load() {
+		t.Fatalf("debug by none: err=%v debug=%v", err, s.debug.Load())
+	}
+	s.setIdentity("adm", s.namespace())
+	if err := p.ctl(s, "debug on"); err != nil || !s.debug.Load() {
+		t.Fatalf("debug by adm: err=%v debug=%v", err, s.debug.Load())
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeMetrics(ln, "/metrics")
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/metrics", http.StatusOK},
+		{"/ws", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get("http://" + ln.Addr().String() + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Fatalf("GET %s: %d, want %d", tt.path, resp.StatusCode, tt.code)
+		}
+		if tt.code == http.StatusOK && !strings.Contains(string(body), "ten_") {
+			t.Fatalf("GET %s: no ten_ metrics in %q", tt.path, body)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		ename string
+		class string
+	}{
+		{"interrupted", "interrupted"},
+		{"kernel_shutting_down", "shutting_down"},
+		{"rate_limited", "limited"},
+		{"too_many_fids", "limited"},
+		{"fid not found", "fid"},
+		{"fid_in_use", "fid"},
+		{"ticket_revoked", "auth"},
+		{"signature verification failed", "auth"},
+		{"open_error: connection closed", "backend"},
+		{"namespace_build_failed: open /lib/namespace: permission denied", "backend"},
+		{"permission denied", "permission"},
+		{"stat /usr/glenda/secret: no such file or directory", "not_found"},
+		{"file exists", "exists"},
+		{"file system full", "full"},
+		{"invalid name", "bad_request"},
+		{"/usr/glenda/diary.txt", "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.ename); got != tt.class {
+			t.Errorf("errorClass(%q) = %q, want %q", tt.ename, got, tt.class)
+		}
+	}
+}
+
+// countingDialer counts the dials it passes on.
+type countingDialer struct {
+	Dialer
+	n atomic.Int32
+}
+
+func (d *countingDialer) Dial(addr string) (*Client, error) {
+	d.n.Add(1)
+	return d.Dialer.Dial(addr)
+}
+
+func TestRevocations(t *testing.T) {
+	ts := newTestSystem(t)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	keys := NewTrustedKeys(pub)
+
+	path := filepath.Join(ts.root, "adm", "revoked")
+	appendLines := func(lines ...string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, l := range lines {
+			f.WriteString(l)
+		}
+	}
+
+	now := time.Now().Unix()
+	appendLines(
+		fmt.Sprintf("%d user=alice nonce=n1\n", now),
+		factotum.SignRevocation(fmt.Sprintf("%d user=bob nonce=n1", now), other)+"\n",
+		factotum.SignRevocation(fmt.Sprintf("%d user=carol nonce=n1", now), priv)+"\n",
+		factotum.SignRevocation(fmt.Sprintf("%d user=dave nonce=n1", now), priv), // incomplete
+	)
+
+	d := &countingDialer{Dialer: ts.pipes}
+	tail := &kernelTail{vfsAddr: testVFS, dialer: d, host: ts.host, path: RevocationPath}
+	apply := func() {
+		data, err := tail.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+			if line != "" {
+				applyRevocation(line, keys)
+			}
+		}
+	}
+	apply()
+	appendLines("\n", factotum.SignRevocation(fmt.Sprintf("%d user=erin nonce=n1", now), priv)+"\n")
+	apply()
+
+	expiry := time.Now().Add(time.Hour)
+	for _, tt := range []struct {
+		user    string
+		revoked bool
+	}{
+		{"alice", false}, // unsigned
+		{"bob", false},   // untrusted key
+		{"carol", true},
+		{"dave", true}, // completed by the second append
+		{"erin", true},
+	} {
+		if got := Tickets.Revoked(&Ticket{User: tt.user, Nonce: "n1", Expiry: expiry}); got != tt.revoked {
+			t.Errorf("%s revoked = %v, want %v", tt.user, got, tt.revoked)
+		}
+	}
+	if n := d.n.Load(); n != 1 {
+		t.Errorf("dialed VFS %d times, want 1", n)
+	}
+}
+
+func TestTrustedKeysRefresh(t *testing.T) {
+	const addr = "tcp!factotum!9002"
+	unrelated, _, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name    string
+		rotate  int
+		root    func(first ed25519.PublicKey) ed25519.PublicKey
+		forge   bool // add a chain link signed by an unrelated key
+		trusted bool // whether the current key ends up trusted
+	}{
+		{"unrotated", 0, func(first ed25519.PublicKey) ed25519.PublicKey { return first }, false, true},
+		{"rotated", 1, func(first ed25519.PublicKey) ed25519.PublicKey { return first }, false, true},
+		{"rotated twice", 2, func(first ed25519.PublicKey) ed25519.PublicKey { return first }, false, true},
+		{"other root", 1, func(ed25519.PublicKey) ed25519.PublicKey { return unrelated }, false, false},
+		{"no root", 1, func(ed25519.PublicKey) ed25519.PublicKey { return nil }, false, false},
+		{"forged link", 0, func(first ed25519.PublicKey) ed25519.PublicKey { return first }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			kr, err := factotum.NewKeyring(dir, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := kr.PublicKey()
+			for i := 0; i < tt.rotate; i++ {
+				if err := kr.RotateSigningKey(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.forge {
+				// Replace the signing key with one no chain link leads to
+				pub, priv, _ := ed25519.GenerateKey(nil)
+				_, other, _ := ed25519.GenerateKey(nil)
+				os.WriteFile(filepath.Join(dir, "signing.key"), []byte(base64.StdEncoding.EncodeToString(priv)), 0600)
+				sig := ed25519.Sign(other, []byte(KeyContext+string(pub)))
+				link := fmt.Sprintf("%s %s %s\n", base64.StdEncoding.EncodeToString(pub), KeyID(other.Public().(ed25519.PublicKey)), base64.StdEncoding.EncodeToString(sig))
+				os.WriteFile(filepath.Join(dir, "signing.chain"), []byte(link), 0644)
+			}
+			srv, err := factotum.NewServer(factotum.Config{DataPath: dir, VFSAddr: testVFS, KeyGrace: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			current, _ := factotum.NewKeyring(dir, time.Hour)
+
+			pipes := NewPipeDialer()
+			ln, err := pipes.Listen(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go srv.Serve(ln)
+
+			keys := NewTrustedKeys(tt.root(first))
+			before := keys.String()
+			err = keys.Refresh(addr, pipes)
+			if (err == nil) != tt.trusted {
+				t.Fatalf("Refresh: %v, want trusted=%v", err, tt.trusted)
+			}
+			kid := KeyID(current.PublicKey())
+			if got := strings.Contains(keys.String(), kid+" current"); got != tt.trusted {
+				t.Fatalf("keys = %q; current %s trusted = %v", keys.String(), kid, got)
+			}
+			if !tt.trusted && keys.String() != before {
+				t.Fatalf("keys changed to %q after a refused refresh", keys.String())
+			}
+			// Archives are named by the second, so only one rotation is kept here
+			if tt.rotate == 1 && tt.trusted && !strings.Contains(keys.String(), KeyID(first)+" ") {
+				t.Fatalf("retired root %s not listed in %q", KeyID(first), keys.String())
+			}
+		})
+	}
+}
+
+func TestEndorsedExpiry(t *testing.T) {
+	root, rootPriv, _ := ed25519.GenerateKey(nil)
+	k1, k1Priv, _ := ed25519.GenerateKey(nil)
+	k2, _, _ := ed25519.GenerateKey(nil)
+	link := func(pub ed25519.PublicKey, signer ed25519.PrivateKey) string {
+		sig := ed25519.Sign(signer, []byte(KeyContext+string(pub)))
+		return fmt.Sprintf("%s %s %s\n", base64.StdEncoding.EncodeToString(pub), KeyID(signer.Public().(ed25519.PublicKey)), base64.StdEncoding.EncodeToString(sig))
+	}
+	chain := link(k1, rootPriv) + link(k2, k1Priv)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		rootUntil time.Time // zero while the root is current
+		k1        *trustedKey
+		want      bool // whether k2 is endorsed
+	}{
+		{"live chain", time.Time{}, &trustedKey{pub: k1, until: future}, true},
+		{"root retired in grace", future, &trustedKey{pub: k1, until: future}, true},
+		{"root expired", past, &trustedKey{pub: k1, until: future}, false},
+		{"middle key expired", time.Time{}, &trustedKey{pub: k1, until: past}, false},
+		{"middle key unpublished", time.Time{}, nil, false},
+	}
+	for _, tt := range tests {
+		keys := NewTrustedKeys(root)
+		keys.keys[KeyID(root)] = trustedKey{pub: root, until: tt.rootUntil}
+		published := map[string]trustedKey{KeyID(k2): {pub: k2}}
+		if tt.k1 != nil {
+			published[KeyID(k1)] = *tt.k1
+		}
+		if got := keys.endorsed(chain, published)[KeyID(k2)]; got != tt.want {
+			t.Errorf("%s: k2 endorsed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInlineTicketNeedsRevocations(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := NewTrustedKeys(pub)
+	aname := factotum.Generate("glenda", priv).String()
+	c := NewTicketCache(0)
+
+	tests := []struct {
+		name   string
+		polled time.Time // zero: no poll recorded
+		ename  string
+	}{
+		{"before the first poll", time.Time{}, "revocations_unavailable"},
+		{"fresh poll", time.Now(), ""},
+		{"stale poll", time.Now().Add(-time.Minute), "revocations_unavailable"},
+	}
+	for _, tt := range tests {
+		if !tt.polled.IsZero() {
+			c.Polled(tt.polled, 30*time.Second)
+		}
+		_, err := c.Validate(aname, testVFS, keys, nil, nil)
+		if got := fmt.Sprint(err); (tt.ename == "" && err != nil) || (tt.ename != "" && got != tt.ename) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.ename)
+		}
+	}
+}
+
+func TestAttachNameRedacted(t *testing.T) {
+	const sig = "c2lnbmF0dXJl"
+	tests := []struct {
+		aname  string
+		secret string
+	}{
+		{"glenda 1893456000 abc123 " + sig + " 0011223344556677", sig},
+		{"glenda 1893456000 abc123 " + sig, sig},
+		{"resume 5f0e9c2b7a1d", "5f0e9c2b7a1d"},
+	}
+	for _, tt := range tests {
+		req := &p9.Fcall{Type: p9.Tattach, Tag: 1, Fid: 0, Afid: p9.NOFID, Uname: "glenda", Aname: tt.aname}
+		resp := &p9.Fcall{Type: p9.Rattach, Tag: 1}
+		for _, line := range []string{traceLine(time.Now(), req, resp, "vfs", time.Millisecond), debugLine(req)} {
+			if strings.Contains(line, tt.secret) {
+				t.Errorf("%q leaks %q", line, tt.secret)
+			}
+		}
+	}
+	if got := ticketLabel("/adm/sessions/glenda/abc123"); got != "/adm/sessions/glenda/abc123" {
+		t.Errorf("ticket path relabelled as %q", got)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	type op struct {
+		rate float64 // SetRate if set
+		take float64
+		ok   bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{"unlimited", []op{{take: 1e9, ok: true}, {take: 1e9, ok: true}}},
+		{"starts full", []op{{rate: 10}, {take: 4, ok: true}, {take: 6, ok: true}, {take: 1, ok: false}}},
+		{"oversized request needs a full bucket", []op{{rate: 10}, {take: 50, ok: true}, {take: 50, ok: false}}},
+		{"lowering the rate caps the tokens", []op{{rate: 10}, {rate: 2}, {take: 2, ok: true}, {take: 1, ok: false}}},
+		{"raising the rate keeps the tokens", []op{{rate: 2}, {take: 2, ok: true}, {rate: 10}, {take: 1, ok: false}}},
+		{"lifting the limit", []op{{rate: 1}, {take: 1, ok: true}, {rate: 0}, {take: 100, ok: true}}},
+	}
+	for _, tt := range tests {
+		var b Bucket
+		for i, o := range tt.ops {
+			if o.rate != 0 || o.take == 0 {
+				b.SetRate(o.rate)
+				continue
+			}
+			if got := b.Take(o.take); got != o.ok {
+				t.Errorf("%s: op %d Take(%v) = %v, want %v (%s)", tt.name, i, o.take, got, o.ok, b.String())
+			}
+		}
+	}
+
+	// Tokens come back at the rate
+	var b Bucket
+	b.SetRate(100)
+	b.Take(100)
+	time.Sleep(50 * time.Millisecond)
+	if !b.Take(4) {
+		t.Errorf("no tokens back after 50ms at 100/s: %s", b.String())
+	}
+}
+
+func TestAnonymousQuota(t *testing.T) {
+	l := NewLimiter()
+	l.Set(map[string]Limits{"none": {Sessions: 1}, "glenda": {Sessions: 1}})
+	tests := []struct {
+		user, transport string
+		ok              bool
+	}{
+		{"none", "tcp!10.0.0.1:4001", true},
+		{"none", "tcp!10.0.0.1:4002", false},
+		{"none", "ws!10.0.0.2:4001", true},
+		{"none", "tls!10.0.0.3:4001", true},
+		{"glenda", "tcp!10.0.0.1:4003", true},
+		{"glenda", "tcp!10.0.0.4:4001", false},
+	}
+	for _, tt := range tests {
+		s := &Session{transport: tt.transport}
+		if err := l.Admit(tt.user, s.quotaKey(tt.user)); (err == nil) != tt.ok {
+			t.Errorf("%s from %s: %v, want ok=%v", tt.user, tt.transport, err, tt.ok)
+		}
+	}
+	if got := l.Sessions("none", (&Session{transport: "tcp!10.0.0.1:5000"}).quotaKey("none")); got != "1/1" {
+		t.Errorf("none from 10.0.0.1: sessions %s, want 1/1", got)
+	}
+}
+
+func TestServerConfigClientAuth(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	tests := []struct {
+		name string
+		t    TLSSettings
+		ok   bool
+	}{
+		{"no client auth", TLSSettings{}, true},
+		{"system roots", TLSSettings{ClientAuth: true}, false},
+		{"ca", TLSSettings{ClientAuth: true, Roots: x509.NewCertPool()}, true},
+		{"pins", TLSSettings{ClientAuth: true, Pins: []ed25519.PublicKey{pub}}, true},
+	}
+	for _, tt := range tests {
+		cfg, err := tt.t.ServerConfig()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok=%v", tt.name, err, tt.ok)
+		}
+		if err == nil && tt.t.ClientAuth && cfg.ClientAuth != tls.RequireAnyClientCert {
+			t.Errorf("%s: client certificates not required", tt.name)
+		}
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca, caKey := testCA(t)
+	otherCA, otherKey := testCA(t)
+	_, hostPriv, _ := ed25519.GenerateKey(nil)
+	host := &HostIdentity{Key: hostPriv}
+	hostCert, err := host.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPub := hostPriv.Public().(ed25519.PublicKey)
+	unrelated, _, _ := ed25519.GenerateKey(nil)
+
+	server := testCert(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	client := testCert(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+	strangerServer := testCert(t, otherCA, otherKey, x509.ExtKeyUsageServerAuth)
+	strangerClient := testCert(t, otherCA, otherKey, x509.ExtKeyUsageClientAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		name   string
+		server TLSSettings // listener; its Cert is served
+		client TLSSettings // dialer of "vfs"; its Cert is presented
+		ok     bool
+	}{
+		{"ca server", TLSSettings{Cert: &server}, TLSSettings{Roots: roots}, true},
+		{"pinned server", TLSSettings{Cert: &hostCert}, TLSSettings{Pins: []ed25519.PublicKey{hostPub}}, true},
+		{"ca client", TLSSettings{Cert: &hostCert, Roots: roots, ClientAuth: true}, TLSSettings{Cert: &client, Pins: []ed25519.PublicKey{hostPub}}, true},
+		{"pinned client", TLSSettings{Cert: &server, Pins: []ed25519.PublicKey{hostPub}, ClientAuth: true}, TLSSettings{Cert: &hostCert, Roots: roots}, true},
+		{"server from untrusted ca", TLSSettings{Cert: &strangerServer}, TLSSettings{Roots: roots}, false},
+		{"unpinned server", TLSSettings{Cert: &server}, TLSSettings{Pins: []ed25519.PublicKey{unrelated}}, false},
+		{"client from untrusted ca", TLSSettings{Cert: &hostCert, Roots: roots, ClientAuth: true}, TLSSettings{Cert: &strangerClient, Pins: []ed25519.PublicKey{hostPub}}, false},
+		{"unpinned client", TLSSettings{Cert: &server, Pins: []ed25519.PublicKey{unrelated}, ClientAuth: true}, TLSSettings{Cert: &hostCert, Roots: roots}, false},
+		{"no client certificate", TLSSettings{Cert: &server, Roots: roots, ClientAuth: true}, TLSSettings{Roots: roots}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scfg, err := tt.server.ServerConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Loopback TCP rather than net.Pipe: alerts must not block on
+			// a peer that is busy writing.
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			serr := make(chan error, 1)
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					serr <- err
+					return
+				}
+				defer c.Close()
+				srv := tls.Server(c, scfg)
+				if err = srv.Handshake(); err == nil {
+					_, err = srv.Read(make([]byte, 1))
+				}
+				serr <- err
+			}()
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			// A TLS 1.3 client finishes before the server has checked its
+			// certificate, so the server's verdict comes with the first read.
+			cli := tls.Client(c, tt.client.ClientConfig("vfs"))
+			cerr := cli.Handshake()
+			if cerr == nil {
+				_, cerr = cli.Write([]byte("x"))
+			}
+			err = <-serr
+			if ok := cerr == nil && err == nil; ok != tt.ok {
+				t.Fatalf("client: %v, server: %v; want ok=%v", cerr, err, tt.ok)
+			}
+		})
+	}
+}
+
+// testCA creates a self-signed CA certificate.
+func testCA(t *testing.T) (*x509.Certificate, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, priv
+}
+
+// testCert issues a certificate for "vfs" from ca with usage.
+func testCert(t *testing.T, ca *x509.Certificate, caKey ed25519.PrivateKey, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "vfs"},
+		DNSNames:     []string{"vfs"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+func TestTCPTransportMsize(t *testing.T) {
+	clunk, _ := (&p9.Fcall{Type: p9.Tclunk, Tag: 1, Fid: 1}).Bytes()
+	header := func(size uint32) []byte {
+		return binary.LittleEndian.AppendUint32(nil, size)
+	}
+	tests := []struct {
+		name  string
+		msize uint32
+		msg   []byte
+		ok    bool
+	}{
+		{"message", 8192, clunk, true},
+		{"default msize", 0, clunk, true},
+		{"over msize", 8192, header(8193), false},
+		{"over MaxMsize", 0, header(MaxMsize + 1), false},
+		{"huge", 8192, header(^uint32(0)), false},
+		{"too short", 8192, header(6), false},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		tr := &TCPTransport{conn: c2}
+		tr.SetMsize(tt.msize)
+		go c1.Write(tt.msg)
+		_, err := tr.ReadMsg(context.Background())
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok=%v", tt.name, err, tt.ok)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestExportHandshake(t *testing.T) {
+	ts := newTestSystem(t)
+	newHost := func() *HostIdentity {
+		_, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &HostIdentity{Key: priv}
+	}
+	pub64 := func(h *HostIdentity) string {
+		return base64.StdEncoding.EncodeToString(h.Key.Public().(ed25519.PublicKey))
+	}
+	glendas, anyone, stranger := newHost(), newHost(), newHost()
+	peers, err := ParseExportKeys(pub64(glendas) + ":glenda, " + pub64(anyone) + ":*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const addr = "tcp!export!9010"
+	ln, err := ts.pipes.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s := NewSession(&TCPTransport{conn: c}, testVFS, ts.keys, ts.host, ts.pipes)
+			s.peers = peers
+			go s.Serve()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		host *HostIdentity
+		user string
+		ok   bool
+	}{
+		{"listed user", glendas, "glenda", true},
+		{"unlisted user", glendas, "bob", false},
+		{"any user", anyone, "bob", true},
+		{"adm by any", anyone, "adm", false},
+		{"none", anyone, "none", false},
+		{"unknown key", stranger, "glenda", false},
+	}
+	for _, tt := range tests {
+		client, err := Import(ts.pipes, addr, tt.user, "/", tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok=%v", tt.name, err, tt.ok)
+		}
+		if client != nil {
+			client.Close()
+		}
+	}
+
+	// A bare signature over the nonce, as any other challenge would get,
+	// is not an import signature
+	client, err := ts.pipes.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	kid := KeyID(glendas.Key.Public().(ed25519.PublicKey))
+	mustRPC(t, client, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	mustRPC(t, client, &p9.Fcall{Type: p9.Tauth, Afid: 1, Uname: "glenda", Aname: kid})
+	nonce := mustRPC(t, client, &p9.Fcall{Type: p9.Tread, Fid: 1, Count: 32}).Data
+	for _, msg := range [][]byte{nonce, importMessage(KeyID(anyone.Key.Public().(ed25519.PublicKey)), nonce)} {
+		resp, err := client.RPC(&p9.Fcall{Type: p9.Twrite, Fid: 1, Data: glendas.Sign(msg)})
+		if err != nil || resp.Type != p9.Rerror {
+			t.Errorf("signature over %q accepted: %v %v", msg, resp, err)
+		}
+	}
+}
+
+func TestEnvFormat(t *testing.T) {
+	vars := map[string]string{
+		"path":   "/bin\x00.\x00", // rc list: each element NUL-terminated
+		"empty":  "",
+		"prompt": "% \n",
+		"quoted": `say "hi"`,
+	}
+	data := FormatEnv(vars)
+	if got := ParseEnv(data); !reflect.DeepEqual(got, vars) {
+		t.Fatalf("ParseEnv(FormatEnv(%q)) = %q", vars, got)
+	}
+	// Malformed lines are skipped, the rest still parse
+	got := ParseEnv("=\"x\"\nbad\nunquoted=x\n" + data)
+	if !reflect.DeepEqual(got, vars) {
+		t.Fatalf("with malformed lines: %q", got)
+	}
+}
+
+func TestEnvStoreMerge(t *testing.T) {
+	ts := newTestSystem(t)
+	// The user has no /usr/glenda/lib yet; the first save provisions it
+	Homes.Forget("glenda")
+	defer Homes.Forget("glenda")
+	stores := []*envStore{
+		newEnvStore(testVFS, ts.pipes, ts.host, "glenda"),
+		newEnvStore(testVFS, ts.pipes, ts.host, "glenda"),
+	}
+	want := make(map[string]string)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		name, val := fmt.Sprintf("v%d", i), fmt.Sprintf("%d\x00", i)
+		want[name] = val
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stores[i%2].Set(name, &val)
+		}()
+	}
+	wg.Wait()
+
+	file := filepath.Join(ts.root, "usr", "glenda", "lib", "env")
+	waitFor(t, "every change to be saved", func() bool {
+		data, err := os.ReadFile(file)
+		return err == nil && reflect.DeepEqual(ParseEnv(string(data)), want)
+	})
+
+	// A removal from one session leaves the other's changes alone
+	stores[0].Set("v1", nil)
+	delete(want, "v1")
+	waitFor(t, "the removal to be saved", func() bool {
+		data, err := os.ReadFile(file)
+		return err == nil && reflect.DeepEqual(ParseEnv(string(data)), want)
+	})
+}
+
+func TestEnvGroupRefs(t *testing.T) {
+	group := func() *EnvFS {
+		EnvGroups.mu.Lock()
+		defer EnvGroups.mu.Unlock()
+		return EnvGroups.groups["glenda"]
+	}
+	c1 := EnvGroups.Dial("glenda")
+	c2 := EnvGroups.Dial("glenda")
+	fs := group()
+	if fs == nil {
+		t.Fatal("no group after Dial")
+	}
+
+	// The group outlives the first of its connections
+	c1.Close()
+	time.Sleep(10 * time.Millisecond)
+	if group() != fs {
+		t.Fatal("group dropped while still connected")
+	}
+	c2.Close()
+	waitFor(t, "the group to be dropped", func() bool { return group() == nil })
+
+	// A later Dial starts afresh
+	c3 := EnvGroups.Dial("glenda")
+	defer c3.Close()
+	if g := group(); g == nil || g == fs {
+		t.Fatal("Dial did not create a new group")
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	a := cacheKey{backend: "vfs:9001", path: 1}
+	b := cacheKey{backend: "vfs:9001", path: 2}
+	other := cacheKey{backend: "vfs:9002", path: 1}
+	c := NewFileCache(16)
+	c.Fill(a, 1, 0, []byte("hello"))
+	c.Fill(a, 1, 5, []byte(" world"))
+	c.Fill(a, 1, 11, nil) // end of file
+	c.Fill(b, 1, 4, []byte("gap"))
+
+	tests := []struct {
+		name   string
+		key    cacheKey
+		vers   uint32
+		offset uint64
+		count  uint32
+		want   string
+		hit    bool
+	}{
+		{"prefix", a, 1, 0, 5, "hello", true},
+		{"extended", a, 1, 6, 5, "world", true},
+		{"past the end of a whole file", a, 1, 8, 100, "rld", true},
+		{"other backend", other, 1, 0, 5, "", false},
+		{"not contiguous", b, 1, 4, 3, "", false},
+		{"new version", a, 2, 0, 5, "", false},
+		{"stale entry dropped", a, 1, 0, 5, "", false},
+	}
+	for _, tt := range tests {
+		data, hit := c.Read(tt.key, tt.vers, tt.offset, tt.count)
+		if hit != tt.hit || string(data) != tt.want {
+			t.Errorf("%s: got %q, %v; want %q, %v", tt.name, data, hit, tt.want, tt.hit)
+		}
+	}
+
+	// Stats share the entry and its version
+	c.FillStat(b, 3, []byte("stat"))
+	if stat, ok := c.Stat(b, 3); !ok || string(stat) != "stat" {
+		t.Errorf("Stat = %q, %v", stat, ok)
+	}
+	c.Invalidate(b)
+	if _, ok := c.Stat(b, 3); ok {
+		t.Error("stat cached after Invalidate")
+	}
+
+	// Least recently used files go first
+	c.Fill(a, 1, 0, []byte("0123456789"))
+	c.Fill(b, 1, 0, []byte("abcdef"))
+	c.Read(a, 1, 0, 1)
+	c.Fill(other, 1, 0, []byte("xyz"))
+	if _, ok := c.Read(b, 1, 0, 1); ok {
+		t.Errorf("b not evicted: %s", c.String())
+	}
+	if _, ok := c.Read(a, 1, 0, 1); !ok {
+		t.Errorf("a evicted: %s", c.String())
+	}
+	c.SetMax(0)
+	if s := c.String(); !strings.HasPrefix(s, "bytes=0/0 files=0") {
+		t.Errorf("after SetMax(0): %s", s)
+	}
+}
+
+func TestImportAllowed(t *testing.T) {
+	defer func(addrs []string) { ImportAddrs = addrs }(ImportAddrs)
+	ImportAddrs = []string{"tcp!peer!9010"}
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"tcp!peer!9010", true},
+		{"peer!9010", true},
+		{"tcp!peer!9011", false},
+		{"tcp!evil!9010", false},
+	}
+	for _, tt := range tests {
+		if got := importAllowed(tt.addr); got != tt.ok {
+			t.Errorf("importAllowed(%s) = %v, want %v", tt.addr, got, tt.ok)
+		}
+	}
+}
+
+func TestRamFS(t *testing.T) {
+	c := NewTmpClient("glenda")
+	defer c.Close()
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "glenda"})
+
+	tests := []struct {
+		name string
+		req  *p9.Fcall
+		want string // Rread data, or the Ename of an Rerror
+	}{
+		{"create dir", &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1}, ""},
+		{"create dir", &p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "d", Perm: p9.DMDIR | 0777, Mode: p9.OREAD}, ""},
+		{"create file", &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 2, Wname: []string{"d"}}, ""},
+		{"create file", &p9.Fcall{Type: p9.Tcreate, Fid: 2, Name: "f", Perm: 0666, Mode: p9.ORDWR}, ""},
+		{"create again", &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 3, Wname: []string{"d"}}, ""},
+		{"create again", &p9.Fcall{Type: p9.Tcreate, Fid: 3, Name: "f", Perm: 0666, Mode: p9.ORDWR}, "file exists"},
+		{"write", &p9.Fcall{Type: p9.Twrite, Fid: 2, Data: []byte("hello world")}, ""},
+		{"overwrite", &p9.Fcall{Type: p9.Twrite, Fid: 2, Offset: 6, Data: []byte("there")}, ""},
+		{"read", &p9.Fcall{Type: p9.Tread, Fid: 2, Count: 100}, "hello there"},
+		{"read at offset", &p9.Fcall{Type: p9.Tread, Fid: 2, Offset: 6, Count: 3}, "the"},
+		{"read past end", &p9.Fcall{Type: p9.Tread, Fid: 2, Offset: 100, Count: 3}, ""},
+		{"walk to file", &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 4, Wname: []string{"d", "f"}}, ""},
+		{"write unopened", &p9.Fcall{Type: p9.Twrite, Fid: 4, Data: []byte("x")}, "file not open for writing"},
+		{"rename", wstatName(4, "g"), ""},
+		{"walk to dir", &p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 6, Wname: []string{"d"}}, ""},
+		{"walk old name", &p9.Fcall{Type: p9.Twalk, Fid: 6, Newfid: 5, Wname: []string{"f"}}, "not found"},
+		{"remove full dir", &p9.Fcall{Type: p9.Tremove, Fid: 1}, "directory not empty"},
+		{"remove file", &p9.Fcall{Type: p9.Tremove, Fid: 4}, ""},
+		{"walk removed", &p9.Fcall{Type: p9.Twalk, Fid: 6, Newfid: 5, Wname: []string{"g"}}, "not found"},
+		{"remove root", &p9.Fcall{Type: p9.Tremove, Fid: 0}, "permission denied"},
+	}
+	for _, tt := range tests {
+		resp, err := c.RPC(tt.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := string(resp.Data)
+		if resp.Type == p9.Rerror {
+			got = resp.Ename
+		}
+		if got != tt.want {
+			t.Fatalf("%s %s: got %q, want %q", tt.name, p9.TypeName(tt.req.Type), got, tt.want)
+		}
+	}
+}
+
+// wstatName is a Twstat of fid changing only the name.
+func wstatName(fid uint32, name string) *p9.Fcall {
+	d := p9.Dir{Type: 0xFFFF, Dev: 0xFFFFFFFF, Mode: 0xFFFFFFFF, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF, Length: ^uint64(0), Name: name}
+	d.Qid = p9.Qid{Type: 0xFF, Vers: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF}
+	return &p9.Fcall{Type: p9.Twstat, Fid: fid, Stat: d.Bytes()}
+}
+
+func TestNoteQueue(t *testing.T) {
+	q := NewNoteQueue()
+	tests := []struct {
+		note string
+		ok   bool
+	}{
+		{"", false},
+		{strings.Repeat("x", maxNoteLen+1), false},
+		{strings.Repeat("x", maxNoteLen), true},
+		{"interrupt", true},
+	}
+	for _, tt := range tests {
+		if err := q.Post(tt.note); (err == nil) != tt.ok {
+			t.Errorf("Post(%.10q): %v, want ok=%v", tt.note, err, tt.ok)
+		}
+	}
+	for i := 2; i < maxNotes; i++ {
+		if err := q.Post("hangup"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Post("hangup"); err == nil {
+		t.Error("queue took more than maxNotes")
+	}
+
+	// Oldest first, one per read
+	ctx := context.Background()
+	for i, want := range []string{strings.Repeat("x", maxNoteLen), "interrupt", "hangup"} {
+		if note, err := q.Read(ctx); err != nil || note != want {
+			t.Fatalf("read %d: %.10q, %v; want %.10q", i, note, err, want)
+		}
+	}
+	for i := 3; i < maxNotes; i++ {
+		q.Read(ctx)
+	}
+
+	// An empty queue blocks until a post or the context ends
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Read(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read of empty queue: %v", err)
+	}
+	got := make(chan string)
+	go func() {
+		note, _ := q.Read(context.Background())
+		got <- note
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Post("alarm")
+	if note := <-got; note != "alarm" {
+		t.Fatalf("blocked read got %q", note)
+	}
+}
+
+func TestInterruptSparesNotes(t *testing.T) {
+	ts := newTestSystem(t)
+	s, c := ts.attach(t)
+	open(t, c, 1, p9.OREAD, "dev", "note")
+	open(t, c, 2, p9.OREAD, "dev", "cons")
+
+	reads := make(map[uint32]chan string)
+	for _, fid := range []uint32{1, 2} {
+		reads[fid] = make(chan string, 1)
+		go func() {
+			resp, err := c.RPC(&p9.Fcall{Type: p9.Tread, Fid: fid, Count: 128})
+			switch {
+			case err != nil:
+				reads[fid] <- err.Error()
+			case resp.Type == p9.Rerror:
+				reads[fid] <- resp.Ename
+			default:
+				reads[fid] <- string(resp.Data)
+			}
+		}()
+	}
+	waitFor(t, "both reads to block", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.inflight) == 2
+	})
+
+	if err := s.Note("interrupt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-reads[1]; got != "interrupt" {
+		t.Errorf("/dev/note read %q, want the note", got)
+	}
+	if got := <-reads[2]; got != "interrupted" {
+		t.Errorf("/dev/cons read %q, want interrupted", got)
+	}
+}
+
+func TestPostsNotes(t *testing.T) {
+	dev, proc, backend := &Client{addr: devAddr}, &Client{addr: procAddr}, &Client{addr: testVFS}
+	tests := []struct {
+		name string
+		ref  fidRef
+		want bool
+	}{
+		{"dev note", fidRef{client: dev, path: "/dev/note", qid: p9.Qid{Path: QidDevNote}}, true},
+		{"dev wall bound elsewhere", fidRef{client: dev, path: "/n/dev/wall", qid: p9.Qid{Path: QidDevWall}}, true},
+		{"dev cons", fidRef{client: dev, path: "/dev/cons", qid: p9.Qid{Path: QidDevCons}}, false},
+		{"proc note", fidRef{client: proc, path: "/proc/7/note", qid: p9.Qid{Path: 7<<8 | QidProcNote}}, true},
+		{"proc ctl", fidRef{client: proc, path: "/proc/7/ctl", qid: p9.Qid{Path: 7<<8 | 2}}, false},
+		{"backend file named note", fidRef{client: backend, path: "/usr/glenda/note", qid: p9.Qid{Path: QidDevNote}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.ref.postsNotes(); got != tt.want {
+			t.Errorf("%s: postsNotes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRamFSBounds(t *testing.T) {
+	fs := NewRamFS("glenda", 1024)
+	fids := make(map[uint32]*ramFid)
+	must := func(req *p9.Fcall) {
+		t.Helper()
+		if resp := fs.handle(req, fids); resp.Type == p9.Rerror {
+			t.Fatalf("%s: %s", p9.TypeName(req.Type), resp.Ename)
+		}
+	}
+	must(&p9.Fcall{Type: p9.Tattach, Fid: 0, Uname: "glenda"})
+	must(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: 1})
+	must(&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "f", Perm: 0666, Mode: p9.ORDWR})
+
+	tests := []struct {
+		name string
+		req  *p9.Fcall
+		ok   bool
+	}{
+		{"write in bounds", &p9.Fcall{Type: p9.Twrite, Fid: 1, Offset: 1000, Data: []byte("abc")}, true},
+		{"write past max", &p9.Fcall{Type: p9.Twrite, Fid: 1, Offset: 1022, Data: []byte("abc")}, false},
+		{"write at 2^63", &p9.Fcall{Type: p9.Twrite, Fid: 1, Offset: 1 << 63, Data: []byte("abc")}, false},
+		{"write at 2^64-1", &p9.Fcall{Type: p9.Twrite, Fid: 1, Offset: ^uint64(0), Data: []byte("abc")}, false},
+		{"wstat length 2^63", wstatLength(1, 1<<63), false},
+		{"wstat length 2^64-2", wstatLength(1, ^uint64(0)-1), false},
+		{"wstat length max", wstatLength(1, 1024), true},
+		{"wstat length 0", wstatLength(1, 0), true},
+	}
+	for _, tt := range tests {
+		resp := fs.handle(tt.req, fids)
+		if ok := resp.Type != p9.Rerror; ok != tt.ok {
+			t.Errorf("%s: got %s %q, want ok=%v", tt.name, p9.TypeName(resp.Type), resp.Ename, tt.ok)
+		}
+	}
+	if fs.size != 0 {
+		t.Errorf("size = %d after truncating, want 0", fs.size)
+	}
+}
+
+// wstatLength is a Twstat of fid changing only the length.
+func wstatLength(fid uint32, length uint64) *p9.Fcall {
+	d := p9.Dir{Type: 0xFFFF, Dev: 0xFFFFFFFF, Mode: 0xFFFFFFFF, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF, Length: length}
+	d.Qid = p9.Qid{Type: 0xFF, Vers: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF}
+	return &p9.Fcall{Type: p9.Twstat, Fid: fid, Stat: d.Bytes()}
+}
+
+// gatedDialer holds its first dial until gate is closed.
+type gatedDialer struct {
+	Dialer
+	gate  chan struct{}
+	first atomic.Bool
+}
+
+func (d *gatedDialer) Dial(addr string) (*Client, error) {
+	if d.first.CompareAndSwap(false, true) {
+		<-d.gate
+	}
+	return d.Dialer.Dial(addr)
+}
+
+func TestHomeProvision(t *testing.T) {
+	ts := newTestSystem(t)
+	homes := &HomeTable{done: make(map[string]bool), busy: make(map[string]chan struct{})}
+	d := &gatedDialer{Dialer: ts.pipes, gate: make(chan struct{})}
+
+	// glenda's provisioning stalls in VFS; bob's and a second glenda login's go ahead
+	results := make(chan bool, 2)
+	for range 2 {
+		go func() {
+			created, err := homes.Provision(testVFS, d, ts.host, "glenda")
+			if err != nil {
+				t.Error(err)
+			}
+			results <- created
+		}()
+	}
+	waitFor(t, "glenda's provisioning to start", d.first.Load)
+	if created, err := homes.Provision(testVFS, d, ts.host, "bob"); err != nil || !created {
+		t.Fatalf("bob: created %v, %v", created, err)
+	}
+	select {
+	case <-results:
+		t.Fatal("glenda provisioned while VFS was stalled")
+	default:
+	}
+
+	close(d.gate)
+	if a, b := <-results, <-results; a == b {
+		t.Fatalf("concurrent logins created %v and %v, want exactly one", a, b)
+	}
+	for _, dir := range homeDirs {
+		if _, err := os.Stat(filepath.Join(ts.root, "usr", "glenda", dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created, err := homes.Provision(testVFS, d, ts.host, "glenda"); err != nil || created {
+		t.Fatalf("later login: created %v, %v", created, err)
+	}
+}
+
+func TestServicesVisibility(t *testing.T) {
+	listed := Services.Track("listed:9100", nil, true)
+	private := Services.Track("private:9100", nil, false)
+	t.Cleanup(func() {
+		Services.forget(listed.Addr)
+		Services.forget(private.Addr)
+	})
+	private.result(0, errors.New("dial tcp 10.1.2.3:9100: connection refused"))
+	listed.result(0, errors.New("dial tcp 10.1.2.4:9100: connection refused"))
+
+	names := func(user string) map[string]bool {
+		b := readServices("", user)
+		got := make(map[string]bool)
+		for len(b) > 0 {
+			d, n, err := p9.UnmarshalDir(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[d.Name] = true
+			b = b[n:]
+		}
+		return got
+	}
+	tests := []struct {
+		user    string
+		private bool
+		errs    bool
+	}{
+		{"adm", true, true},
+		{"glenda", false, false},
+		{"none", false, false},
+	}
+	for _, tt := range tests {
+		got := names(tt.user)
+		if !got["tcp!listed!9100"] || got["tcp!private!9100"] != tt.private {
+			t.Errorf("%s lists %v", tt.user, got)
+		}
+		if line := string(readServices("tcp!private!9100", tt.user)); (line != "") != tt.private {
+			t.Errorf("%s reads private service as %q", tt.user, line)
+		}
+		if line := string(readServices("tcp!listed!9100", tt.user)); strings.Contains(line, "10.1.2.4") != tt.errs {
+			t.Errorf("%s reads listed service as %q", tt.user, line)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := RetryConfig{MaxRetries: 2, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond, Multiplier: 2}
+	b := NewCircuitBreaker(cfg)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	wait := func(d time.Duration) func() { return func() { now = now.Add(d) } }
+	tests := []struct {
+		name  string
+		do    func()
+		allow bool
+		state string
+	}{
+		{"new", func() {}, true, "closed"},
+		{"one failure", b.Failure, true, "closed"},
+		{"threshold", b.Failure, false, "open"},
+		{"cooling down", wait(19 * time.Millisecond), false, "open"},
+		{"cooldown over", wait(time.Millisecond), true, "halfopen"},
+		{"trial fails", b.Failure, false, "open"},
+		{"longer cooldown", wait(29 * time.Millisecond), false, "open"},
+		{"capped cooldown over", wait(time.Millisecond), true, "halfopen"},
+		{"trial succeeds", b.Success, true, "closed"},
+		{"failures reset", b.Failure, true, "closed"},
+	}
+	for _, tt := range tests {
+		tt.do()
+		if got := b.Allow(); got != tt.allow {
+			t.Fatalf("%s: Allow() = %v, want %v", tt.name, got, tt.allow)
+		}
+		if got := b.State(); got != tt.state {
+			t.Fatalf("%s: state %s, want %s", tt.name, got, tt.state)
+		}
+	}
+}
+
+// serveRamFS serves a RamFS owned by owner at addr in pipes, returning a
+// function that takes the replica down: it stops listening and hangs up
+// every connection.
+func serveRamFS(t *testing.T, pipes *PipeDialer, addr, owner string) (kill func()) {
+	t.Helper()
+	ln, err := pipes.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewRamFS(owner, 1<<20)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go fs.Serve(c)
+		}
+	}()
+	kill = func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	t.Cleanup(kill)
+	return kill
+}
+
+func TestReplicaFailover(t *testing.T) {
+	t.Cleanup(Health.Stop)
+	pipes := NewPipeDialer()
+	killA := serveRamFS(t, pipes, "tcp!replica-a!9001", "a")
+	serveRamFS(t, pipes, "tcp!replica-b!9001", "b")
+
+	c, err := DialReplicated(pipes, []string{"replica-a:9001", "replica-b:9001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	attach := &p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "glenda"}
+	stat := &p9.Fcall{Type: p9.Tstat, Fid: 0}
+	tests := []struct {
+		name  string
+		do    func()
+		req   *p9.Fcall
+		owner string // "" for an error
+	}{
+		{"attach", func() {}, attach, ""},
+		{"first replica", func() {}, stat, "a"},
+		{"fid lost with the replica", killA, stat, ""},
+		{"attach fails over", func() {}, attach, ""},
+		{"second replica", func() {}, stat, "b"},
+	}
+	for _, tt := range tests {
+		tt.do()
+		resp, err := c.RPC(tt.req)
+		if tt.req.Type == p9.Tattach {
+			if err != nil || resp.Type != p9.Rattach {
+				t.Fatalf("%s: %v %v", tt.name, resp, err)
+			}
+			continue
+		}
+		if tt.owner == "" {
+			if err == nil && resp.Type != p9.Rerror {
+				t.Fatalf("%s: got %v, want an error", tt.name, resp)
+			}
+			continue
+		}
+		if err != nil || resp.Type != p9.Rstat {
+			t.Fatalf("%s: %v %v", tt.name, resp, err)
+		}
+		d, _, err := p9.UnmarshalDir(resp.Stat)
+		if err != nil || d.Uid != tt.owner {
+			t.Fatalf("%s: served by %q (%v), want %q", tt.name, d.Uid, err, tt.owner)
+		}
+	}
+	if s := Health.String(); !strings.Contains(s, "replica-a:9001 closed fails=") || strings.Contains(s, "replica-a:9001 closed fails=0") {
+		t.Errorf("replica a's failure not recorded:\n%s", s)
+	}
+}
+
+func TestReadCountClamped(t *testing.T) {
+	ts := newTestSystem(t)
+	_, c := ts.attach(t)
+	open(t, c, 1, p9.OREAD, "dev", "random")
+	resp := mustRPC(t, c, &p9.Fcall{Type: p9.Tread, Fid: 1, Count: 1 << 30})
+	if len(resp.Data) != 8192-IOHDRSZ {
+		t.Fatalf("read %d bytes at msize 8192, want %d", len(resp.Data), 8192-IOHDRSZ)
+	}
+}
+
+func TestSessionShutdown(t *testing.T) {
+	ts := newTestSystem(t)
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		post    bool   // post a note so the blocked read finishes
+		err     error  // from Shutdown
+		read    string // the blocked read's data; "" if it failed
+	}{
+		{"drained", 5 * time.Second, true, nil, "alarm"},
+		{"cut short", 50 * time.Millisecond, false, context.DeadlineExceeded, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := ts.attach(t)
+			open(t, c, 1, p9.OREAD, "dev", "note")
+			read := make(chan string, 1)
+			go func() {
+				resp, err := c.RPC(&p9.Fcall{Type: p9.Tread, Fid: 1, Count: 128})
+				if err != nil {
+					read <- ""
+					return
+				}
+				read <- string(resp.Data)
+			}()
+			waitFor(t, "read outstanding", s.busy)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- s.Shutdown(ctx) }()
+			waitFor(t, "draining", s.draining.Load)
+
+			// New requests are refused while the old one drains
+			resp, err := c.RPC(&p9.Fcall{Type: p9.Tstat, Fid: 0})
+			if err != nil || resp.Ename != "kernel_shutting_down" {
+				t.Fatalf("request while draining: %v %v", resp, err)
+			}
+			if tt.post {
+				s.notes.Post("alarm")
+			}
+			if got := <-read; got != tt.read {
+				t.Errorf("blocked read got %q, want %q", got, tt.read)
+			}
+			if err := <-done; !errors.Is(err, tt.err) {
+				t.Errorf("Shutdown: %v, want %v", err, tt.err)
+			}
+			select {
+			case <-s.done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve did not return")
+			}
+		})
+	}
+}
+
+func TestSessionWatchdog(t *testing.T) {
+	saved := Timeouts
+	t.Cleanup(func() { Timeouts = saved })
+	ts := newTestSystem(t)
+
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		lifetime time.Duration
+		busy     bool // keep a blocking read outstanding
+		active   bool // keep sending requests
+		hangup   bool
+	}{
+		{"idle", 50 * time.Millisecond, 0, false, false, true},
+		{"blocked read is not idle", 50 * time.Millisecond, 0, true, false, false},
+		{"lifetime", 0, 150 * time.Millisecond, false, true, true},
+		{"active", 50 * time.Millisecond, 0, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Timeouts.Idle, Timeouts.Lifetime = tt.idle, tt.lifetime
+			s, conn := ts.session(t)
+			c := &Client{addr: "test", conn: conn, tag: 1}
+			// Serve has read Timeouts by the time it returns
+			defer func() { conn.Close(); <-s.done }()
+			mustRPC(t, c, &p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+			mustRPC(t, c, &p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: p9.NOFID, Uname: "none"})
+			if tt.busy {
+				open(t, c, 1, p9.OREAD, "dev", "note")
+				go c.RPC(&p9.Fcall{Type: p9.Tread, Fid: 1, Count: 128})
+			}
+			stop := make(chan struct{})
+			defer close(stop)
+			if tt.active {
+				go func() {
+					for {
+						select {
+						case <-stop:
+							return
+						case <-time.After(10 * time.Millisecond):
+							c.RPC(&p9.Fcall{Type: p9.Tstat, Fid: 0})
+						}
+					}
+				}()
+			}
+
+			// Hang-ups come within a few watchdog ticks; survivors are
+			// checked after several idle periods.
+			wait := 300 * time.Millisecond
+			if tt.hangup {
+				wait = 5 * time.Second
+			}
+			select {
+			case <-s.done:
+				if !tt.hangup {
+					t.Fatal("session hung up")
+				}
+			case <-time.After(wait):
+				if tt.hangup {
+					t.Fatal("session not hung up")
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	saved := Timeouts
+	t.Cleanup(func() { Timeouts = saved })
+	Timeouts.Ping = 50 * time.Millisecond
+
+	dropped := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sock, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		_, err = sock.ReadMsg(context.Background())
+		dropped <- err
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		answers bool // the client reads, so it answers pings
+		dropped bool
+	}{
+		{"answers pings", true, false},
+		{"silent peer", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{Subprotocols: []string{Subprotocol}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.CloseNow()
+			if tt.answers {
+				c.CloseRead(ctx)
+			}
+
+			wait := 300 * time.Millisecond
+			if tt.dropped {
+				wait = 5 * time.Second
+			}
+			select {
+			case err := <-dropped:
+				if !tt.dropped {
+					t.Fatalf("connection dropped: %v", err)
+				}
+			case <-time.After(wait):
+				if tt.dropped {
+					t.Fatal("silent peer not dropped")
+				}
+				c.CloseNow()
+				<-dropped
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
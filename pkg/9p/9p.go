@@ -53,6 +53,21 @@ const (
 	Rwstat
 )
 
+var typeNames = [...]string{
+	"Tversion", "Rversion", "Tauth", "Rauth", "Tattach", "Rattach", "Terror", "Rerror",
+	"Tflush", "Rflush", "Twalk", "Rwalk", "Topen", "Ropen", "Tcreate", "Rcreate",
+	"Tread", "Rread", "Twrite", "Rwrite", "Tclunk", "Rclunk", "Tremove", "Rremove",
+	"Tstat", "Rstat", "Twstat", "Rwstat",
+}
+
+// TypeName returns the name of a message type, e.g. "Twalk".
+func TypeName(t uint8) string {
+	if t >= Tversion && int(t-Tversion) < len(typeNames) {
+		return typeNames[t-Tversion]
+	}
+	return fmt.Sprintf("T%d", t)
+}
+
 // --- Permissions (Mode bits) ---
 
 const (
@@ -14,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/coder/websocket/wsjson"
@@ -74,11 +75,21 @@ type Server struct {
 	FactotumAddr string
 	TemplatesDir string
 	StaticDir    string
+	Origins      []string      // cross-origin hosts allowed on /ws (WS_ORIGINS)
+	Dialer       kernel.Dialer // reaches the Kernel and Factotum
 	tmpl         *template.Template
 }
 
 // Start launches the SSR HTTP server.
 func Start(httpAddr, kernelAddr, factotumAddr string) error {
+	s := NewServer(kernelAddr, factotumAddr)
+	log.Printf("SSR Gateway listening on %s (Kernel: %s, Factotum: %s)", httpAddr, kernelAddr, factotumAddr)
+	log.Printf("SSR Templates: %s, Static: %s", s.TemplatesDir, s.StaticDir)
+	return http.ListenAndServe(httpAddr, s)
+}
+
+// NewServer creates an SSR handler configured from the environment.
+func NewServer(kernelAddr, factotumAddr string) *Server {
 	templatesDir := os.Getenv("TEMPLATES_DIR")
 	if templatesDir == "" {
 		templatesDir = "/templates"
@@ -88,16 +99,14 @@ func Start(httpAddr, kernelAddr, factotumAddr string) error {
 		staticDir = "/static"
 	}
 
-	s := &Server{
+	return &Server{
 		KernelAddr:   kernelAddr,
 		FactotumAddr: factotumAddr,
 		TemplatesDir: templatesDir,
 		StaticDir:    staticDir,
+		Origins:      kernel.ParseOrigins(os.Getenv("WS_ORIGINS")),
+		Dialer:       kernel.NewNetworkDialer(),
 	}
-
-	log.Printf("SSR Gateway listening on %s (Kernel: %s, Factotum: %s)", httpAddr, kernelAddr, factotumAddr)
-	log.Printf("SSR Templates: %s, Static: %s", templatesDir, staticDir)
-	return http.ListenAndServe(httpAddr, s)
 }
 
 // ServeHTTP handles incoming HTTP requests.
@@ -315,7 +324,7 @@ func (s *Server) readFile(client *kernel.Client, fid uint32) (string, error) {
 // handleWebSocket handles the "Thin Client" protocol.
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
+		OriginPatterns: s.Origins,
 	})
 	if err != nil {
 		log.Printf("SSR: Failed to accept websocket: %v", err)
@@ -346,7 +355,8 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if msgType != websocket.MessageText {
-			continue
+			c.Close(websocket.StatusUnsupportedData, "text messages only")
+			return
 		}
 
 		msg := string(data)
@@ -480,8 +490,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 // dialFactotumRegister initiates registration
 func (s *Server) dialFactotumRegister(user string) (string, uint32, *kernel.Client, error) {
-	dialer := kernel.NewNetworkDialer()
-	client, err := dialer.Dial(s.FactotumAddr)
+	client, err := s.Dialer.Dial(s.FactotumAddr)
 	if err != nil {
 		return "", 0, nil, err
 	}
@@ -528,6 +537,8 @@ func (s *Server) dialFactotumRegister(user string) (string, uint32, *kernel.Clie
 }
 
 func (s *Server) writeText(ctx context.Context, c *websocket.Conn, msg string) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second) // a stalled browser drops the connection
+	defer cancel()
 	c.Write(ctx, websocket.MessageText, []byte(msg))
 }
 
@@ -543,8 +554,7 @@ func parseParams(parts []string) map[string]string {
 
 // dialKernelAuth connects to the kernel and authenticates with a ticket.
 func (s *Server) dialKernelAuth(user, ticket string) (*kernel.Client, uint32, error) {
-	dialer := kernel.NewNetworkDialer()
-	client, err := dialer.Dial(s.KernelAddr)
+	client, err := s.Dialer.Dial(s.KernelAddr)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -566,8 +576,7 @@ func (s *Server) dialKernelAuth(user, ticket string) (*kernel.Client, uint32, er
 
 // dialFactotumLogin connects to Factotum and requests a ticket for the user.
 func (s *Server) dialFactotumLogin(user string) (string, error) {
-	dialer := kernel.NewNetworkDialer()
-	client, err := dialer.Dial(s.FactotumAddr)
+	client, err := s.Dialer.Dial(s.FactotumAddr)
 	if err != nil {
 		return "", err
 	}
@@ -5,37 +5,56 @@ package vfs
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
+	"embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 
 	p9 "github.com/keaganluttrell/ten/pkg/9p"
+	"golang.org/x/sys/unix"
 )
 
 // --- Server ---
 
 // StartServer starts the VFS 9P server on the given address.
-func StartServer(addr string, root string, trustedKey string) error {
+// If tlsConf is set the server speaks TLS.
+func StartServer(addr string, root string, trustedKey string, tlsConf *tls.Config) error {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	log.Printf("VFS listening on %s, root=%s", addr, root)
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+		log.Printf("VFS listening on %s (TLS), root=%s", addr, root)
+	} else {
+		log.Printf("VFS listening on %s, root=%s", addr, root)
+	}
 
 	backend, err := NewLocalBackend(root)
 	if err != nil {
 		return err
 	}
+	return Serve(l, backend, trustedKey)
+}
 
+// Serve accepts connections on l and serves backend on each until l is closed.
+func Serve(l net.Listener, backend Backend, trustedKey string) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Printf("accept error: %v", err)
 			continue
 		}
@@ -45,6 +64,38 @@ func StartServer(addr string, root string, trustedKey string) error {
 	}
 }
 
+// --- Seed ---
+
+// SeedFS is the initial tree (fs/): users, the namespace file and the
+// directories the Kernel expects.
+//
+//go:embed all:fs
+var SeedFS embed.FS
+
+// Seed copies SeedFS into root, keeping any file that already exists.
+func Seed(root string) error {
+	return fs.WalkDir(SeedFS, "fs", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		localPath := filepath.Join(root, strings.TrimPrefix(name, "fs"))
+		if d.IsDir() {
+			return os.MkdirAll(localPath, 0755)
+		}
+		if d.Name() == ".keep" {
+			return nil
+		}
+		if _, err := os.Stat(localPath); err == nil {
+			return nil
+		}
+		data, err := SeedFS.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(localPath, data, 0644)
+	})
+}
+
 // --- Backend Interface ---
 
 // Backend abstracts the storage layer.
@@ -57,6 +108,7 @@ type Backend interface {
 	Remove(path string) error
 	Rename(oldPath, newPath string) error
 	Chmod(path string, mode uint32) error
+	Chown(path string, uid, gid string) error
 	Truncate(path string, size int64) error
 }
 
@@ -92,7 +144,7 @@ func (b *LocalBackend) Stat(path string) (p9.Dir, error) {
 	if err != nil {
 		return p9.Dir{}, err
 	}
-	return fileInfoToDir(fi), nil
+	return fileInfoToDir(localPath, fi), nil
 }
 
 func (b *LocalBackend) List(path string) ([]p9.Dir, error) {
@@ -112,7 +164,7 @@ func (b *LocalBackend) List(path string) ([]p9.Dir, error) {
 			continue
 		}
 		log.Printf("  - %s", info.Name())
-		dirs = append(dirs, fileInfoToDir(info))
+		dirs = append(dirs, fileInfoToDir(filepath.Join(localPath, info.Name()), info))
 	}
 	log.Printf("List: Returning %d dirs", len(dirs))
 	return dirs, nil
@@ -127,6 +179,11 @@ func (b *LocalBackend) Open(path string, mode uint8) (io.ReadWriteCloser, error)
 		flag = os.O_WRONLY
 	}
 
+	// Append-only files (DMAPPEND, stored as the sticky bit) ignore write offsets
+	if fi, err := os.Stat(localPath); err == nil && isAppend(fi) && flag != os.O_RDONLY {
+		flag |= os.O_APPEND
+	}
+
 	f, err := os.OpenFile(localPath, flag, 0)
 	if err != nil {
 		return nil, err
@@ -144,12 +201,19 @@ func (b *LocalBackend) Open(path string, mode uint8) (io.ReadWriteCloser, error)
 	return f, nil
 }
 
+// isAppend reports whether a regular file is append-only.
+// The local filesystem has no DMAPPEND bit, so it is kept as the sticky bit.
+func isAppend(fi os.FileInfo) bool {
+	return !fi.IsDir() && fi.Mode()&os.ModeSticky != 0
+}
+
 func (b *LocalBackend) Create(path string, perm uint32, mode uint8) (io.ReadWriteCloser, error) {
 	localPath := b.toLocal(path)
 	if perm&p9.DMDIR != 0 {
 		if err := os.Mkdir(localPath, 0755); err != nil {
 			return nil, err
 		}
+		inheritOwner(localPath)
 		f, err := os.Open(localPath)
 		if err != nil {
 			return nil, err
@@ -157,7 +221,25 @@ func (b *LocalBackend) Create(path string, perm uint32, mode uint8) (io.ReadWrit
 		return &DirHandle{f: f}, nil
 	}
 
-	return os.Create(localPath)
+	if perm&p9.DMAPPEND != 0 {
+		f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, os.FileMode(perm&0777))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(localPath, os.FileMode(perm&0777)|os.ModeSticky); err != nil {
+			f.Close()
+			return nil, err
+		}
+		inheritOwner(localPath)
+		return f, nil
+	}
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		return nil, err
+	}
+	inheritOwner(localPath)
+	return f, nil
 }
 
 func (b *LocalBackend) Remove(path string) error {
@@ -169,14 +251,67 @@ func (b *LocalBackend) Rename(oldPath, newPath string) error {
 }
 
 func (b *LocalBackend) Chmod(path string, mode uint32) error {
-	return os.Chmod(b.toLocal(path), os.FileMode(mode&0777))
+	fm := os.FileMode(mode & 0777)
+	if mode&p9.DMAPPEND != 0 {
+		fm |= os.ModeSticky
+	}
+	return os.Chmod(b.toLocal(path), fm)
 }
 
 func (b *LocalBackend) Truncate(path string, size int64) error {
 	return os.Truncate(b.toLocal(path), size)
 }
 
-func fileInfoToDir(fi os.FileInfo) p9.Dir {
+// The local filesystem's owner is the VFS process, so a file's 9P owner
+// and group are kept in extended attributes. Files without them belong to
+// "user" and "group".
+const (
+	xattrUid = "user.ten.uid"
+	xattrGid = "user.ten.gid"
+)
+
+// Chown sets the owner and group of path. An empty name is left unchanged.
+func (b *LocalBackend) Chown(path string, uid, gid string) error {
+	localPath := b.toLocal(path)
+	if uid != "" {
+		if err := unix.Setxattr(localPath, xattrUid, []byte(uid), 0); err != nil {
+			return err
+		}
+	}
+	if gid != "" {
+		if err := unix.Setxattr(localPath, xattrGid, []byte(gid), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOwner returns the owner and group recorded for localPath, or "".
+func getOwner(localPath string) (uid, gid string) {
+	buf := make([]byte, 256)
+	if n, err := unix.Getxattr(localPath, xattrUid, buf); err == nil {
+		uid = string(buf[:n])
+	}
+	if n, err := unix.Getxattr(localPath, xattrGid, buf); err == nil {
+		gid = string(buf[:n])
+	}
+	return uid, gid
+}
+
+// inheritOwner gives a new file the owner and group of its directory.
+// Every user reaches VFS through the Kernel, so VFS cannot tell who
+// created it.
+func inheritOwner(localPath string) {
+	uid, gid := getOwner(filepath.Dir(localPath))
+	if uid != "" {
+		unix.Setxattr(localPath, xattrUid, []byte(uid), 0)
+	}
+	if gid != "" {
+		unix.Setxattr(localPath, xattrGid, []byte(gid), 0)
+	}
+}
+
+func fileInfoToDir(localPath string, fi os.FileInfo) p9.Dir {
 	mode := uint32(fi.Mode() & 0777)
 	qidType := uint8(p9.QTFILE)
 
@@ -184,23 +319,43 @@ func fileInfoToDir(fi os.FileInfo) p9.Dir {
 		mode |= p9.DMDIR
 		qidType = p9.QTDIR
 	}
+	if isAppend(fi) {
+		mode |= p9.DMAPPEND
+		qidType = p9.QTAPPEND
+	}
+
+	uid, gid := getOwner(localPath)
+	if uid == "" {
+		uid = "user"
+	}
+	if gid == "" {
+		gid = "group"
+	}
+
+	// qid.path names the file by device and inode; qid.vers changes with
+	// its mtime or size, so a cached copy of an older version is not used
+	qidPath := uint64(fi.ModTime().UnixNano())
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		qidPath = uint64(st.Dev)<<48 ^ uint64(st.Ino)
+	}
+	vers := uint64(fi.ModTime().UnixNano()) ^ uint64(fi.Size())*0x9E3779B97F4A7C15
 
 	return p9.Dir{
 		Type: 0,
 		Dev:  0,
 		Qid: p9.Qid{
 			Type: qidType,
-			Vers: 0,
-			Path: uint64(fi.ModTime().UnixNano()),
+			Vers: uint32(vers ^ vers>>32),
+			Path: qidPath,
 		},
 		Mode:   mode,
 		Atime:  uint32(fi.ModTime().Unix()),
 		Mtime:  uint32(fi.ModTime().Unix()),
 		Length: uint64(fi.Size()),
 		Name:   fi.Name(),
-		Uid:    "user",
-		Gid:    "group",
-		Muid:   "user",
+		Uid:    uid,
+		Gid:    gid,
+		Muid:   uid,
 	}
 }
 
@@ -224,7 +379,7 @@ func (d *DirHandle) Read(p []byte) (n int, err error) {
 		log.Printf("DirHandle: Found %d entries", len(dirs))
 		for _, fi := range dirs {
 			log.Printf("  - %s", fi.Name())
-			p9d := fileInfoToDir(fi)
+			p9d := fileInfoToDir(filepath.Join(d.f.Name(), fi.Name()), fi)
 			d.data = append(d.data, p9d.Bytes()...)
 		}
 		d.loaded = true
@@ -256,6 +411,7 @@ type Session struct {
 	trustedKey ed25519.PublicKey
 	fids       map[uint32]*Fid
 	mu         sync.Mutex
+	privileged bool // attached as kernel, host or adm
 }
 
 type Fid struct {
@@ -273,6 +429,10 @@ type Fid struct {
 	AuthSuccess bool
 }
 
+// HostAuthContext prefixes the nonce a host signs in Host Authentication,
+// so the signature is good for nothing else (see kernel.HostAuthContext).
+const HostAuthContext = "ten-host\x00"
+
 func NewSession(conn net.Conn, backend Backend, trustedKeyB64 string) *Session {
 	var key ed25519.PublicKey
 	if trustedKeyB64 != "" {
@@ -376,6 +536,11 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 		fid.Dir = (d.Qid.Type & p9.QTDIR) != 0
 		s.putFid(req.Fid, fid)
+		if isPrivileged {
+			s.mu.Lock()
+			s.privileged = true
+			s.mu.Unlock()
+		}
 		resp.Qid = d.Qid
 
 	case p9.Twalk:
@@ -432,6 +597,12 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 
 		if !fid.Dir {
+			if req.Mode&p9.OTRUNC != 0 && s.appendOnly(fid.Path) {
+				return rError(req, "cannot truncate append-only file")
+			}
+			if (req.Mode&3 != p9.OREAD || req.Mode&p9.OTRUNC != 0) && s.admOwned(fid.Path) {
+				return rError(req, "permission denied")
+			}
 			f, err := s.backend.Open(fid.Path, req.Mode)
 			if err != nil {
 				return rError(req, err.Error())
@@ -463,6 +634,13 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 
 		newPath := resolveJoin(fid.Path, req.Name)
+		// Create truncates an existing file
+		if s.appendOnly(newPath) {
+			return rError(req, "cannot truncate append-only file")
+		}
+		if s.admOwned(fid.Path) || s.admOwned(newPath) {
+			return rError(req, "permission denied")
+		}
 		f, err := s.backend.Create(newPath, req.Perm, req.Mode)
 		if err != nil {
 			return rError(req, err.Error())
@@ -545,7 +723,7 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 				return rError(req, "invalid signature length")
 			}
 
-			if ed25519.Verify(s.trustedKey, fid.AuthNonce, sig) {
+			if ed25519.Verify(s.trustedKey, append([]byte(HostAuthContext), fid.AuthNonce...), sig) {
 				fid.AuthSuccess = true
 				resp.Count = uint32(len(sig))
 			} else {
@@ -591,6 +769,12 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 			return rError(req, "permission denied")
 		}
 
+		if s.appendOnly(fid.Path) {
+			return rError(req, "cannot remove append-only file")
+		}
+		if s.admOwned(fid.Path) || s.admOwned(resolveParent(fid.Path)) {
+			return rError(req, "permission denied")
+		}
 		err := s.backend.Remove(fid.Path)
 		if err != nil {
 			return rError(req, err.Error())
@@ -618,10 +802,19 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		if err != nil {
 			return rError(req, "stat failed: "+err.Error())
 		}
+		if s.admOwned(fid.Path) {
+			return rError(req, "permission denied")
+		}
 
 		if newDir.Name != "" && newDir.Name != oldDir.Name {
 			parentPath := resolveParent(fid.Path)
 			newPath := resolveJoin(parentPath, newDir.Name)
+			if s.appendOnly(fid.Path) || s.appendOnly(newPath) {
+				return rError(req, "cannot rename append-only file")
+			}
+			if s.admOwned(newPath) || s.admOwned(parentPath) {
+				return rError(req, "permission denied")
+			}
 			if err := s.backend.Rename(fid.Path, newPath); err != nil {
 				return rError(req, "rename failed: "+err.Error())
 			}
@@ -629,12 +822,28 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 		}
 
 		if newDir.Mode != 0xFFFFFFFF && newDir.Mode != oldDir.Mode {
+			if newDir.Mode&p9.DMAPPEND == 0 && s.appendOnly(fid.Path) {
+				return rError(req, "cannot clear append-only")
+			}
 			if err := s.backend.Chmod(fid.Path, newDir.Mode); err != nil {
 				return rError(req, "chmod failed: "+err.Error())
 			}
 		}
 
+		// Only a privileged attach may give a file away
+		if (newDir.Uid != "" && newDir.Uid != oldDir.Uid) || (newDir.Gid != "" && newDir.Gid != oldDir.Gid) {
+			if !s.isPrivileged() {
+				return rError(req, "permission denied")
+			}
+			if err := s.backend.Chown(fid.Path, newDir.Uid, newDir.Gid); err != nil {
+				return rError(req, "chown failed: "+err.Error())
+			}
+		}
+
 		if newDir.Length != 0xFFFFFFFFFFFFFFFF && newDir.Length != oldDir.Length {
+			if oldDir.Mode&p9.DMAPPEND != 0 && !s.isPrivileged() {
+				return rError(req, "cannot truncate append-only file")
+			}
 			if err := s.backend.Truncate(fid.Path, int64(newDir.Length)); err != nil {
 				return rError(req, "truncate failed: "+err.Error())
 			}
@@ -649,6 +858,34 @@ func (s *Session) handle(req *p9.Fcall) *p9.Fcall {
 	return resp
 }
 
+func (s *Session) isPrivileged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.privileged
+}
+
+// appendOnly reports whether path is a DMAPPEND file that this session
+// may only append to: only a privileged attach may truncate or remove one.
+func (s *Session) appendOnly(path string) bool {
+	if s.isPrivileged() {
+		return false
+	}
+	d, err := s.backend.Stat(path)
+	return err == nil && d.Mode&p9.DMAPPEND != 0
+}
+
+// admOwned reports whether path is owned by adm and this session may not
+// change it: only a privileged attach may modify an adm file, or create or
+// remove one in an adm directory. The Kernel takes policy, like /adm/limits,
+// only from adm files.
+func (s *Session) admOwned(path string) bool {
+	if s.isPrivileged() {
+		return false
+	}
+	d, err := s.backend.Stat(path)
+	return err == nil && d.Uid == "adm"
+}
+
 func (s *Session) getFid(id uint32) (*Fid, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,321 @@
+package vfs
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	p9 "github.com/keaganluttrell/ten/pkg/9p"
+)
+
+// testConn is the client end of a Session served over a pipe.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+func serveTest(t *testing.T, backend Backend, pub ed25519.PublicKey) *testConn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	go NewSession(c2, backend, base64.StdEncoding.EncodeToString(pub)).Serve()
+	t.Cleanup(func() { c1.Close() })
+	return &testConn{t: t, conn: c1}
+}
+
+// rpc sends req and returns the reply, which may be an Rerror.
+func (c *testConn) rpc(req *p9.Fcall) *p9.Fcall {
+	c.t.Helper()
+	c.tag++
+	req.Tag = c.tag
+	b, err := req.Bytes()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := p9.ReadFcall(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+func (c *testConn) mustRPC(req *p9.Fcall) *p9.Fcall {
+	c.t.Helper()
+	resp := c.rpc(req)
+	if resp.Type == p9.Rerror {
+		c.t.Fatalf("%s: %s", p9.TypeName(req.Type), resp.Ename)
+	}
+	return resp
+}
+
+// attach attaches as uname at fid 0, host-authenticating with priv if set.
+func (c *testConn) attach(uname string, priv ed25519.PrivateKey) {
+	c.t.Helper()
+	c.mustRPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+	afid := p9.NOFID
+	if priv != nil {
+		afid = 100
+		c.mustRPC(&p9.Fcall{Type: p9.Tauth, Afid: afid, Uname: uname})
+		nonce := c.mustRPC(&p9.Fcall{Type: p9.Tread, Fid: afid, Count: 32}).Data
+		c.mustRPC(&p9.Fcall{Type: p9.Twrite, Fid: afid, Data: ed25519.Sign(priv, append([]byte(HostAuthContext), nonce...))})
+	}
+	c.mustRPC(&p9.Fcall{Type: p9.Tattach, Fid: 0, Afid: afid, Uname: uname})
+}
+
+// walk clones fid 0 to newfid at path.
+func (c *testConn) walk(newfid uint32, path ...string) {
+	c.t.Helper()
+	c.mustRPC(&p9.Fcall{Type: p9.Twalk, Fid: 0, Newfid: newfid, Wname: path})
+}
+
+// wstat returns a Twstat of fid that changes only what set fills in.
+func wstat(fid uint32, set func(d *p9.Dir)) *p9.Fcall {
+	d := p9.Dir{Type: 0xFFFF, Dev: 0xFFFFFFFF, Mode: 0xFFFFFFFF, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF, Length: 0xFFFFFFFFFFFFFFFF}
+	d.Qid = p9.Qid{Type: 0xFF, Vers: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF}
+	set(&d)
+	return &p9.Fcall{Type: p9.Twstat, Fid: fid, Stat: d.Bytes()}
+}
+
+func TestAppendOnly(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adm := serveTest(t, backend, pub)
+	adm.attach("adm", priv)
+	adm.walk(1)
+	adm.mustRPC(&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "log", Perm: p9.DMAPPEND | 0640, Mode: p9.OWRITE})
+	adm.mustRPC(&p9.Fcall{Type: p9.Twrite, Fid: 1, Data: []byte("one\n")})
+	adm.mustRPC(&p9.Fcall{Type: p9.Tclunk, Fid: 1})
+
+	d, err := backend.Stat("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode != p9.DMAPPEND|0640 {
+		t.Fatalf("mode = %#o, want %#o", d.Mode, p9.DMAPPEND|0640)
+	}
+
+	user := serveTest(t, backend, pub)
+	user.attach("none", nil)
+
+	tests := []struct {
+		name string
+		req  func() *p9.Fcall
+		ok   bool
+	}{
+		{"open append", func() *p9.Fcall {
+			user.walk(1, "log")
+			return &p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OWRITE}
+		}, true},
+		{"open truncate", func() *p9.Fcall {
+			user.walk(2, "log")
+			return &p9.Fcall{Type: p9.Topen, Fid: 2, Mode: p9.OWRITE | p9.OTRUNC}
+		}, false},
+		{"create over", func() *p9.Fcall {
+			user.walk(3)
+			return &p9.Fcall{Type: p9.Tcreate, Fid: 3, Name: "log", Perm: 0666, Mode: p9.OWRITE}
+		}, false},
+		{"wstat length", func() *p9.Fcall {
+			user.walk(4, "log")
+			return wstat(4, func(d *p9.Dir) { d.Length = 0 })
+		}, false},
+		{"wstat clear append", func() *p9.Fcall {
+			user.walk(5, "log")
+			return wstat(5, func(d *p9.Dir) { d.Mode = 0666 })
+		}, false},
+		{"wstat rename", func() *p9.Fcall {
+			user.walk(6, "log")
+			return wstat(6, func(d *p9.Dir) { d.Name = "old" })
+		}, false},
+		{"remove", func() *p9.Fcall {
+			user.walk(7, "log")
+			return &p9.Fcall{Type: p9.Tremove, Fid: 7}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := user.rpc(tt.req())
+			if ok := resp.Type != p9.Rerror; ok != tt.ok {
+				t.Fatalf("got %s %q, want ok=%v", p9.TypeName(resp.Type), resp.Ename, tt.ok)
+			}
+		})
+	}
+
+	if d, err := backend.Stat("/log"); err != nil || d.Length != 4 {
+		t.Fatalf("log after user: %+v, %v", d, err)
+	}
+
+	// The privileged attach may still truncate and remove it
+	adm.walk(2, "log")
+	adm.mustRPC(wstat(2, func(d *p9.Dir) { d.Length = 0 }))
+	adm.mustRPC(&p9.Fcall{Type: p9.Tremove, Fid: 2})
+}
+
+func TestAdmOwned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adm := serveTest(t, backend, pub)
+	adm.attach("adm", priv)
+	adm.walk(1)
+	adm.mustRPC(&p9.Fcall{Type: p9.Tcreate, Fid: 1, Name: "adm", Perm: p9.DMDIR | 0775, Mode: p9.OREAD})
+	adm.walk(2, "adm")
+	adm.mustRPC(&p9.Fcall{Type: p9.Tcreate, Fid: 2, Name: "limits", Perm: 0664, Mode: p9.OWRITE})
+	adm.mustRPC(&p9.Fcall{Type: p9.Twrite, Fid: 2, Data: []byte("none sessions=1\n")})
+	for _, path := range []string{"/adm", "/adm/limits"} {
+		if err := backend.Chown(path, "adm", "adm"); err != nil {
+			t.Skipf("no extended attributes here: %v", err)
+		}
+	}
+
+	user := serveTest(t, backend, pub)
+	user.attach("none", nil)
+
+	tests := []struct {
+		name string
+		req  func() *p9.Fcall
+		ok   bool
+	}{
+		{"open read", func() *p9.Fcall {
+			user.walk(1, "adm", "limits")
+			return &p9.Fcall{Type: p9.Topen, Fid: 1, Mode: p9.OREAD}
+		}, true},
+		{"open write", func() *p9.Fcall {
+			user.walk(2, "adm", "limits")
+			return &p9.Fcall{Type: p9.Topen, Fid: 2, Mode: p9.OWRITE}
+		}, false},
+		{"open read truncate", func() *p9.Fcall {
+			user.walk(3, "adm", "limits")
+			return &p9.Fcall{Type: p9.Topen, Fid: 3, Mode: p9.OREAD | p9.OTRUNC}
+		}, false},
+		{"create over", func() *p9.Fcall {
+			user.walk(4, "adm")
+			return &p9.Fcall{Type: p9.Tcreate, Fid: 4, Name: "limits", Perm: 0666, Mode: p9.OWRITE}
+		}, false},
+		{"create beside", func() *p9.Fcall {
+			user.walk(5, "adm")
+			return &p9.Fcall{Type: p9.Tcreate, Fid: 5, Name: "keys", Perm: 0666, Mode: p9.OWRITE}
+		}, false},
+		{"wstat owner", func() *p9.Fcall {
+			user.walk(6, "adm", "limits")
+			return wstat(6, func(d *p9.Dir) { d.Uid = "none" })
+		}, false},
+		{"wstat rename", func() *p9.Fcall {
+			user.walk(7, "adm", "limits")
+			return wstat(7, func(d *p9.Dir) { d.Name = "old" })
+		}, false},
+		{"remove", func() *p9.Fcall {
+			user.walk(8, "adm", "limits")
+			return &p9.Fcall{Type: p9.Tremove, Fid: 8}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := user.rpc(tt.req())
+			if ok := resp.Type != p9.Rerror; ok != tt.ok {
+				t.Fatalf("got %s %q, want ok=%v", p9.TypeName(resp.Type), resp.Ename, tt.ok)
+			}
+		})
+	}
+
+	if d, err := backend.Stat("/adm/limits"); err != nil || d.Uid != "adm" || d.Length == 0 {
+		t.Fatalf("limits after user: %+v, %v", d, err)
+	}
+}
+
+func TestQid(t *testing.T) {
+	root := t.TempDir()
+	backend, err := NewLocalBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	write := func(name, data string) p9.Qid {
+		t.Helper()
+		local := filepath.Join(root, name)
+		if err := os.WriteFile(local, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(local, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		d, err := backend.Stat("/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Qid
+	}
+
+	a, b := write("a", "one"), write("b", "one")
+	if a.Path == b.Path {
+		t.Errorf("a and b with the same mtime share qid.path %#x", a.Path)
+	}
+	tests := []struct {
+		name, data string
+		same       bool
+	}{
+		{"unchanged", "one", true},
+		{"grown, same mtime", "one more", false},
+		{"shrunk, same mtime", "on", false},
+	}
+	prev := a
+	for _, tt := range tests {
+		q := write("a", tt.data)
+		if q.Path != a.Path {
+			t.Errorf("%s: qid.path changed from %#x to %#x", tt.name, a.Path, q.Path)
+		}
+		if (q.Vers == prev.Vers) != tt.same {
+			t.Errorf("%s: qid.vers %d after %d, want same=%v", tt.name, q.Vers, prev.Vers, tt.same)
+		}
+		prev = q
+	}
+}
+
+func TestHostAuthContext(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		sign func(nonce []byte) []byte
+		ok   bool
+	}{
+		{"with context", func(nonce []byte) []byte { return ed25519.Sign(priv, append([]byte(HostAuthContext), nonce...)) }, true},
+		{"bare nonce", func(nonce []byte) []byte { return ed25519.Sign(priv, nonce) }, false},
+	}
+	for _, tt := range tests {
+		c := serveTest(t, backend, pub)
+		c.mustRPC(&p9.Fcall{Type: p9.Tversion, Msize: 8192, Version: "9P2000"})
+		c.mustRPC(&p9.Fcall{Type: p9.Tauth, Afid: 100, Uname: "kernel"})
+		nonce := c.mustRPC(&p9.Fcall{Type: p9.Tread, Fid: 100, Count: 32}).Data
+		resp := c.rpc(&p9.Fcall{Type: p9.Twrite, Fid: 100, Data: tt.sign(nonce)})
+		if (resp.Type != p9.Rerror) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.name, resp, tt.ok)
+		}
+	}
+}